@@ -0,0 +1,48 @@
+package api
+
+import (
+	"io"
+	"notification-service/model"
+	"strconv"
+	"strings"
+)
+
+// writeSseRetry writes the retry field of the Server-Sent Events protocol, which tells the client how many milliseconds it
+// should wait before reconnecting after the connection is lost
+func writeSseRetry(w io.Writer, retryMilliseconds int) error {
+	_, err := io.WriteString(w, "retry: "+strconv.Itoa(retryMilliseconds)+"\n\n")
+	return err
+}
+
+// writeSseNotification writes the given notification as a single Server-Sent Events frame
+// The notification id is used as the event id (so the client can resume from it by the Last-Event-ID header), the subject as
+// the event type, and the body is split into multiple data fields, since a data field must not contain line breaks
+func writeSseNotification(w io.Writer, notification model.Notification) error {
+	var frame strings.Builder
+	if notification.Id != "" {
+		frame.WriteString("id: " + sanitizeSseField(notification.Id) + "\n")
+	}
+	if notification.Subject != "" {
+		frame.WriteString("event: " + sanitizeSseField(notification.Subject) + "\n")
+	}
+	body := strings.ReplaceAll(notification.Body, "\r\n", "\n")
+	body = strings.ReplaceAll(body, "\r", "\n")
+	for _, line := range strings.Split(body, "\n") {
+		frame.WriteString("data: " + line + "\n")
+	}
+	frame.WriteString("\n")
+	_, err := io.WriteString(w, frame.String())
+	return err
+}
+
+// writeSseError writes an error event with the given error code as data, it is sent right before the server closes the
+// stream because it can no longer serve it
+func writeSseError(w io.Writer, code string) error {
+	_, err := io.WriteString(w, "event: error\ndata: "+sanitizeSseField(code)+"\n\n")
+	return err
+}
+
+// sanitizeSseField removes line breaks from single line fields, since they would terminate the field
+func sanitizeSseField(value string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"notification-service/model"
+	"strings"
+	"testing"
+)
+
+func TestWriteSseNotification(t *testing.T) {
+	var frame strings.Builder
+	notification := model.Notification{Id: "id\n1", Subject: "subject", Body: "first\r\nsecond\rthird\n"}
+	if err := writeSseNotification(&frame, notification); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "id: id 1\nevent: subject\ndata: first\ndata: second\ndata: third\ndata: \n\n"
+	if frame.String() != expected {
+		t.Fatalf("unexpected frame: %q", frame.String())
+	}
+}
+
+func TestWriteSseNotificationWithoutIdAndSubject(t *testing.T) {
+	var frame strings.Builder
+	if err := writeSseNotification(&frame, model.Notification{Body: "body"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frame.String() != "data: body\n\n" {
+		t.Fatalf("unexpected frame: %q", frame.String())
+	}
+}
+
+func TestWriteSseRetryAndError(t *testing.T) {
+	var frames strings.Builder
+	if err := writeSseRetry(&frames, 3000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writeSseError(&frames, "ERROR\nCODE"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "retry: 3000\n\nevent: error\ndata: ERROR CODE\n\n"
+	if frames.String() != expected {
+		t.Fatalf("unexpected frames: %q", frames.String())
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"notification-service/model"
+	"sync"
+	"time"
+)
+
+// groupBarrier keeps the order of the notifications of ordered message groups (e.g. FIFO queues) when a delivery fails
+// The broker does not hand out the next notification of a group while the previous one is in flight, however the successors
+// received in the same batch are already on their way to the dispatcher. If one of them were delivered while the failed
+// notification waits for its redelivery, the order would be broken, thus they are held back until the failed notification
+// comes back (or until ttl elapses)
+type groupBarrier struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	blocked map[string]blockedGroup
+}
+
+type blockedGroup struct {
+	failedId  string
+	expiresAt time.Time
+}
+
+// newGroupBarrier creates a new groupBarrier, which blocks the groups for at most ttl
+func newGroupBarrier(ttl time.Duration) *groupBarrier {
+	return &groupBarrier{
+		ttl:     ttl,
+		blocked: make(map[string]blockedGroup),
+	}
+}
+
+// Blocked reports whether the notification has to be held back, since an earlier notification of its group has failed
+// The redelivery of the failed notification itself is not blocked, it unblocks the group instead
+func (b *groupBarrier) Blocked(meta model.NotificationMeta) bool {
+	if meta.GroupId == "" {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := groupBarrierKey(meta)
+	group, ok := b.blocked[key]
+	if !ok {
+		return false
+	}
+	if group.failedId == meta.Notification.Id || time.Now().After(group.expiresAt) {
+		delete(b.blocked, key)
+		return false
+	}
+	return true
+}
+
+// Fail blocks the group of the failed notification
+func (b *groupBarrier) Fail(meta model.NotificationMeta) {
+	if meta.GroupId == "" {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := groupBarrierKey(meta)
+	if _, ok := b.blocked[key]; ok {
+		//The group is already blocked by an earlier notification, which will be redelivered first
+		return
+	}
+	b.blocked[key] = blockedGroup{failedId: meta.Notification.Id, expiresAt: time.Now().Add(b.ttl)}
+}
+
+// PruneAll removes the expired blocks
+func (b *groupBarrier) PruneAll() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	for key, group := range b.blocked {
+		if now.After(group.expiresAt) {
+			delete(b.blocked, key)
+		}
+	}
+}
+
+func groupBarrierKey(meta model.NotificationMeta) string {
+	return meta.QueueUrl + "/" + meta.GroupId
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"notification-service/common/common"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"os"
+	"time"
+)
+
+// GetInstances returns the live instances of the service, whose heartbeat has been renewed within INSTANCE_STALE_SECONDS
+// (ServiceInstanceQueue mode only)
+func (s *NotificationService) GetInstances(c *gin.Context) {
+	instances, err := s.d.GetLiveInstances(s.instanceStaleAfter)
+	if err != nil {
+		s.zLog.Error("Error while listing the instances", zap.String("trace-id:", c.GetHeader("trace-id")), zap.Any("error", err))
+		common.ErrorResponse(c, 500, ErrorInternalServerError, "Instances could not be listed", c.GetHeader("trace-id"))
+		return
+	}
+	c.JSON(200, gin.H{"instances": instances})
+}
+
+// registerInstance adds the instance to the instance registry
+func (s *NotificationService) registerInstance() error {
+	host, err := os.Hostname()
+	if err != nil {
+		host = ""
+	}
+	return s.d.RegisterInstance(model.Instance{
+		Id:        s.serviceInstanceId,
+		QueueUrl:  *s.queueUrl,
+		OwnsQueue: s.ownsQueue && s.deleteQueue,
+		Host:      host,
+		Version:   common.Version,
+		StartedAt: s.startedAt,
+		UserCount: s.sessions.UserCount(),
+	})
+}
+
+// heartbeatInstance renews the heartbeat of the instance periodically, until the service is closed
+// The stale instances are purged together with their session leases, and the queues they created are retired
+// If the entry of this instance is missing (e.g. the heartbeat could not be renewed for a while and the entry has been
+// purged), its queue might be retired by the instance which has purged it, if it created its queue. Then the instance
+// fails, thus it stops accepting sessions and gets restarted, otherwise it registers itself again and restores the
+// leases of its clients
+func (s *NotificationService) heartbeatInstance(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.d.HeartbeatInstance(s.serviceInstanceId, s.sessions.UserCount())
+			if errors.Is(err, commonmodel.ErrInstanceNotRegistered) {
+				if s.ownsQueue && s.deleteQueue {
+					s.fail(err)
+					return
+				}
+				s.zLog.Warn("Instance is missing from the registry, registering it again")
+				err = s.registerInstance()
+				if err == nil {
+					err = s.d.RestoreSessionLeases(s.serviceInstanceId, *s.queueUrl, s.sessions.SessionCounts(), s.sessionLeaseTtl)
+				}
+			}
+			if err != nil {
+				s.zLog.Error("Error while renewing the heartbeat of the instance", zap.Any("error", err))
+			}
+			purged, err := s.d.PurgeStaleInstances(s.instanceStaleAfter)
+			if err != nil {
+				s.zLog.Error("Error while purging the stale instances", zap.Any("error", err))
+			}
+			for _, instance := range purged {
+				s.zLog.Info("Stale instance purged", zap.String("instanceId", instance.Id), zap.String("queueUrl", instance.QueueUrl))
+				//The queue created by the instance is left behind if the instance crashed
+				if instance.OwnsQueue {
+					go s.retireStaleQueue(instance)
+				}
+			}
+		}
+	}
+}
+
+// retireStaleQueue retires the queue created by a purged instance, the queue is kept if the instance has registered
+// itself again in the meantime, since then it still consumes the queue
+func (s *NotificationService) retireStaleQueue(instance model.Instance) {
+	s.retireQueue(instance.QueueUrl, func() bool {
+		registered, err := s.d.IsInstanceRegistered(instance.Id)
+		if err != nil {
+			s.zLog.Error("Error while checking the registration of the purged instance, keeping its queue", zap.String("instanceId", instance.Id), zap.String("queueUrl", instance.QueueUrl), zap.Any("error", err))
+			return false
+		}
+		return !registered
+	})
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"go.uber.org/zap"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/common/session"
+	"notification-service/database"
+	"notification-service/model"
+	"sync"
+	"testing"
+	"time"
+)
+
+// purgedRegistry reports the instance as purged from the registry until it registers itself again
+type purgedRegistry struct {
+	database.DatabaseInterface
+	mutex    sync.Mutex
+	entries  map[string]model.Instance
+	restored map[string]int
+}
+
+func (f *purgedRegistry) HeartbeatInstance(instanceId string, userCount int) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.entries[instanceId]; !ok {
+		return commonmodel.ErrInstanceNotRegistered
+	}
+	return nil
+}
+
+func (f *purgedRegistry) RegisterInstance(instance model.Instance) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.entries[instance.Id] = instance
+	return nil
+}
+
+func (f *purgedRegistry) RestoreSessionLeases(serviceId string, queueUrl string, sessionCounts map[string]int, ttl time.Duration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.restored = sessionCounts
+	return nil
+}
+
+func (f *purgedRegistry) PurgeStaleInstances(staleAfter time.Duration) (instances []model.Instance, err error) {
+	return nil, nil
+}
+
+func (f *purgedRegistry) Restored() map[string]int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.restored
+}
+
+func newRegistryTestService(d database.DatabaseInterface, ownsQueue bool) (*NotificationService, *session.Session) {
+	ctx, cancel := context.WithCancel(context.Background())
+	service := &NotificationService{
+		zLog:              *zap.NewNop(),
+		d:                 d,
+		sessions:          session.NewRegistry(1),
+		serviceInstanceId: "purged",
+		queueUrl:          &[]string{"prefix-purged"}[0],
+		ownsQueue:         ownsQueue,
+		deleteQueue:       true,
+		ctx:               ctx,
+		cancel:            cancel,
+		failed:            make(chan struct{}),
+	}
+	clientSession := session.NewSession("s1", "u1", "d1", "t1")
+	_ = service.sessions.Register(clientSession, func() error { return nil })
+	return service, clientSession
+}
+
+func TestPurgedInstanceWithOwnQueueFails(t *testing.T) {
+	service, clientSession := newRegistryTestService(&purgedRegistry{entries: make(map[string]model.Instance)}, true)
+	defer service.cancel()
+	go service.heartbeatInstance(10 * time.Millisecond)
+	select {
+	case <-service.Failed():
+	case <-time.After(time.Second):
+		t.Fatalf("the purged instance has not failed")
+	}
+	select {
+	case <-clientSession.Terminated():
+	case <-time.After(time.Second):
+		t.Fatalf("the session of the failed instance has not been terminated")
+	}
+	if _, err := service.openSession("u2", "d2", "t2"); err != commonmodel.ErrInstanceFailed {
+		t.Fatalf("unexpected error of a new session: %v", err)
+	}
+}
+
+func TestPurgedInstanceWithProvisionedQueueRestoresLeases(t *testing.T) {
+	registry := &purgedRegistry{entries: make(map[string]model.Instance)}
+	service, clientSession := newRegistryTestService(registry, false)
+	defer service.cancel()
+	go service.heartbeatInstance(10 * time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for registry.Restored() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("the session leases have not been restored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := registry.Restored()["u1"]; count != 1 {
+		t.Fatalf("unexpected restored leases: %v", registry.Restored())
+	}
+	select {
+	case <-service.Failed():
+		t.Fatalf("the instance has failed")
+	case <-clientSession.Terminated():
+		t.Fatalf("the session has been terminated")
+	default:
+	}
+}
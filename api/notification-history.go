@@ -0,0 +1,88 @@
+package api
+
+import (
+	"notification-service/model"
+	"sync"
+	"time"
+)
+
+// notificationHistory keeps the most recent notifications handed over to each user, so a reconnecting client can receive
+// the ones it missed since the last event id it has seen
+type notificationHistory struct {
+	mutex   sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string][]historyEntry
+}
+
+type historyEntry struct {
+	notification model.Notification
+	recordedAt   time.Time
+}
+
+// newNotificationHistory creates a new notificationHistory, which keeps at most size notifications per user for ttl
+func newNotificationHistory(size int, ttl time.Duration) *notificationHistory {
+	return &notificationHistory{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string][]historyEntry),
+	}
+}
+
+// Record stores the given notification in the history of its addressee
+func (h *notificationHistory) Record(notification model.Notification) {
+	if h.size <= 0 {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	entries := append(h.entries[notification.Addressee], historyEntry{notification: notification, recordedAt: time.Now()})
+	if len(entries) > h.size {
+		entries = entries[len(entries)-h.size:]
+	}
+	h.entries[notification.Addressee] = entries
+}
+
+// Since returns the notifications of the given user recorded after the notification with the given id
+// If the id is not known (e.g.: it has already expired from the history), nothing is returned, since we cannot tell which
+// of the recorded notifications the client has already seen, and replaying all of them would deliver duplicates
+func (h *notificationHistory) Since(user string, lastEventId string) (notifications []model.Notification) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	entries := h.prune(user, time.Now())
+	for i, entry := range entries {
+		if entry.notification.Id == lastEventId {
+			for _, missed := range entries[i+1:] {
+				notifications = append(notifications, missed.notification)
+			}
+			break
+		}
+	}
+	return notifications
+}
+
+// PruneAll removes the expired entries of every user
+func (h *notificationHistory) PruneAll() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	now := time.Now()
+	for user := range h.entries {
+		h.prune(user, now)
+	}
+}
+
+// prune removes the expired entries of the given user and returns the remaining ones, the caller must hold the mutex
+func (h *notificationHistory) prune(user string, now time.Time) []historyEntry {
+	entries := h.entries[user]
+	expired := 0
+	for expired < len(entries) && now.Sub(entries[expired].recordedAt) > h.ttl {
+		expired++
+	}
+	entries = entries[expired:]
+	if len(entries) == 0 {
+		delete(h.entries, user)
+		return nil
+	}
+	h.entries[user] = entries
+	return entries
+}
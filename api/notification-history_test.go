@@ -0,0 +1,42 @@
+package api
+
+import (
+	"notification-service/model"
+	"testing"
+	"time"
+)
+
+func TestNotificationHistorySince(t *testing.T) {
+	history := newNotificationHistory(3, time.Minute)
+	for _, id := range []string{"1", "2", "3", "4"} {
+		history.Record(model.Notification{Id: id, Addressee: "u1"})
+	}
+	missed := history.Since("u1", "2")
+	if len(missed) != 2 || missed[0].Id != "3" || missed[1].Id != "4" {
+		t.Fatalf("unexpected notifications: %v", missed)
+	}
+	if missed := history.Since("u1", "4"); len(missed) != 0 {
+		t.Fatalf("unexpected notifications after the last one: %v", missed)
+	}
+	//The first notification has been evicted, the client cannot be told which notifications it has missed
+	if missed := history.Since("u1", "1"); len(missed) != 0 {
+		t.Fatalf("unexpected notifications after an evicted id: %v", missed)
+	}
+	if missed := history.Since("u2", "2"); len(missed) != 0 {
+		t.Fatalf("unexpected notifications of another user: %v", missed)
+	}
+}
+
+func TestNotificationHistoryExpires(t *testing.T) {
+	history := newNotificationHistory(10, 50*time.Millisecond)
+	history.Record(model.Notification{Id: "1", Addressee: "u1"})
+	history.Record(model.Notification{Id: "2", Addressee: "u1"})
+	time.Sleep(100 * time.Millisecond)
+	if missed := history.Since("u1", "1"); len(missed) != 0 {
+		t.Fatalf("unexpected notifications after an expired id: %v", missed)
+	}
+	history.PruneAll()
+	if len(history.entries) != 0 {
+		t.Fatalf("the expired entries have not been pruned: %v", history.entries)
+	}
+}
@@ -1,37 +1,71 @@
 package api
 
 import (
+	"context"
 	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
+	"notification-service/common/broker"
 	"notification-service/common/common"
 	commonmodel "notification-service/common/common-model"
+	"notification-service/common/dedup"
+	"notification-service/common/nats"
+	"notification-service/common/session"
 	sqs "notification-service/common/sqs"
 	"notification-service/database"
 	"notification-service/factory"
 	"notification-service/model"
 	"strconv"
+	"sync"
 	"time"
 )
 
 const ErrorInvalidJwt = "ERROR_INVALID_JWT"
 const ErrorInternalServerError = "ERROR_INTERNAL_SERVER_ERROR"
+const ErrorNotificationNotFound = "ERROR_NOTIFICATION_NOT_FOUND"
+const ErrorServiceUnavailable = "ERROR_SERVICE_UNAVAILABLE"
 
 // NotificationService is an object type that implements all the functionalities to handle incoming messages and deliver them to the addressee
 type NotificationService struct {
-	F                 factory.FactoryInterface
-	zLog              zap.Logger
-	d                 database.DatabaseInterface
-	sqs               sqs.SqsServiceInterface
-	sessions          map[string]chan string
-	maxTimeoutSeconds int
-	serviceInstanceId string
-	queueUrl          *string
-	receiveMessage    chan model.NotificationMeta
-	doneChannel       chan interface{}
-	operationMode     commonmodel.OperationMode
-	userQueueBaseUrl  *string
+	F                  factory.FactoryInterface
+	zLog               zap.Logger
+	d                  database.DatabaseInterface
+	broker             broker.Broker
+	sessions           *session.Registry
+	userSubscriptions  *sync.Map
+	history            *notificationHistory
+	ackRequired        bool
+	pendingAcks        *pendingAcknowledgements
+	leaser             *broker.Leaser
+	barrier            *groupBarrier
+	releases           *releaseBackoff
+	dedup              dedup.Cache
+	routes             *routeCache
+	sessionLeaseTtl    time.Duration
+	instanceStaleAfter time.Duration
+	startedAt          time.Time
+	maxTimeoutSeconds  int
+	sseRetryMs         int
+	wsPingInterval     time.Duration
+	deliveryTimeout    time.Duration
+	wsUpgrader         websocket.Upgrader
+	serviceInstanceId  string
+	queueUrl           *string
+	queueNamePrefix    string
+	queueNameSuffix    string
+	ownsQueue          bool
+	deleteQueue        bool
+	drainTimeout       time.Duration
+	receiveMessage     chan model.NotificationMeta
+	ctx                context.Context
+	cancel             context.CancelFunc
+	failed             chan struct{}
+	failOnce           sync.Once
+	operationMode      commonmodel.OperationMode
+	userQueueBaseUrl   *string
+	userSubjectPrefix  string
 }
 
 // NewNotificationService is a factory function that creates a new NotificationService instance
@@ -47,66 +81,263 @@ func NewNotificationService(factory factory.FactoryInterface) *NotificationServi
 	if err != nil {
 		log.Fatal("Error while parsing MAX_TIMEOUT_SECONDS", zap.Any("error", err))
 	}
+	sseRetryMs, err := strconv.Atoi(common.GetEnvWithDefault("SSE_RETRY_MILLISECONDS", "3000"))
+	if err != nil {
+		log.Fatal("Error while parsing SSE_RETRY_MILLISECONDS", zap.Any("error", err))
+	}
+	historySize, err := strconv.Atoi(common.GetEnvWithDefault("SSE_HISTORY_SIZE", "50"))
+	if err != nil {
+		log.Fatal("Error while parsing SSE_HISTORY_SIZE", zap.Any("error", err))
+	}
+	historyTtl, err := strconv.Atoi(common.GetEnvWithDefault("SSE_HISTORY_TTL_SECONDS", "300"))
+	if err != nil {
+		log.Fatal("Error while parsing SSE_HISTORY_TTL_SECONDS", zap.Any("error", err))
+	}
+	ackRequired, err := strconv.ParseBool(common.GetEnvWithDefault("ACK_REQUIRED", "false"))
+	if err != nil {
+		log.Fatal("Error while parsing ACK_REQUIRED", zap.Any("error", err))
+	}
+	ackTimeout, err := strconv.Atoi(common.GetEnvWithDefault("ACK_TIMEOUT_SECONDS", "60"))
+	if err != nil {
+		log.Fatal("Error while parsing ACK_TIMEOUT_SECONDS", zap.Any("error", err))
+	}
+	shardCount, err := strconv.Atoi(common.GetEnvWithDefault("SESSION_REGISTRY_SHARDS", "32"))
+	if err != nil {
+		log.Fatal("Error while parsing SESSION_REGISTRY_SHARDS", zap.Any("error", err))
+	}
+	routeCacheTtl, err := strconv.Atoi(common.GetEnvWithDefault("ROUTE_CACHE_TTL_SECONDS", "5"))
+	if err != nil {
+		log.Fatal("Error while parsing ROUTE_CACHE_TTL_SECONDS", zap.Any("error", err))
+	}
+	sessionLeaseTtl, err := strconv.Atoi(common.GetEnvWithDefault("SESSION_LEASE_TTL_SECONDS", "90"))
+	if err != nil || sessionLeaseTtl < 1 {
+		log.Fatal("Error while parsing SESSION_LEASE_TTL_SECONDS", zap.Any("error", err))
+	}
+	sessionHeartbeat, err := strconv.Atoi(common.GetEnvWithDefault("SESSION_HEARTBEAT_SECONDS", "30"))
+	if err != nil || sessionHeartbeat < 1 || sessionHeartbeat >= sessionLeaseTtl {
+		log.Fatal("Error while parsing SESSION_HEARTBEAT_SECONDS, it must be shorter than SESSION_LEASE_TTL_SECONDS", zap.Any("error", err))
+	}
+	instanceHeartbeat, err := strconv.Atoi(common.GetEnvWithDefault("INSTANCE_HEARTBEAT_SECONDS", "30"))
+	if err != nil || instanceHeartbeat < 1 {
+		log.Fatal("Error while parsing INSTANCE_HEARTBEAT_SECONDS", zap.Any("error", err))
+	}
+	instanceStaleAfter, err := strconv.Atoi(common.GetEnvWithDefault("INSTANCE_STALE_SECONDS", "90"))
+	if err != nil || instanceStaleAfter <= instanceHeartbeat {
+		log.Fatal("Error while parsing INSTANCE_STALE_SECONDS, it must be longer than INSTANCE_HEARTBEAT_SECONDS", zap.Any("error", err))
+	}
+	wsPingInterval, err := strconv.Atoi(common.GetEnvWithDefault("WS_PING_INTERVAL_SECONDS", "30"))
+	if err != nil || wsPingInterval < 1 {
+		log.Fatal("Error while parsing WS_PING_INTERVAL_SECONDS", zap.Any("error", err))
+	}
+	deliveryTimeout, err := strconv.Atoi(common.GetEnvWithDefault("DELIVERY_TIMEOUT_MILLISECONDS", "1000"))
+	if err != nil || deliveryTimeout < 1 {
+		log.Fatal("Error while parsing DELIVERY_TIMEOUT_MILLISECONDS", zap.Any("error", err))
+	}
+	deleteQueue, err := strconv.ParseBool(common.GetEnvWithDefault("SQS_DELETE_QUEUE_ON_SHUTDOWN", "true"))
+	if err != nil {
+		log.Fatal("Error while parsing SQS_DELETE_QUEUE_ON_SHUTDOWN", zap.Any("error", err))
+	}
+	drainTimeout, err := strconv.Atoi(common.GetEnvWithDefault("SQS_QUEUE_DRAIN_SECONDS", "30"))
+	if err != nil || drainTimeout < 1 {
+		log.Fatal("Error while parsing SQS_QUEUE_DRAIN_SECONDS", zap.Any("error", err))
+	}
+	fifo, err := strconv.ParseBool(common.GetEnvWithDefault("SQS_FIFO", "false"))
+	if err != nil {
+		log.Fatal("Error while parsing SQS_FIFO", zap.Any("error", err))
+	}
+	queueNameSuffix := ""
+	if fifo {
+		if factory.Sqs() == nil {
+			log.Fatal("SQS_FIFO requires the sqs message broker")
+		}
+		queueNameSuffix = sqs.FifoQueueSuffix
+	}
 	//Create the queue if the uuid was not provided, if it was then expect that the url is provided too and do not create the queue again
 	var queueUrl *string
 	var userQueueBaseUrl *string
+	ownsQueue := false
 	if factory.Mode() == commonmodel.ServiceInstanceQueue {
 		if uuidProvidedStr := common.GetEnvWithDefault("NOTIFICATION_SERVICE_CLIENT_ID", ""); uuidProvidedStr != "" {
 			uuidProvided, _ = uuid.Parse(uuidProvidedStr)
 			queueUrl = common.GetStringPointer(common.GetEnvRequired("SQS_QUEUE_URL"))
 		} else {
-			queueName := common.GetEnvRequired("SQS_QUEUE_NAME_PREFIX") + "-" + uuidProvided.String()
-			queueUrl, err = factory.Sqs().CreateMessageQueue(queueName, nil, nil, nil, nil)
+			queueName := common.GetEnvRequired("SQS_QUEUE_NAME_PREFIX") + "-" + uuidProvided.String() + queueNameSuffix
+			destination, err := factory.Broker().CreateDestination(queueName)
 			if err != nil {
 				log.Fatal("Error while creating queue", zap.Any("error", err))
 			}
+			queueUrl = &destination
+			ownsQueue = true
 		}
 	} else if factory.Mode() == commonmodel.UserQueue {
 		userQueueBaseUrl = common.GetStringPointer(common.GetEnvRequired("SQS_USER_QUEUE_BASE_URL"))
+	} else if factory.Mode() == commonmodel.PartitionedTopic {
+		queueUrl = common.GetStringPointer(common.GetEnvRequired("KAFKA_TOPIC"))
 	}
+	userSubjectPrefix := common.GetEnvWithDefault("NATS_SUBJECT_PREFIX", "notifications")
+	ctx, cancel := context.WithCancel(context.Background())
 	service := NotificationService{
-		F:                 factory,
-		zLog:              factory.Logger(),
-		d:                 factory.Db(),
-		sqs:               factory.Sqs(),
-		sessions:          make(map[string]chan string),
-		maxTimeoutSeconds: timeout,
-		serviceInstanceId: uuidProvided.String(),
-		queueUrl:          queueUrl,
-		receiveMessage:    make(chan model.NotificationMeta),
-		doneChannel:       make(chan interface{}),
-		operationMode:     factory.Mode(),
-		userQueueBaseUrl:  userQueueBaseUrl,
-	}
-
-	//Subscribe to the service instance queue
-	if factory.Mode() == commonmodel.ServiceInstanceQueue {
-		errSubscribe := service.sqs.ReceiveNotification(&service.doneChannel, &service.receiveMessage, service.queueUrl, 15)
+		F:                  factory,
+		zLog:               factory.Logger(),
+		d:                  factory.Db(),
+		broker:             factory.Broker(),
+		dedup:              factory.Dedup(),
+		routes:             newRouteCache(time.Duration(routeCacheTtl) * time.Second),
+		sessionLeaseTtl:    time.Duration(sessionLeaseTtl) * time.Second,
+		instanceStaleAfter: time.Duration(instanceStaleAfter) * time.Second,
+		startedAt:          time.Now(),
+		sessions:           session.NewRegistry(shardCount),
+		userSubscriptions:  &sync.Map{},
+		history:            newNotificationHistory(historySize, time.Duration(historyTtl)*time.Second),
+		ackRequired:        ackRequired,
+		maxTimeoutSeconds:  timeout,
+		sseRetryMs:         sseRetryMs,
+		wsPingInterval:     time.Duration(wsPingInterval) * time.Second,
+		deliveryTimeout:    time.Duration(deliveryTimeout) * time.Millisecond,
+		wsUpgrader:         newWebSocketUpgrader(common.GetEnvWithDefault("WS_ALLOWED_ORIGINS", "")),
+		serviceInstanceId:  uuidProvided.String(),
+		queueUrl:           queueUrl,
+		queueNamePrefix:    common.GetEnvWithDefault("SQS_QUEUE_NAME_PREFIX", ""),
+		queueNameSuffix:    queueNameSuffix,
+		ownsQueue:          ownsQueue,
+		deleteQueue:        deleteQueue,
+		drainTimeout:       time.Duration(drainTimeout) * time.Second,
+		receiveMessage:     make(chan model.NotificationMeta),
+		ctx:                ctx,
+		cancel:             cancel,
+		failed:             make(chan struct{}),
+		operationMode:      factory.Mode(),
+		userQueueBaseUrl:   userQueueBaseUrl,
+		userSubjectPrefix:  userSubjectPrefix,
+	}
+
+	service.leaser = broker.NewLeaser(service.broker, factory.VisibilityTimeout(), &service.zLog)
+	//A failed notification of a FIFO queue is redelivered at latest when its visibility timeout expires
+	service.barrier = newGroupBarrier(2 * factory.VisibilityTimeout())
+	//Released notifications come back after a growing delay, at most after the visibility timeout as if they expired
+	service.releases = newReleaseBackoff(releaseBackoffBase, factory.VisibilityTimeout())
+	//Unacknowledged notifications are released, so they are delivered again without waiting for the visibility timeout
+	service.pendingAcks = newPendingAcknowledgements(time.Duration(ackTimeout)*time.Second, func(lease *broker.Lease) {
+		service.zLog.Debug("Acknowledgement expired, releasing notification", zap.String("message_id", lease.Delivery.Notification.Id))
+		if err := lease.Release(service.ctx); err != nil {
+			service.zLog.Error("Error while releasing notification", zap.String("message_id", lease.Delivery.Notification.Id), zap.Any("error", err))
+		}
+	})
+
+	//Subscribe to the service instance queue, or to the topic shared by all instances
+	if factory.Mode() == commonmodel.ServiceInstanceQueue || factory.Mode() == commonmodel.PartitionedTopic {
+		subscription, errSubscribe := service.broker.Subscribe(service.ctx, *service.queueUrl, service.receiveMessage)
 		if errSubscribe != nil {
 			service.zLog.Fatal("Error while subscribing to the queue", zap.Any("error", errSubscribe))
 		}
+		//If the queue is lost, no notification can be received anymore, so the clients should reconnect to another instance
+		go func() {
+			<-subscription.Done()
+			if err := subscription.Err(); err != nil {
+				service.zLog.Error("Subscription terminated", zap.String("queueUrl", *service.queueUrl), zap.Any("error", err))
+				service.fail(err)
+			}
+		}()
+	}
+
+	//Keep the leases of the connected clients and the registration of the instance alive, the leases left behind by a
+	//previous run with the same id are released. The queues left behind by the instances which are gone are retired when
+	//they are purged from the registry
+	if factory.Mode() == commonmodel.ServiceInstanceQueue {
+		if err := service.d.ReleaseSessionLeases(service.serviceInstanceId); err != nil {
+			log.Fatal("Error while releasing the session leases of the instance", zap.Any("error", err))
+		}
+		go service.renewSessionLeases(time.Duration(sessionHeartbeat) * time.Second)
+		//Register the instance, so the operators and the publishers can see it is alive
+		if err := service.registerInstance(); err != nil {
+			log.Fatal("Error while registering the instance", zap.Any("error", err))
+		}
+		go service.heartbeatInstance(time.Duration(instanceHeartbeat) * time.Second)
 	}
 
+	//Periodically drop the expired entries of the notification history, the pending acknowledgements and the cached routes
+	pruneInterval := time.Minute
+	if ackTimeoutDuration := time.Duration(ackTimeout) * time.Second / 2; ackTimeoutDuration > 0 && ackTimeoutDuration < pruneInterval {
+		pruneInterval = ackTimeoutDuration
+	}
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-service.ctx.Done():
+				return
+			case <-ticker.C:
+				service.history.PruneAll()
+				service.pendingAcks.PruneAll()
+				service.barrier.PruneAll()
+				service.releases.PruneAll()
+				service.routes.PruneAll()
+			}
+		}
+	}()
+
 	//Start handler for incoming messages
 	go func() {
 		for {
 			select {
-			case <-service.doneChannel:
+			case <-service.ctx.Done():
 				service.zLog.Debug("Done notification caught... Stopping handler function receiving messages")
+				return
 			case notification := <-service.receiveMessage:
+				//Keep the notification hidden from the other consumers while the delivery is in progress
+				lease := service.leaser.Acquire(service.ctx, notification)
+				if service.isDuplicate(notification.Notification) {
+					//Already delivered, thus it only has to be removed from the queue
+					service.zLog.Debug("Duplicate notification dropped", zap.String("message_id", notification.Notification.Id))
+					if err := lease.Ack(service.ctx); err != nil {
+						service.zLog.Error("Error while deleting notification from the queue", zap.String("message_id", notification.Notification.Id), zap.Any("error", err))
+					}
+					continue
+				}
+				if service.barrier.Blocked(notification) {
+					service.zLog.Debug("Notification held back, an earlier notification of its group failed", zap.String("message_id", notification.Notification.Id))
+					service.abandon(lease)
+					continue
+				}
+				//In at-least-once mode the acknowledgement is expected as soon as the notification is delivered, thus it must
+				//be waiting for it before the delivery
+				awaitAck := service.ackRequired && service.operationMode != commonmodel.PartitionedTopic
+				if awaitAck {
+					service.pendingAcks.Add(lease)
+				}
 				err := service.HandleIncomingNotification(notification)
+				if err != nil && awaitAck {
+					service.pendingAcks.Remove(notification.Notification.Addressee, notification.Notification.Id)
+				}
 				needToBeDeleted := false
-				if err == nil {
+				if service.operationMode == commonmodel.PartitionedTopic {
+					//Every instance receives every notification of the topic, the ones addressed to users connected to other
+					//instances are skipped, offsets are committed in order right after the dispatch
 					needToBeDeleted = true
+					if err == nil {
+						service.rememberDelivered(notification.Notification)
+					} else if !errors.Is(err, commonmodel.ErrLongPollingCouldNotDeliver) {
+						service.zLog.Error("Error while handling incoming notification", zap.String("message_id", notification.Notification.Id), zap.Any("error", err))
+					}
+				} else if err == nil {
+					//In at-least-once mode the notification is deleted only when the client acknowledges it
+					if !awaitAck {
+						service.rememberDelivered(notification.Notification)
+						needToBeDeleted = true
+					}
 				} else {
 					service.zLog.Error("Error while handling incoming notification", zap.String("message_id", notification.Notification.Id), zap.Any("error", err))
 					if errors.Is(err, commonmodel.ErrSqsInvalidMessage) {
 						needToBeDeleted = true
+					} else {
+						service.barrier.Fail(notification)
+						service.abandon(lease)
 					}
 				}
 				if needToBeDeleted {
 					// Delete the notification from the queue
-					err = service.sqs.DeleteMessage(notification.QueueUrl, notification.ReceiptHandle)
+					err = lease.Ack(service.ctx)
 					if err != nil {
 						service.zLog.Error("Error while deleting notification from the queue", zap.String("message_id", notification.Notification.Id), zap.Any("error", err))
 					}
@@ -118,14 +349,123 @@ func NewNotificationService(factory factory.FactoryInterface) *NotificationServi
 	return &service
 }
 
-// HandleIncomingNotification handles incoming awssqs.Message objects, received from different SQS queues
+// Close stops receiving notifications, the connections of the clients are not affected
+// In ServiceInstanceQueue mode the session leases of the instance are released and the instance is deregistered. The
+// notifications waiting for an acknowledgement are released, then the queue created by the instance is drained and
+// deleted (unless SQS_DELETE_QUEUE_ON_SHUTDOWN is false), since nobody else consumes it. Finally the pending deletions of
+// the acknowledged notifications are sent
+func (s *NotificationService) Close() {
+	s.cancel()
+	if s.operationMode == commonmodel.ServiceInstanceQueue {
+		//The clients are about to be disconnected, publishers should not send their notifications to this instance anymore
+		if err := s.d.ReleaseSessionLeases(s.serviceInstanceId); err != nil {
+			s.zLog.Error("Error while releasing the session leases of the instance", zap.Any("error", err))
+		}
+		if err := s.d.DeregisterInstance(s.serviceInstanceId); err != nil {
+			s.zLog.Error("Error while deregistering the instance", zap.Any("error", err))
+		}
+	}
+	for _, lease := range s.pendingAcks.TakeAll() {
+		if err := lease.Release(context.Background()); err != nil {
+			s.zLog.Error("Error while releasing notification", zap.String("message_id", lease.Delivery.Notification.Id), zap.Any("error", err))
+		}
+	}
+	if s.ownsQueue && s.deleteQueue {
+		s.retireQueue(*s.queueUrl, nil)
+	}
+	if closer, ok := s.broker.(broker.Closer); ok {
+		closer.Close()
+	}
+	if sqsService := s.F.Sqs(); sqsService != nil {
+		sqsService.Close()
+	}
+}
+
+// Failed returns a channel which is closed when the instance cannot receive notifications anymore (e.g. its queue has been
+// lost), then the service should be closed, so the instance can be restarted
+func (s *NotificationService) Failed() <-chan struct{} {
+	return s.failed
+}
+
+// fail marks the instance as failed with the given reason, thus no new session is accepted, and the existing sessions are
+// closed, so the clients reconnect to another instance
+func (s *NotificationService) fail(reason error) {
+	s.failOnce.Do(func() {
+		s.zLog.Error("Instance failed, closing all sessions", zap.Any("reason", reason))
+		close(s.failed)
+		s.sessions.Range(func(clientSession *session.Session) bool {
+			clientSession.Terminate(reason)
+			return true
+		})
+	})
+}
+
+// renewSessionLeases extends the session leases of the connected clients periodically, until the service is closed
+// The expired leases of any instance are purged as well, they are already treated as offline
+func (s *NotificationService) renewSessionLeases(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.d.RenewSessionLeases(s.serviceInstanceId, s.sessions.SessionCounts(), s.sessionLeaseTtl); err != nil {
+				s.zLog.Error("Error while renewing the session leases", zap.Any("error", err))
+			}
+			if err := s.d.PurgeExpiredSessionLeases(); err != nil {
+				s.zLog.Error("Error while purging the expired session leases", zap.Any("error", err))
+			}
+		}
+	}
+}
+
+// GetHealth reports the health of the service instance, if SQS is used the state of its circuit breaker is included
+// The instance is reported healthy even if the circuit breaker is open, since the outage affects every instance alike, while
+// it is reported down (503) once it has failed, since it cannot receive notifications anymore
+func (s *NotificationService) GetHealth(c *gin.Context) {
+	health := gin.H{"status": "UP"}
+	if sqsService := s.F.Sqs(); sqsService != nil {
+		health["sqsCircuit"] = sqsService.CircuitState().String()
+	}
+	select {
+	case <-s.failed:
+		health["status"] = "DOWN"
+		c.JSON(503, health)
+	default:
+		c.JSON(200, health)
+	}
+}
+
+// abandon ends the lease of a notification which could not be delivered by this instance
+func (s *NotificationService) abandon(lease *broker.Lease) {
+	if s.operationMode == commonmodel.UserQueue || s.operationMode == commonmodel.UserSubject {
+		//The queue of the user might be consumed by other instances too, where the user might still be connected. The delay
+		//keeps a notification which cannot be delivered anywhere (e.g. it is held back) from returning in a tight loop
+		if err := lease.ReleaseAfter(s.ctx, s.releases.Next(lease.Delivery.Notification.Id)); err != nil {
+			s.zLog.Error("Error while releasing notification", zap.String("message_id", lease.Delivery.Notification.Id), zap.Any("error", err))
+		}
+		return
+	}
+	//Nobody else consumes the queue of the instance, releasing it would only make it reappear here again, so let it expire
+	//and eventually reach the dead-letter-queue
+	lease.Stop()
+}
+
+// HandleIncomingNotification handles incoming notifications, received from the destinations of the message broker (e.g. SQS queues)
 // The function validates the message and if it is valid, forwards it to the corresponding client through a dedicated channel
 // All message is deleted from the queue after delivery, or if it is formally invalid, however it is kept in case of delivery failure
-func (s NotificationService) HandleIncomingNotification(notification model.NotificationMeta) (err error) {
+func (s *NotificationService) HandleIncomingNotification(notification model.NotificationMeta) (err error) {
 
-	// Request checked, performing delivery if the addressee is connected
-	if channel, ok := s.sessions[notification.Notification.Addressee]; ok {
-		channel <- notification.Notification.Body
+	// Request checked, performing delivery to every connection of the addressee if it is connected
+	delivered := false
+	for _, clientSession := range s.sessions.Lookup(notification.Notification.Addressee) {
+		if clientSession.Deliver(notification.Notification, s.deliveryTimeout) {
+			delivered = true
+		}
+	}
+	if delivered {
+		s.history.Record(notification.Notification)
 	} else {
 		s.zLog.Debug("User not connected, notification not delivered", zap.String("message_id", notification.Notification.Id))
 		//Message is valid and addressee is provided, however we could not deliver it, possible addressee disconnected, thus
@@ -136,7 +476,76 @@ func (s NotificationService) HandleIncomingNotification(notification model.Notif
 	return nil
 }
 
-func (s NotificationService) GetNotificationSubscribe(c *gin.Context) {
+// PostNotificationAck acknowledges the receipt of a notification by the client
+// In at-least-once mode (ACK_REQUIRED) the notification is deleted from the queue only after the acknowledgement, otherwise
+// it has already been deleted at delivery and the acknowledgement has no effect
+// The pending acknowledgements are kept in memory, thus the request must reach the instance the client is connected to
+func (s *NotificationService) PostNotificationAck(c *gin.Context) {
+	tokenParsed, errToken := s.F.Auth().ParseJWTPayloadGin(c)
+	if errToken != nil {
+		s.zLog.Debug("Error while parsing token", zap.Any("error", errToken), zap.String("trace-id:", c.GetHeader("trace-id")))
+		common.ErrorResponse(c, 400, ErrorInvalidJwt, "Invalid token", c.GetHeader("trace-id"))
+		return
+	}
+	client := tokenParsed["sub"].(string)
+	err := s.acknowledge(client, c.Param("id"), c.GetHeader("trace-id"))
+	if errors.Is(err, commonmodel.ErrNotificationNotFound) {
+		common.ErrorResponse(c, 404, ErrorNotificationNotFound, "Notification not found or acknowledgement expired", c.GetHeader("trace-id"))
+		return
+	} else if err != nil {
+		common.ErrorResponse(c, 500, ErrorInternalServerError, "Internal Server Error", c.GetHeader("trace-id"))
+		return
+	}
+	c.Status(204)
+}
+
+// acknowledge deletes the notification acknowledged by the client from the queue
+// It returns ErrNotificationNotFound if the notification is not waiting for the acknowledgement of the client, e.g. the
+// acknowledgement timeout has already expired and the notification will be delivered again
+func (s *NotificationService) acknowledge(client, id, traceId string) error {
+	if !s.ackRequired {
+		return nil
+	}
+	lease, ok := s.pendingAcks.Take(client, id)
+	if !ok {
+		s.zLog.Debug("Acknowledged notification is not pending", zap.String("trace-id:", traceId), zap.String("message_id", id))
+		return commonmodel.ErrNotificationNotFound
+	}
+	err := lease.Ack(s.ctx)
+	if err != nil {
+		s.zLog.Error("Error while deleting notification from the queue", zap.String("trace-id:", traceId), zap.String("message_id", id), zap.Any("error", err))
+		return err
+	}
+	s.rememberDelivered(lease.Delivery.Notification)
+	return nil
+}
+
+// isDuplicate reports whether the notification has already been delivered, if the deduplication cache is not available
+// the notification is treated as new, since a duplicate is preferred to a lost notification
+func (s *NotificationService) isDuplicate(notification model.Notification) bool {
+	if s.dedup == nil || notification.Id == "" {
+		return false
+	}
+	duplicate, err := s.dedup.Contains(s.ctx, notification.Id)
+	if err != nil {
+		s.zLog.Error("Error while checking notification for duplicate", zap.String("message_id", notification.Id), zap.Any("error", err))
+		return false
+	}
+	return duplicate
+}
+
+// rememberDelivered adds the notification to the deduplication cache, in at-least-once mode it is called only when the
+// client acknowledges the notification, since the redeliveries of the unacknowledged notifications are intentional
+func (s *NotificationService) rememberDelivered(notification model.Notification) {
+	if s.dedup == nil || notification.Id == "" {
+		return
+	}
+	if err := s.dedup.Add(s.ctx, notification.Id); err != nil {
+		s.zLog.Error("Error while remembering delivered notification", zap.String("message_id", notification.Id), zap.Any("error", err))
+	}
+}
+
+func (s *NotificationService) GetNotificationSubscribe(c *gin.Context) {
 	//Set up a listener to detect when the client closes the connection, or losing the connection by whatever reason
 	s.zLog.Debug("Setting up event listening", zap.String("trace-id:", c.GetHeader("trace-id")))
 	closeNotify := c.Writer.CloseNotify()
@@ -147,44 +556,38 @@ func (s NotificationService) GetNotificationSubscribe(c *gin.Context) {
 		return
 	}
 	client := tokenParsed["sub"].(string)
-	sessionClosed := make(chan interface{})
-
-	//Create dedicated channel for this client
-	sessionChannel := make(chan string)
-	s.sessions[client] = sessionChannel
-
-	if s.operationMode == commonmodel.ServiceInstanceQueue {
-		//Assign the service ID to the client in the database
-		err := s.d.UpdateClientServiceId(client, s.serviceInstanceId)
-		if err != nil {
-			s.zLog.Error("Error while assigning service ID to client", zap.String("trace-id:", c.GetHeader("trace-id")), zap.Any("error", err))
-			s.sessions[client] = nil
-			common.ErrorResponse(c, 500, ErrorInternalServerError, "Internal Server Error", c.GetHeader("trace-id"))
-			return
-		}
-	} else if s.operationMode == commonmodel.UserQueue {
-		//Subscribe to the user queue
-		errSubscribe := s.sqs.ReceiveNotification(&sessionClosed, &s.receiveMessage, getUserQueueUrl(*s.userQueueBaseUrl, client), 15)
-		if errSubscribe != nil {
-			s.zLog.Error("Error while subscribing to the queue", zap.Any("error", errSubscribe))
-			s.sessions[client] = nil
-			common.ErrorResponse(c, 500, ErrorInternalServerError, "Internal Server Error", c.GetHeader("trace-id"))
-			return
-		}
+	clientSession, err := s.openSession(client, getDeviceId(c), c.GetHeader("trace-id"))
+	if err != nil {
+		s.sessionErrorResponse(c, err, c.GetHeader("trace-id"))
+		return
 	}
 
 	//Set up headers and flush it immediately to let client know that connection is established
 	//and the server will stream data through the established connection
 	c.Writer.Header().Set("Content-Type", "text/event-stream")
 	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.WriteHeader(200)
+	if err := writeSseRetry(c.Writer, s.sseRetryMs); err != nil {
+		s.zLog.Debug("Error while notifying client", zap.String("trace-id:", c.GetHeader("trace-id")), zap.Any("error", err))
+	}
 	c.Writer.Flush()
 
+	//Resume the stream if the client provides the id of the last notification it has received
+	if lastEventId := getLastEventId(c); lastEventId != "" {
+		missed := s.history.Since(client, lastEventId)
+		s.zLog.Debug("Resuming event stream", zap.String("trace-id:", c.GetHeader("trace-id")), zap.String("last_event_id", lastEventId), zap.Int("missed", len(missed)))
+		for _, notification := range missed {
+			if err := writeSseNotification(c.Writer, notification); err != nil {
+				s.zLog.Debug("Error while notifying client", zap.String("trace-id:", c.GetHeader("trace-id")), zap.Any("error", err))
+				break
+			}
+		}
+		c.Writer.Flush()
+	}
+
 	//Set up timeout and terminate connection in case it happens
-	timeoutChannel := make(chan interface{})
-	go func() {
-		time.Sleep(time.Duration(s.maxTimeoutSeconds) * time.Second)
-		timeoutChannel <- true
-	}()
+	timeoutChannel := time.After(time.Duration(s.maxTimeoutSeconds) * time.Second)
 
 	//Start listening events and also monitor the closeNotify channel
 	stop := false
@@ -196,27 +599,134 @@ func (s NotificationService) GetNotificationSubscribe(c *gin.Context) {
 		case <-timeoutChannel:
 			s.zLog.Debug("Connection timed out", zap.String("trace-id:", c.GetHeader("trace-id")))
 			stop = true
-		case sessionMessage := <-sessionChannel:
-			s.zLog.Debug("Sending message to client", zap.String("trace-id:", c.GetHeader("trace-id")), zap.Any("message", sessionMessage))
-			_, err := c.Writer.WriteString(sessionMessage)
+		case <-clientSession.Terminated():
+			s.zLog.Debug("Session terminated", zap.String("trace-id:", c.GetHeader("trace-id")), zap.Any("error", clientSession.Err()))
+			if err := writeSseError(c.Writer, clientSession.Err().Error()); err != nil {
+				s.zLog.Debug("Error while notifying client", zap.String("trace-id:", c.GetHeader("trace-id")), zap.Any("error", err))
+			}
+			c.Writer.Flush()
+			stop = true
+		case notification := <-clientSession.Notifications():
+			s.zLog.Debug("Sending message to client", zap.String("trace-id:", c.GetHeader("trace-id")), zap.String("message_id", notification.Id))
+			err := writeSseNotification(c.Writer, notification)
 			if err != nil {
 				s.zLog.Debug("Error while notifying client", zap.String("trace-id:", c.GetHeader("trace-id")), zap.Any("error", err))
 			}
 			c.Writer.Flush()
 		}
 	}
-	s.zLog.Debug("Cleaning up after connection", zap.String("trace-id:", c.GetHeader("trace-id")))
-	if s.operationMode == commonmodel.ServiceInstanceQueue {
-		err := s.d.UpdateClientServiceIdToNull(client)
-		if err != nil {
-			s.zLog.Error("Error while removing service ID from client", zap.String("trace-id:", c.GetHeader("trace-id")), zap.Any("error", err))
+	s.closeSession(clientSession)
+}
+
+// openSession registers a new session for the connection of the client and makes sure its notifications are received by
+// this instance, regardless of the transport the client is connected through
+// When the first session of the client is opened, in ServiceInstanceQueue mode the instance is assigned to the client in
+// the database, in UserQueue and UserSubject modes the instance subscribes to the queue (subject) of the client
+func (s *NotificationService) openSession(client, deviceId, traceId string) (clientSession *session.Session, err error) {
+	select {
+	case <-s.failed:
+		return nil, commonmodel.ErrInstanceFailed
+	default:
+	}
+	clientSession = session.NewSession(uuid.New().String(), client, deviceId, traceId)
+	err = s.sessions.Register(clientSession, func() error {
+		if s.operationMode == commonmodel.ServiceInstanceQueue {
+			//Assign the service ID to the client in the database, the lease is kept alive by renewSessionLeases
+			err := s.d.AcquireSessionLease(client, s.serviceInstanceId, *s.queueUrl, s.sessionLeaseTtl)
+			s.routes.Invalidate(client)
+			if err != nil {
+				s.zLog.Error("Error while assigning service ID to client", zap.String("trace-id:", traceId), zap.Any("error", err))
+				return err
+			}
+		} else if s.operationMode == commonmodel.UserQueue || s.operationMode == commonmodel.UserSubject {
+			//Subscribe to the user queue
+			ctx, cancel := context.WithCancel(s.ctx)
+			subscription, err := s.broker.Subscribe(ctx, s.userDestination(client), s.receiveMessage)
+			if err != nil {
+				s.zLog.Error("Error while subscribing to the queue", zap.String("trace-id:", traceId), zap.Any("error", err))
+				cancel()
+				return err
+			}
+			s.userSubscriptions.Store(client, cancel)
+			go s.watchUserSubscription(client, subscription)
 		}
-	} else if s.operationMode == commonmodel.UserQueue {
-		sessionClosed <- true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.zLog.Debug("Session registered", zap.String("trace-id:", traceId), zap.String("session_id", clientSession.Id), zap.String("device_id", deviceId))
+	return clientSession, nil
+}
+
+// sessionErrorResponse responds to the request whose session could not be opened, if the instance has failed the client is
+// told to connect to another instance (503)
+func (s *NotificationService) sessionErrorResponse(c *gin.Context, err error, traceId string) {
+	if errors.Is(err, commonmodel.ErrInstanceFailed) {
+		common.ErrorResponse(c, 503, ErrorServiceUnavailable, "Instance is unavailable, connect again", traceId)
+		return
+	}
+	common.ErrorResponse(c, 500, ErrorInternalServerError, "Internal Server Error", traceId)
+}
+
+// closeSession unregisters the session of the client, and releases everything openSession has set up for the client if it
+// was the last session of the client
+func (s *NotificationService) closeSession(clientSession *session.Session) {
+	s.zLog.Debug("Cleaning up after connection", zap.String("trace-id:", clientSession.TraceId), zap.String("session_id", clientSession.Id))
+	s.sessions.Unregister(clientSession, func() {
+		if s.operationMode == commonmodel.ServiceInstanceQueue {
+			err := s.d.ReleaseSessionLease(clientSession.UserId, s.serviceInstanceId)
+			s.routes.Invalidate(clientSession.UserId)
+			if err != nil {
+				s.zLog.Error("Error while removing service ID from client", zap.String("trace-id:", clientSession.TraceId), zap.Any("error", err))
+			}
+		} else if s.operationMode == commonmodel.UserQueue || s.operationMode == commonmodel.UserSubject {
+			if cancel, ok := s.userSubscriptions.LoadAndDelete(clientSession.UserId); ok {
+				cancel.(context.CancelFunc)()
+			}
+		}
+	})
+}
+
+// watchUserSubscription terminates the sessions of the client if its subscription ends with an error (e.g.: the queue of
+// the client has been deleted), since the client would not receive any notification through them anymore
+func (s *NotificationService) watchUserSubscription(client string, subscription *broker.Subscription) {
+	<-subscription.Done()
+	err := subscription.Err()
+	if err == nil {
+		return
+	}
+	s.zLog.Error("Subscription of the client terminated", zap.String("client", client), zap.Any("error", err))
+	for _, clientSession := range s.sessions.Lookup(client) {
+		clientSession.Terminate(err)
+	}
+}
+
+// getDeviceId returns the device id provided by the client, it is used to tell apart the connections of the same user
+func getDeviceId(c *gin.Context) string {
+	if deviceId := c.GetHeader("device-id"); deviceId != "" {
+		return deviceId
+	}
+	return c.Query("deviceId")
+}
+
+// getLastEventId returns the id of the last notification the client has received
+// Browsers send it in the Last-Event-ID header when EventSource reconnects, the query parameter is supported for clients
+// which cannot set custom headers on the initial request
+func getLastEventId(c *gin.Context) string {
+	if lastEventId := c.GetHeader("Last-Event-ID"); lastEventId != "" {
+		return lastEventId
+	}
+	return c.Query("lastEventId")
+}
+
+// userDestination returns the destination dedicated to the given user, the queue URL in UserQueue mode and the subject in
+// UserSubject mode
+func (s *NotificationService) userDestination(userId string) string {
+	if s.operationMode == commonmodel.UserSubject {
+		return nats.Subject(s.userSubjectPrefix, userId)
 	}
-	close(sessionChannel)
-	delete(s.sessions, client)
-	c.JSON(288, nil)
+	return *getUserQueueUrl(*s.userQueueBaseUrl, userId) + s.queueNameSuffix
 }
 
 // getUserQueueUrl returns the URL of the user queue for the given user
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"notification-service/common/broker"
+	"sync"
+	"time"
+)
+
+// pendingAcknowledgements keeps track of the notifications handed over to the clients, which are kept in the queue until
+// the client acknowledges them
+// The leases of the notifications are kept alive while they wait for the acknowledgement, when an entry expires (after
+// ttl) its lease is passed to expire, so the notification can be released for another delivery attempt
+type pendingAcknowledgements struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	expire  func(lease *broker.Lease)
+	entries map[string]pendingAcknowledgement
+}
+
+type pendingAcknowledgement struct {
+	lease     *broker.Lease
+	expiresAt time.Time
+}
+
+// newPendingAcknowledgements creates a new pendingAcknowledgements, which keeps the entries for ttl
+func newPendingAcknowledgements(ttl time.Duration, expire func(lease *broker.Lease)) *pendingAcknowledgements {
+	return &pendingAcknowledgements{
+		ttl:     ttl,
+		expire:  expire,
+		entries: make(map[string]pendingAcknowledgement),
+	}
+}
+
+// Add registers the notification of the given lease as waiting for acknowledgement
+func (p *pendingAcknowledgements) Add(lease *broker.Lease) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.entries[pendingAcknowledgementKey(lease.Delivery.Notification.Addressee, lease.Delivery.Notification.Id)] = pendingAcknowledgement{
+		lease:     lease,
+		expiresAt: time.Now().Add(p.ttl),
+	}
+}
+
+// Take removes and returns the lease of the notification with the given id waiting for the acknowledgement of the given client
+func (p *pendingAcknowledgements) Take(client, id string) (lease *broker.Lease, ok bool) {
+	p.mutex.Lock()
+	key := pendingAcknowledgementKey(client, id)
+	entry, ok := p.entries[key]
+	delete(p.entries, key)
+	p.mutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		p.expire(entry.lease)
+		return nil, false
+	}
+	return entry.lease, true
+}
+
+// Remove removes the notification with the given id from the pending ones without expiring it, e.g. because its delivery
+// failed before the client could acknowledge it
+func (p *pendingAcknowledgements) Remove(client, id string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.entries, pendingAcknowledgementKey(client, id))
+}
+
+// TakeAll removes and returns the leases of all the pending notifications
+func (p *pendingAcknowledgements) TakeAll() (leases []*broker.Lease) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, entry := range p.entries {
+		delete(p.entries, key)
+		leases = append(leases, entry.lease)
+	}
+	return leases
+}
+
+// PruneAll removes the expired entries
+func (p *pendingAcknowledgements) PruneAll() {
+	var expired []*broker.Lease
+	p.mutex.Lock()
+	now := time.Now()
+	for key, entry := range p.entries {
+		if now.After(entry.expiresAt) {
+			delete(p.entries, key)
+			expired = append(expired, entry.lease)
+		}
+	}
+	p.mutex.Unlock()
+	for _, lease := range expired {
+		p.expire(lease)
+	}
+}
+
+func pendingAcknowledgementKey(client, id string) string {
+	return client + "/" + id
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"notification-service/common/common"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+)
+
+// PostNotification publishes a single notification to its addressee
+func (s *NotificationService) PostNotification(c *gin.Context) {
+	var request model.PublishRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		s.zLog.Debug("Invalid publish request", zap.String("trace-id:", c.GetHeader("trace-id")), zap.Any("error", err))
+		common.ErrorResponse(c, 400, commonmodel.ErrInvalidBody.Error(), err.Error(), c.GetHeader("trace-id"))
+		return
+	}
+	result, err := s.publish(request, c.GetHeader("trace-id"))
+	if err != nil {
+		status, code := publishErrorResponse(err)
+		common.ErrorResponse(c, status, code, "Notification could not be published", c.GetHeader("trace-id"))
+		return
+	}
+	c.JSON(201, result)
+}
+
+// PostNotificationBatch publishes multiple notifications
+// The notifications are published independently, the result of each of them is returned in the order of the request
+func (s *NotificationService) PostNotificationBatch(c *gin.Context) {
+	var request model.PublishBatchRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		s.zLog.Debug("Invalid publish request", zap.String("trace-id:", c.GetHeader("trace-id")), zap.Any("error", err))
+		common.ErrorResponse(c, 400, commonmodel.ErrInvalidBody.Error(), err.Error(), c.GetHeader("trace-id"))
+		return
+	}
+	response := model.PublishBatchResult{Results: make([]model.PublishResult, 0, len(request.Notifications))}
+	for _, notification := range request.Notifications {
+		result, err := s.publish(notification, c.GetHeader("trace-id"))
+		if err != nil {
+			_, result.Error = publishErrorResponse(err)
+		}
+		response.Results = append(response.Results, result)
+	}
+	c.JSON(200, response)
+}
+
+// publish validates the notification and sends it to the queue of the addressee
+func (s *NotificationService) publish(request model.PublishRequest, traceId string) (result model.PublishResult, err error) {
+	result.Addressee = request.Addressee
+	queueUrl, err := s.resolveQueueUrl(request.Addressee)
+	if err != nil {
+		s.zLog.Debug("Could not resolve the queue of the addressee", zap.String("trace-id:", traceId), zap.Any("error", err))
+		return result, err
+	}
+	notification := model.Notification{
+		Id:        uuid.New().String(),
+		Addressee: request.Addressee,
+		Subject:   request.Subject,
+		Body:      request.Body,
+	}
+	messageId, err := s.broker.Publish(s.ctx, *queueUrl, notification)
+	if err != nil {
+		s.zLog.Error("Error while publishing notification", zap.String("trace-id:", traceId), zap.Any("error", err))
+		return result, err
+	}
+	result.Id = notification.Id
+	result.MessageId = messageId
+	return result, nil
+}
+
+// resolveQueueUrl returns the URL of the queue the notifications of the addressee must be sent to according to the operation mode
+// In ServiceInstanceQueue mode the notifications are sent to the queue of the instance the addressee is connected to, it
+// is resolved by the (cached) route lookup of GET /routes. ErrAddresseeNotConnected is returned if the addressee is not
+// connected to any instance
+func (s *NotificationService) resolveQueueUrl(addressee string) (queueUrl *string, err error) {
+	switch s.operationMode {
+	case commonmodel.ServiceInstanceQueue:
+		route, err := s.lookupRoute(addressee)
+		if err != nil {
+			return nil, err
+		}
+		if !route.Online {
+			return nil, commonmodel.ErrAddresseeNotConnected
+		}
+		return &route.QueueUrl, nil
+	case commonmodel.UserQueue, commonmodel.UserSubject:
+		return common.GetStringPointer(s.userDestination(addressee)), nil
+	case commonmodel.PartitionedTopic:
+		return s.queueUrl, nil
+	}
+	return nil, commonmodel.ErrInvalidArgument
+}
+
+// publishErrorResponse maps the errors of publishing to HTTP status codes and error codes
+func publishErrorResponse(err error) (status int, code string) {
+	switch {
+	case errors.Is(err, commonmodel.ErrInvalidArgument):
+		return 400, err.Error()
+	case errors.Is(err, commonmodel.ErrContentTooLong):
+		return 413, err.Error()
+	case errors.Is(err, commonmodel.ErrAddresseeNotConnected):
+		return 404, err.Error()
+	}
+	return 500, ErrorInternalServerError
+}
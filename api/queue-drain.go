@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"notification-service/common/broker"
+	"notification-service/model"
+	"time"
+)
+
+// drainPollInterval is the time between the checks whether the queue being drained is empty
+const drainPollInterval = time.Second
+
+// retireQueue drains the queue of an instance which is gone (or is shutting down), then deletes it
+// The queue is deleted even if it could not be drained within the drain timeout, the number of the notifications lost
+// with it is logged. abandoned is optional, it is checked before the queue is drained and again before it is deleted, the
+// queue is kept if it reports that the queue is consumed again
+func (s *NotificationService) retireQueue(queueUrl string, abandoned func() bool) {
+	deleter, ok := s.broker.(broker.DestinationDeleter)
+	if !ok {
+		return
+	}
+	if abandoned != nil && !abandoned() {
+		return
+	}
+	remaining, err := s.drainQueue(queueUrl)
+	if err != nil {
+		s.zLog.Error("Error while draining the queue", zap.String("queueUrl", queueUrl), zap.Any("error", err))
+	} else if remaining > 0 {
+		s.zLog.Error("Queue could not be drained in time, deleting it with its notifications", zap.String("queueUrl", queueUrl), zap.Int("remaining", remaining))
+	}
+	if abandoned != nil && !abandoned() {
+		s.zLog.Info("Queue is consumed again, keeping it", zap.String("queueUrl", queueUrl))
+		return
+	}
+	if err := deleter.DeleteDestination(queueUrl); err != nil {
+		s.zLog.Error("Error while deleting the queue", zap.String("queueUrl", queueUrl), zap.Any("error", err))
+		return
+	}
+	s.zLog.Info("Queue deleted", zap.String("queueUrl", queueUrl))
+}
+
+// drainQueue empties the queue before it is deleted: the notifications of the addressees connected to another instance
+// are forwarded to the queue of that instance, the rest is released until the redrive policy of the queue moves them to
+// the dead-letter-queue. It returns the number of notifications still in the queue when the drain timeout elapses
+func (s *NotificationService) drainQueue(queueUrl string) (remaining int, err error) {
+	counter, ok := s.broker.(broker.DestinationCounter)
+	if !ok {
+		return 0, nil
+	}
+	remaining, err = counter.CountNotifications(queueUrl)
+	if err != nil || remaining == 0 {
+		return remaining, err
+	}
+	s.zLog.Info("Draining queue", zap.String("queueUrl", queueUrl), zap.Int("notifications", remaining))
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	deliveries := make(chan model.NotificationMeta)
+	if _, err := s.broker.Subscribe(ctx, queueUrl, deliveries); err != nil {
+		return remaining, err
+	}
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return remaining, nil
+		case delivery := <-deliveries:
+			s.forward(ctx, queueUrl, delivery)
+		case <-ticker.C:
+			if remaining, err = counter.CountNotifications(queueUrl); err != nil || remaining == 0 {
+				return remaining, err
+			}
+		}
+	}
+}
+
+// forward sends the notification received from the queue being drained to the queue of the instance its addressee is
+// connected to, if the addressee is not connected to another instance, the notification is released
+func (s *NotificationService) forward(ctx context.Context, queueUrl string, delivery model.NotificationMeta) {
+	lease := s.leaser.Acquire(ctx, delivery)
+	target, err := s.resolveQueueUrl(delivery.Notification.Addressee)
+	if err == nil && *target != queueUrl {
+		if _, err = s.broker.Publish(ctx, *target, delivery.Notification); err == nil {
+			if err := lease.Ack(ctx); err != nil {
+				s.zLog.Error("Error while deleting the forwarded notification", zap.String("message_id", delivery.Notification.Id), zap.Any("error", err))
+			}
+			return
+		}
+		s.zLog.Error("Error while forwarding notification", zap.String("message_id", delivery.Notification.Id), zap.String("queueUrl", *target), zap.Any("error", err))
+	}
+	if err := lease.ReleaseAfter(ctx, releaseBackoffBase); err != nil {
+		s.zLog.Error("Error while releasing notification", zap.String("message_id", delivery.Notification.Id), zap.Any("error", err))
+	}
+}
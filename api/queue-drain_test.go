@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"notification-service/common/broker"
+	"notification-service/database"
+	"notification-service/model"
+	"testing"
+	"time"
+)
+
+// fakeRoutes resolves the addressees to the instances they are connected to
+type fakeRoutes struct {
+	database.DatabaseInterface
+	instances map[string]string
+}
+
+func (f *fakeRoutes) GetClientRoute(client string) (route model.Route, err error) {
+	route.UserId = client
+	if instance, ok := f.instances[client]; ok {
+		route.Online = true
+		route.InstanceId = instance
+		route.QueueUrl = "prefix-" + instance
+	}
+	return route, nil
+}
+
+func newDrainTestService(b *broker.MemoryBroker, instances map[string]string) *NotificationService {
+	service := &NotificationService{
+		zLog:              *zap.NewNop(),
+		d:                 &fakeRoutes{instances: instances},
+		routes:            newRouteCache(0),
+		broker:            b,
+		serviceInstanceId: "gone",
+		queueUrl:          &[]string{"prefix-gone"}[0],
+		queueNamePrefix:   "prefix",
+		drainTimeout:      1500 * time.Millisecond,
+		ctx:               context.Background(),
+	}
+	service.leaser = broker.NewLeaser(b, time.Minute, &service.zLog)
+	return service
+}
+
+func TestDrainQueueForwardsNotificationsOfConnectedAddressees(t *testing.T) {
+	b := broker.NewMemoryBroker(time.Minute)
+	service := newDrainTestService(b, map[string]string{"connected": "alive"})
+	for _, addressee := range []string{"connected", "offline"} {
+		if _, err := b.Publish(context.Background(), "prefix-gone", model.Notification{Addressee: addressee, Body: addressee}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	remaining, err := service.drainQueue("prefix-gone")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	//The notification of the offline addressee is left to the redrive policy of the queue
+	if remaining != 1 {
+		t.Fatalf("unexpected number of remaining notifications: %d", remaining)
+	}
+	if count, _ := b.CountNotifications("prefix-alive"); count != 1 {
+		t.Fatalf("the notification has not been forwarded, %d notifications in the target queue", count)
+	}
+}
+
+func TestRetireQueueDeletesDrainedQueue(t *testing.T) {
+	b := broker.NewMemoryBroker(time.Minute)
+	service := newDrainTestService(b, map[string]string{"connected": "alive"})
+	if _, err := b.Publish(context.Background(), "prefix-gone", model.Notification{Addressee: "connected", Body: "body"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	start := time.Now()
+	service.retireQueue("prefix-gone", nil)
+	if elapsed := time.Since(start); elapsed >= service.drainTimeout {
+		t.Fatalf("the drained queue was not deleted before the drain timeout: %v", elapsed)
+	}
+	if count, _ := b.CountNotifications("prefix-gone"); count != 0 {
+		t.Fatalf("the queue has not been deleted")
+	}
+	if count, _ := b.CountNotifications("prefix-alive"); count != 1 {
+		t.Fatalf("the notification has not been forwarded")
+	}
+}
+
+func TestRetireQueueKeepsQueueConsumedAgain(t *testing.T) {
+	b := broker.NewMemoryBroker(time.Minute)
+	service := newDrainTestService(b, map[string]string{"connected": "alive"})
+	if _, err := b.Publish(context.Background(), "prefix-gone", model.Notification{Addressee: "offline", Body: "body"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	service.retireQueue("prefix-gone", func() bool { return false })
+	if count, _ := b.CountNotifications("prefix-gone"); count != 1 {
+		t.Fatalf("the queue consumed again has been drained or deleted")
+	}
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"notification-service/common/circuit"
+	"sync"
+	"time"
+)
+
+// releaseBackoffBase is the shortest delay after which a released notification becomes available again
+const releaseBackoffBase = time.Second
+
+// releaseBackoff calculates the delay after which a notification released by this instance becomes available again
+// The delay grows with every release of the same notification, so a notification which cannot be delivered for a while
+// (e.g. it is held back by the groupBarrier) does not circulate between the broker and the instances in a tight loop
+type releaseBackoff struct {
+	mutex   sync.Mutex
+	base    time.Duration
+	max     time.Duration
+	entries map[string]releaseEntry
+}
+
+type releaseEntry struct {
+	backoff   *circuit.Backoff
+	expiresAt time.Time
+}
+
+// newReleaseBackoff creates a new releaseBackoff, whose delays grow from base up to max
+func newReleaseBackoff(base, max time.Duration) *releaseBackoff {
+	return &releaseBackoff{
+		base:    base,
+		max:     max,
+		entries: make(map[string]releaseEntry),
+	}
+}
+
+// Next returns the delay of the next release of the notification, at least base and at most max
+// The releases of a notification are remembered until twice the maximum delay elapses without a new release
+func (r *releaseBackoff) Next(id string) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, ok := r.entries[id]
+	if !ok {
+		entry.backoff = circuit.NewBackoff(r.base, r.max)
+	}
+	entry.expiresAt = time.Now().Add(2 * r.max)
+	r.entries[id] = entry
+	return min(r.base+entry.backoff.Next(), r.max)
+}
+
+// PruneAll removes the expired entries
+func (r *releaseBackoff) PruneAll() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	for id, entry := range r.entries {
+		if now.After(entry.expiresAt) {
+			delete(r.entries, id)
+		}
+	}
+}
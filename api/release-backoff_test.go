@@ -0,0 +1,30 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReleaseBackoffGrows(t *testing.T) {
+	releases := newReleaseBackoff(100*time.Millisecond, time.Second)
+	for i, upper := range []time.Duration{200, 300, 500, 900, 1000, 1000} {
+		delay := releases.Next("id")
+		if delay < 100*time.Millisecond || delay > upper*time.Millisecond {
+			t.Fatalf("delay %d out of bounds: %v", i, delay)
+		}
+	}
+	//The releases of the other notifications are counted separately
+	if delay := releases.Next("other"); delay > 200*time.Millisecond {
+		t.Fatalf("unexpected delay of the first release: %v", delay)
+	}
+}
+
+func TestReleaseBackoffForgetsExpiredEntries(t *testing.T) {
+	releases := newReleaseBackoff(time.Millisecond, 10*time.Millisecond)
+	releases.Next("id")
+	time.Sleep(30 * time.Millisecond)
+	releases.PruneAll()
+	if len(releases.entries) != 0 {
+		t.Fatalf("the expired entry has not been removed")
+	}
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"notification-service/model"
+	"sync"
+	"time"
+)
+
+// routeCache keeps the recently looked up routes for ttl, so the publishers polling the route of the same users do not
+// query the database and the broker every time
+// The offline routes are cached as well. A cached route might be outdated by at most ttl, the routes of the users connecting
+// to or disconnecting from this instance are invalidated right away
+type routeCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedRoute
+}
+
+type cachedRoute struct {
+	route     model.Route
+	expiresAt time.Time
+}
+
+// newRouteCache creates a new routeCache, which keeps the routes for ttl, a zero ttl disables the caching
+func newRouteCache(ttl time.Duration) *routeCache {
+	return &routeCache{
+		ttl:     ttl,
+		entries: make(map[string]cachedRoute),
+	}
+}
+
+// Get returns the cached route of the user, if it has not expired yet
+func (r *routeCache) Get(userId string) (route model.Route, ok bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, ok := r.entries[userId]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return route, false
+	}
+	return entry.route, true
+}
+
+// Add caches the route of the user
+func (r *routeCache) Add(route model.Route) {
+	if r.ttl <= 0 {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entries[route.UserId] = cachedRoute{route: route, expiresAt: time.Now().Add(r.ttl)}
+}
+
+// Invalidate removes the cached route of the user
+func (r *routeCache) Invalidate(userId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.entries, userId)
+}
+
+// PruneAll removes the expired entries
+func (r *routeCache) PruneAll() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	for userId, entry := range r.entries {
+		if now.After(entry.expiresAt) {
+			delete(r.entries, userId)
+		}
+	}
+}
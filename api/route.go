@@ -0,0 +1,35 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"notification-service/common/common"
+	"notification-service/model"
+)
+
+// GetRoute returns the instance the user is connected to and the URL of its queue, so the publishers sending the
+// notifications to the queues directly do not need to access the database (ServiceInstanceQueue mode only)
+// If the user is not connected to any instance, the route is returned with online set to false
+func (s *NotificationService) GetRoute(c *gin.Context) {
+	route, err := s.lookupRoute(c.Param("userId"))
+	if err != nil {
+		s.zLog.Error("Error while looking up the route", zap.String("trace-id:", c.GetHeader("trace-id")), zap.Any("error", err))
+		common.ErrorResponse(c, 500, ErrorInternalServerError, "Route could not be looked up", c.GetHeader("trace-id"))
+		return
+	}
+	c.JSON(200, route)
+}
+
+// lookupRoute returns the route of the user from the cache, or reads it from the database, where the instances store the
+// URL of their queue with the leases of their clients
+func (s *NotificationService) lookupRoute(userId string) (route model.Route, err error) {
+	if route, ok := s.routes.Get(userId); ok {
+		return route, nil
+	}
+	route, err = s.d.GetClientRoute(userId)
+	if err != nil {
+		return route, err
+	}
+	s.routes.Add(route)
+	return route, nil
+}
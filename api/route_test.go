@@ -0,0 +1,37 @@
+package api
+
+import (
+	"go.uber.org/zap"
+	"notification-service/database"
+	"notification-service/model"
+	"testing"
+	"time"
+)
+
+// countingRoutes returns the stored route of every client and counts the lookups
+type countingRoutes struct {
+	database.DatabaseInterface
+	lookups int
+}
+
+func (f *countingRoutes) GetClientRoute(client string) (route model.Route, err error) {
+	f.lookups++
+	return model.Route{UserId: client, Online: true, InstanceId: "other", QueueUrl: "https://sqs.local/provisioned-queue"}, nil
+}
+
+func TestLookupRouteReturnsStoredQueueUrlAndCachesIt(t *testing.T) {
+	routes := &countingRoutes{}
+	service := &NotificationService{zLog: *zap.NewNop(), d: routes, routes: newRouteCache(time.Minute)}
+	for i := 0; i < 2; i++ {
+		route, err := service.lookupRoute("u1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !route.Online || route.QueueUrl != "https://sqs.local/provisioned-queue" {
+			t.Fatalf("unexpected route: %+v", route)
+		}
+	}
+	if routes.lookups != 1 {
+		t.Fatalf("unexpected number of database lookups: %d", routes.lookups)
+	}
+}
@@ -0,0 +1,195 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"net/http"
+	"notification-service/common/common"
+	"notification-service/model"
+	"strings"
+	"time"
+)
+
+// Close codes sent to WebSocket clients when the server terminates the connection (4000-4999 is reserved for applications)
+const (
+	WebSocketCloseTimeout      = 4000
+	WebSocketCloseTokenExpired = 4001
+	WebSocketCloseTerminated   = 4002
+)
+
+const webSocketWriteWait = 10 * time.Second
+
+// Types of the frames exchanged with WebSocket clients
+const (
+	webSocketFrameNotification = "notification"
+	webSocketFrameAck          = "ack"
+)
+
+// webSocketFrame is the JSON object sent over the WebSocket connection in both directions
+// The server sends notification frames, the client may send ack frames referring to the id of a received notification
+type webSocketFrame struct {
+	Type    string `json:"type"`
+	Id      string `json:"id,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Body    string `json:"body,omitempty"`
+}
+
+// newWebSocketUpgrader creates the upgrader used by the WebSocket endpoint
+// allowedOrigins is a comma separated list of origins allowed to open a connection, "*" allows any origin, if it is empty
+// only same-origin requests are accepted
+func newWebSocketUpgrader(allowedOrigins string) websocket.Upgrader {
+	upgrader := websocket.Upgrader{}
+	if allowedOrigins == "" {
+		return upgrader
+	}
+	origins := make(map[string]bool)
+	for _, origin := range strings.Split(allowedOrigins, ",") {
+		origins[strings.TrimSpace(origin)] = true
+	}
+	upgrader.CheckOrigin = func(r *http.Request) bool {
+		return origins["*"] || origins[r.Header.Get("Origin")]
+	}
+	return upgrader
+}
+
+// GetNotificationWebSocket upgrades the connection to WebSocket and streams the notifications of the client as JSON frames
+// The connection is kept alive by ping/pong messages and it is closed by the server when it reaches MAX_TIMEOUT_SECONDS or
+// when the token of the client expires
+func (s *NotificationService) GetNotificationWebSocket(c *gin.Context) {
+	traceId := c.GetHeader("trace-id")
+	tokenParsed, errToken := s.F.Auth().ParseJWTPayloadGin(c)
+	if errToken != nil {
+		s.zLog.Debug("Error while parsing token", zap.Any("error", errToken), zap.String("trace-id:", traceId))
+		common.ErrorResponse(c, 400, ErrorInvalidJwt, "Invalid token", traceId)
+		return
+	}
+	client := tokenParsed["sub"].(string)
+	var tokenExpired <-chan time.Time
+	if expiration, err := tokenParsed.GetExpirationTime(); err == nil && expiration != nil {
+		tokenExpired = time.After(time.Until(expiration.Time))
+	}
+
+	clientSession, err := s.openSession(client, getDeviceId(c), traceId)
+	if err != nil {
+		s.sessionErrorResponse(c, err, traceId)
+		return
+	}
+	defer s.closeSession(clientSession)
+
+	conn, err := s.wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		//The upgrader has already responded to the client with the corresponding HTTP error
+		s.zLog.Debug("Error while upgrading connection", zap.String("trace-id:", traceId), zap.Any("error", err))
+		return
+	}
+	defer conn.Close()
+
+	//Read the frames of the client in a dedicated goroutine, since reading is blocking
+	pongWait := 2 * s.wsPingInterval
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	incoming := make(chan webSocketFrame)
+	readerDone := make(chan error, 1)
+	stopped := make(chan interface{})
+	defer close(stopped)
+	go func() {
+		for {
+			_, payload, err := conn.ReadMessage()
+			if err != nil {
+				readerDone <- err
+				return
+			}
+			var frame webSocketFrame
+			if err := json.Unmarshal(payload, &frame); err != nil {
+				s.zLog.Debug("Invalid frame received", zap.String("trace-id:", traceId), zap.Any("error", err))
+				continue
+			}
+			select {
+			case incoming <- frame:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	//Resume the stream if the client provides the id of the last notification it has received, the same way as the event stream
+	if lastEventId := getLastEventId(c); lastEventId != "" {
+		for _, notification := range s.history.Since(client, lastEventId) {
+			if err := writeWebSocketNotification(conn, notification); err != nil {
+				s.zLog.Debug("Error while notifying client", zap.String("trace-id:", traceId), zap.Any("error", err))
+				return
+			}
+		}
+	}
+
+	timeoutChannel := time.After(time.Duration(s.maxTimeoutSeconds) * time.Second)
+	pingTicker := time.NewTicker(s.wsPingInterval)
+	defer pingTicker.Stop()
+	for {
+		select {
+		case err := <-readerDone:
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				s.zLog.Debug("WebSocket connection closed by the client", zap.String("trace-id:", traceId))
+			} else {
+				s.zLog.Debug("WebSocket connection lost", zap.String("trace-id:", traceId), zap.Any("error", err))
+			}
+			return
+		case <-timeoutChannel:
+			s.zLog.Debug("Connection timed out", zap.String("trace-id:", traceId))
+			closeWebSocket(conn, WebSocketCloseTimeout, "session timeout")
+			return
+		case <-tokenExpired:
+			s.zLog.Debug("Token expired", zap.String("trace-id:", traceId))
+			closeWebSocket(conn, WebSocketCloseTokenExpired, "token expired")
+			return
+		case <-pingTicker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketWriteWait)); err != nil {
+				s.zLog.Debug("Error while sending ping", zap.String("trace-id:", traceId), zap.Any("error", err))
+				return
+			}
+		case <-clientSession.Terminated():
+			s.zLog.Debug("Session terminated", zap.String("trace-id:", traceId), zap.Any("error", clientSession.Err()))
+			closeWebSocket(conn, WebSocketCloseTerminated, clientSession.Err().Error())
+			return
+		case frame := <-incoming:
+			s.handleWebSocketFrame(client, traceId, frame)
+		case notification := <-clientSession.Notifications():
+			s.zLog.Debug("Sending message to client", zap.String("trace-id:", traceId), zap.String("message_id", notification.Id))
+			if err := writeWebSocketNotification(conn, notification); err != nil {
+				s.zLog.Debug("Error while notifying client", zap.String("trace-id:", traceId), zap.Any("error", err))
+				return
+			}
+		}
+	}
+}
+
+// handleWebSocketFrame processes a frame sent by the client
+func (s *NotificationService) handleWebSocketFrame(client, traceId string, frame webSocketFrame) {
+	switch frame.Type {
+	case webSocketFrameAck:
+		s.zLog.Debug("Acknowledgement received", zap.String("trace-id:", traceId), zap.String("message_id", frame.Id))
+		_ = s.acknowledge(client, frame.Id, traceId)
+	default:
+		s.zLog.Debug("Unsupported frame received", zap.String("trace-id:", traceId), zap.String("type", frame.Type))
+	}
+}
+
+// writeWebSocketNotification sends the given notification to the client as a notification frame
+func writeWebSocketNotification(conn *websocket.Conn, notification model.Notification) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(webSocketWriteWait))
+	return conn.WriteJSON(webSocketFrame{
+		Type:    webSocketFrameNotification,
+		Id:      notification.Id,
+		Subject: notification.Subject,
+		Body:    notification.Body,
+	})
+}
+
+// closeWebSocket sends a close frame with the given code, the connection itself is closed by the caller
+func closeWebSocket(conn *websocket.Conn, code int, reason string) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(webSocketWriteWait))
+}
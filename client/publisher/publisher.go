@@ -0,0 +1,344 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"net/http"
+	"notification-service/common/circuit"
+	commonmodel "notification-service/common/common-model"
+	service "notification-service/common/sqs"
+	"notification-service/model"
+	"strconv"
+	"time"
+)
+
+// Config contains the parameters of the Publisher
+// Mode is the operation mode of the notification service, ServiceInstanceQueue and UserQueue are supported
+// UserQueueBaseUrl is the base URL of the user queues (SQS_USER_QUEUE_BASE_URL of the service), required in UserQueue mode
+// Fifo appends the FIFO suffix to the user queue URLs (SQS_FIFO of the service)
+// ServiceUrl is the base URL of the notification service and ApiKey is the key of the publisher (one of SERVICE_API_KEYS),
+// both required in ServiceInstanceQueue mode, where the queue of the instance the user is connected to is looked up
+// MaxAttempts is the number of attempts of sending a notification (defaults to 3), the failed attempts are retried after
+// a jittered exponential delay between BackoffBase and BackoffMax
+type Config struct {
+	Mode             commonmodel.OperationMode
+	UserQueueBaseUrl string
+	Fifo             bool
+	ServiceUrl       string
+	ApiKey           string
+	HttpClient       *http.Client
+	MaxAttempts      int
+	BackoffBase      time.Duration
+	BackoffMax       time.Duration
+	Logger           *zap.Logger
+}
+
+// Publisher sends notifications to the queues of their addressees, in the message layout the notification service expects
+// It is safe for concurrent use
+type Publisher struct {
+	sqs    sqsiface.SQSAPI
+	config Config
+	routes *routeClient
+	log    *zap.Logger
+}
+
+// message is a notification waiting to be sent, with the index of its result
+type message struct {
+	index        int
+	queueUrl     string
+	notification model.Notification
+}
+
+// NewPublisher is a factory function that creates a new Publisher instance, it returns ErrInvalidArgument if the config
+// is incomplete
+func NewPublisher(sqsClient sqsiface.SQSAPI, config Config) (*Publisher, error) {
+	if sqsClient == nil {
+		return nil, commonmodel.ErrInvalidArgument
+	}
+	switch config.Mode {
+	case commonmodel.UserQueue:
+		if config.UserQueueBaseUrl == "" {
+			return nil, commonmodel.ErrInvalidArgument
+		}
+	case commonmodel.ServiceInstanceQueue:
+		if config.ServiceUrl == "" || config.ApiKey == "" {
+			return nil, commonmodel.ErrInvalidArgument
+		}
+	default:
+		return nil, commonmodel.ErrInvalidArgument
+	}
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = 3
+	}
+	if config.BackoffBase <= 0 {
+		config.BackoffBase = 100 * time.Millisecond
+	}
+	if config.BackoffMax < config.BackoffBase {
+		config.BackoffMax = 20 * config.BackoffBase
+	}
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	publisher := &Publisher{
+		sqs:    sqsClient,
+		config: config,
+		log:    config.Logger,
+	}
+	if config.Mode == commonmodel.ServiceInstanceQueue {
+		publisher.routes = newRouteClient(config.ServiceUrl, config.ApiKey, config.HttpClient)
+	}
+	return publisher, nil
+}
+
+// Publish sends a notification to the user and returns the id of the notification and the id of the SQS message
+// The following errors are returned: ErrInvalidArgument if a field is empty, ErrContentTooLong if the message exceeds the
+// size limit of SQS, ErrAddresseeNotConnected if the user is not connected to any instance (ServiceInstanceQueue mode),
+// ErrRouteUnavailable or ErrSqsUnexpected if the notification could not be sent within MaxAttempts attempts
+func (p *Publisher) Publish(ctx context.Context, userId, subject, body string) (result model.PublishResult, err error) {
+	results := p.PublishBatch(ctx, []model.PublishRequest{{Addressee: userId, Subject: subject, Body: body}})
+	result = results[0]
+	if result.Error != "" {
+		return result, errorOfCode(result.Error)
+	}
+	return result, nil
+}
+
+// PublishBatch sends multiple notifications, the notifications sent to the same queue are sent in batches of up to 10
+// The notifications are sent independently, the result of each of them is returned in the order of the requests, the
+// error code of the failed ones is set in their Error field
+func (p *Publisher) PublishBatch(ctx context.Context, requests []model.PublishRequest) []model.PublishResult {
+	results := make([]model.PublishResult, len(requests))
+	queues := make(map[string][]message)
+	queueUrls := make(map[string]string)
+	for i, request := range requests {
+		results[i].Addressee = request.Addressee
+		notification := model.Notification{
+			Id:        uuid.New().String(),
+			Addressee: request.Addressee,
+			Subject:   request.Subject,
+			Body:      request.Body,
+		}
+		if err := validate(notification); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		//The queue of each user is resolved once per batch
+		queueUrl, ok := queueUrls[request.Addressee]
+		if !ok {
+			var err error
+			queueUrl, err = p.resolveQueueUrl(ctx, request.Addressee)
+			if err != nil {
+				p.log.Debug("Could not resolve the queue of the addressee", zap.String("addressee", request.Addressee), zap.Any("error", err))
+				results[i].Error = err.Error()
+				continue
+			}
+			queueUrls[request.Addressee] = queueUrl
+		}
+		queues[queueUrl] = append(queues[queueUrl], message{index: i, queueUrl: queueUrl, notification: notification})
+	}
+	for queueUrl, messages := range queues {
+		for _, batch := range splitBatches(messages) {
+			p.sendBatch(ctx, queueUrl, batch, results)
+		}
+	}
+	return results
+}
+
+// resolveQueueUrl returns the URL of the queue the notifications of the user must be sent to according to the operation mode
+func (p *Publisher) resolveQueueUrl(ctx context.Context, userId string) (queueUrl string, err error) {
+	if p.config.Mode == commonmodel.UserQueue {
+		queueUrl = p.config.UserQueueBaseUrl + "-" + userId
+		if p.config.Fifo {
+			queueUrl += service.FifoQueueSuffix
+		}
+		return queueUrl, nil
+	}
+	backoff := circuit.NewBackoff(p.config.BackoffBase, p.config.BackoffMax)
+	for attempt := 1; ; attempt++ {
+		queueUrl, err = p.routes.lookup(ctx, userId)
+		if !errors.Is(err, commonmodel.ErrRouteUnavailable) || attempt >= p.config.MaxAttempts {
+			return queueUrl, err
+		}
+		if !sleepWithContext(ctx, backoff.Next()) {
+			return "", commonmodel.ErrRouteUnavailable
+		}
+	}
+}
+
+// sendBatch sends the messages by a single SendMessageBatch request, the failed entries are retried until MaxAttempts
+// The ids of the entries are the indices of the messages within the batch, the entries are always sent in the order of the
+// batch, thus the order of the messages of a FIFO message group is kept
+func (p *Publisher) sendBatch(ctx context.Context, queueUrl string, batch []message, results []model.PublishResult) {
+	backoff := circuit.NewBackoff(p.config.BackoffBase, p.config.BackoffMax)
+	pending := make([]int, len(batch))
+	for i := range batch {
+		pending[i] = i
+	}
+	fail := func(indices []int, err error) {
+		for _, i := range indices {
+			results[batch[i].index].Error = err.Error()
+		}
+	}
+	for attempt := 1; len(pending) > 0; attempt++ {
+		input := &sqs.SendMessageBatchInput{QueueUrl: aws.String(queueUrl)}
+		for _, i := range pending {
+			input.Entries = append(input.Entries, createBatchEntry(strconv.Itoa(i), batch[i]))
+		}
+		output, err := p.sqs.SendMessageBatchWithContext(ctx, input)
+		if err != nil {
+			p.log.Debug("Error while sending notifications", zap.String("queueUrl", queueUrl), zap.Int("attempt", attempt), zap.Any("error", err))
+			if !isRetryableError(err) || attempt >= p.config.MaxAttempts || !sleepWithContext(ctx, backoff.Next()) {
+				fail(pending, sendErrorOf(err))
+				return
+			}
+			continue
+		}
+		done := make(map[string]bool, len(pending))
+		for _, entry := range output.Successful {
+			msg, ok := entryMessage(batch, entry.Id)
+			if !ok {
+				continue
+			}
+			results[msg.index].Id = msg.notification.Id
+			results[msg.index].MessageId = aws.StringValue(entry.MessageId)
+			done[aws.StringValue(entry.Id)] = true
+		}
+		retry := attempt < p.config.MaxAttempts
+		for _, entry := range output.Failed {
+			msg, ok := entryMessage(batch, entry.Id)
+			if !ok {
+				continue
+			}
+			p.log.Debug("Notification could not be sent", zap.String("queueUrl", queueUrl), zap.String("code", aws.StringValue(entry.Code)), zap.Bool("senderFault", aws.BoolValue(entry.SenderFault)))
+			if aws.BoolValue(entry.SenderFault) || !retry {
+				if aws.BoolValue(entry.SenderFault) {
+					results[msg.index].Error = commonmodel.ErrInvalidArgument.Error()
+				} else {
+					results[msg.index].Error = commonmodel.ErrSqsUnexpected.Error()
+				}
+				done[aws.StringValue(entry.Id)] = true
+			}
+		}
+		remaining := pending[:0]
+		for _, i := range pending {
+			if !done[strconv.Itoa(i)] {
+				remaining = append(remaining, i)
+			}
+		}
+		pending = remaining
+		if len(pending) > 0 && !sleepWithContext(ctx, backoff.Next()) {
+			fail(pending, commonmodel.ErrSqsUnexpected)
+			return
+		}
+	}
+}
+
+// entryMessage returns the message of the batch the entry id refers to
+func entryMessage(batch []message, entryId *string) (msg message, ok bool) {
+	i, err := strconv.Atoi(aws.StringValue(entryId))
+	if err != nil || i < 0 || i >= len(batch) {
+		return message{}, false
+	}
+	return batch[i], true
+}
+
+// createBatchEntry creates the batch entry of the message, FIFO messages are grouped by the addressee and deduplicated by
+// the notification id
+func createBatchEntry(entryId string, msg message) *sqs.SendMessageBatchRequestEntry {
+	entry := &sqs.SendMessageBatchRequestEntry{
+		Id:                aws.String(entryId),
+		MessageBody:       aws.String(msg.notification.Body),
+		MessageAttributes: model.NotificationMessageAttributes(msg.notification),
+	}
+	if service.IsFifoQueue(msg.queueUrl) {
+		entry.MessageGroupId = aws.String(msg.notification.Addressee)
+		entry.MessageDeduplicationId = aws.String(msg.notification.Id)
+	}
+	return entry
+}
+
+// splitBatches splits the messages into batches of at most MaxBatchSize entries, whose total size does not exceed the
+// size limit of a SendMessageBatch request
+func splitBatches(messages []message) (batches [][]message) {
+	var batch []message
+	size := 0
+	for _, msg := range messages {
+		msgSize := messageSize(msg.notification)
+		if len(batch) == service.MaxBatchSize || size+msgSize > service.MaxMessageBodySize {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, msg)
+		size += msgSize
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// validate checks the fields of the notification and its size, which includes the message attributes
+func validate(notification model.Notification) error {
+	if notification.Addressee == "" || notification.Subject == "" || notification.Body == "" {
+		return commonmodel.ErrInvalidArgument
+	}
+	if messageSize(notification) > service.MaxMessageBodySize {
+		return commonmodel.ErrContentTooLong
+	}
+	return nil
+}
+
+// messageSize returns the size of the SQS message carrying the notification as SQS accounts it: the body, and the name,
+// data type and value of each message attribute
+func messageSize(notification model.Notification) int {
+	size := len(notification.Body)
+	for name, attribute := range model.NotificationMessageAttributes(notification) {
+		size += len(name) + len(aws.StringValue(attribute.DataType)) + len(aws.StringValue(attribute.StringValue))
+	}
+	return size
+}
+
+// isRetryableError reports whether the failed request is worth retrying, e.g. throttling or a temporary server error
+func isRetryableError(err error) bool {
+	return request.IsErrorRetryable(err) || request.IsErrorThrottle(err)
+}
+
+// sendErrorOf maps the error of a failed request to the errors of the package
+func sendErrorOf(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	if aerr, ok := err.(interface{ Code() string }); ok && aerr.Code() == request.CanceledErrorCode {
+		return context.Canceled
+	}
+	return commonmodel.ErrSqsUnexpected
+}
+
+// errorOfCode returns the error of the package with the given error code
+func errorOfCode(code string) error {
+	for _, err := range []error{commonmodel.ErrInvalidArgument, commonmodel.ErrContentTooLong, commonmodel.ErrAddresseeNotConnected,
+		commonmodel.ErrRouteUnavailable, commonmodel.ErrInvalidApiKey, context.Canceled, context.DeadlineExceeded} {
+		if err.Error() == code {
+			return err
+		}
+	}
+	return commonmodel.ErrSqsUnexpected
+}
+
+// sleepWithContext waits for the given duration, it returns false if the context is cancelled in the meantime
+func sleepWithContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,158 @@
+package publisher
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	commonmodel "notification-service/common/common-model"
+	service "notification-service/common/sqs"
+	"notification-service/model"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSqs records the SendMessageBatch requests, the entries whose body is listed in failures fail that many times
+type fakeSqs struct {
+	sqsiface.SQSAPI
+	mutex    sync.Mutex
+	requests []*sqs.SendMessageBatchInput
+	failures map[string]int
+}
+
+func (f *fakeSqs) SendMessageBatchWithContext(ctx aws.Context, input *sqs.SendMessageBatchInput, options ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests = append(f.requests, input)
+	output := &sqs.SendMessageBatchOutput{}
+	for _, entry := range input.Entries {
+		body := aws.StringValue(entry.MessageBody)
+		if f.failures[body] > 0 {
+			f.failures[body]--
+			output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{Id: entry.Id, Code: aws.String("InternalError"), SenderFault: aws.Bool(false)})
+			continue
+		}
+		output.Successful = append(output.Successful, &sqs.SendMessageBatchResultEntry{Id: entry.Id, MessageId: aws.String("message-" + body)})
+	}
+	return output, nil
+}
+
+func newTestPublisher(t *testing.T, fake *fakeSqs) *Publisher {
+	publisher, err := NewPublisher(fake, Config{
+		Mode:             commonmodel.UserQueue,
+		UserQueueBaseUrl: "https://sqs.local/queue",
+		BackoffBase:      time.Millisecond,
+		BackoffMax:       time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return publisher
+}
+
+func TestPublishBatchSplitsIntoBatches(t *testing.T) {
+	fake := &fakeSqs{}
+	publisher := newTestPublisher(t, fake)
+	var requests []model.PublishRequest
+	for i := 0; i < 2*service.MaxBatchSize+1; i++ {
+		requests = append(requests, model.PublishRequest{Addressee: "u1", Subject: "subject", Body: strconv.Itoa(i)})
+	}
+	requests = append(requests, model.PublishRequest{Addressee: "u1", Subject: "", Body: "invalid"})
+	results := publisher.PublishBatch(context.Background(), requests)
+	if len(fake.requests) != 3 {
+		t.Fatalf("unexpected number of requests: %d", len(fake.requests))
+	}
+	for _, input := range fake.requests {
+		if len(input.Entries) > service.MaxBatchSize || aws.StringValue(input.QueueUrl) != "https://sqs.local/queue-u1" {
+			t.Fatalf("unexpected request: %v", input)
+		}
+	}
+	for i, result := range results[:len(results)-1] {
+		if result.Error != "" || result.Id == "" || result.MessageId != "message-"+strconv.Itoa(i) {
+			t.Fatalf("unexpected result %d: %+v", i, result)
+		}
+	}
+	if results[len(results)-1].Error != commonmodel.ErrInvalidArgument.Error() {
+		t.Fatalf("unexpected result of the invalid request: %+v", results[len(results)-1])
+	}
+}
+
+func TestPublishBatchRetriesFailedEntries(t *testing.T) {
+	fake := &fakeSqs{failures: map[string]int{"retried": 1, "failed": 3}}
+	publisher := newTestPublisher(t, fake)
+	results := publisher.PublishBatch(context.Background(), []model.PublishRequest{
+		{Addressee: "u1", Subject: "subject", Body: "sent"},
+		{Addressee: "u1", Subject: "subject", Body: "retried"},
+		{Addressee: "u1", Subject: "subject", Body: "failed"},
+	})
+	if len(fake.requests) != 3 {
+		t.Fatalf("unexpected number of requests: %d", len(fake.requests))
+	}
+	if results[0].MessageId != "message-sent" || results[1].MessageId != "message-retried" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if results[2].Error != commonmodel.ErrSqsUnexpected.Error() {
+		t.Fatalf("unexpected result of the failed entry: %+v", results[2])
+	}
+}
+
+func TestSplitBatchesRespectsSizeLimit(t *testing.T) {
+	body := strings.Repeat("x", service.MaxMessageBodySize/3)
+	var messages []message
+	for i := 0; i < 4; i++ {
+		messages = append(messages, message{index: i, notification: model.Notification{Id: "id", Addressee: "u1", Subject: "s", Body: body}})
+	}
+	batches := splitBatches(messages)
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 2 {
+		t.Fatalf("unexpected batches: %d", len(batches))
+	}
+	if batches[1][0].index != 2 {
+		t.Fatalf("the order of the messages must be kept")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := model.Notification{Id: "id", Addressee: "u1", Subject: "subject", Body: "body"}
+	if err := validate(valid); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	empty := valid
+	empty.Body = ""
+	if err := validate(empty); err != commonmodel.ErrInvalidArgument {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	//The message attributes count towards the size limit
+	long := valid
+	long.Body = strings.Repeat("x", service.MaxMessageBodySize-len(valid.Subject))
+	if err := validate(long); err != commonmodel.ErrContentTooLong {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestPublishBatchKeepsOrderOfEntries(t *testing.T) {
+	fake := &fakeSqs{failures: map[string]int{"2": 1, "5": 1}}
+	publisher := newTestPublisher(t, fake)
+	var requests []model.PublishRequest
+	for i := 0; i < service.MaxBatchSize; i++ {
+		requests = append(requests, model.PublishRequest{Addressee: "u1", Subject: "subject", Body: strconv.Itoa(i)})
+	}
+	publisher.PublishBatch(context.Background(), requests)
+	if len(fake.requests) != 2 {
+		t.Fatalf("unexpected number of requests: %d", len(fake.requests))
+	}
+	//The retried entries are sent in their original order too
+	for _, input := range fake.requests {
+		previous := -1
+		for _, entry := range input.Entries {
+			i, _ := strconv.Atoi(aws.StringValue(entry.MessageBody))
+			if i <= previous {
+				t.Fatalf("entries out of order: %v", input.Entries)
+			}
+			previous = i
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"strings"
+)
+
+// apiKeyHeader is the header the publisher authenticates with by its API key at the route lookup endpoint
+const apiKeyHeader = "X-Api-Key"
+
+// routeClient looks up the instance queue of the users through the GET /routes/{userId} endpoint of the notification service
+type routeClient struct {
+	serviceUrl string
+	apiKey     string
+	http       *http.Client
+}
+
+// newRouteClient creates a new routeClient for the notification service available at serviceUrl
+func newRouteClient(serviceUrl string, apiKey string, httpClient *http.Client) *routeClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &routeClient{
+		serviceUrl: strings.TrimSuffix(serviceUrl, "/"),
+		apiKey:     apiKey,
+		http:       httpClient,
+	}
+}
+
+// lookup returns the queue URL of the instance the user is connected to
+// ErrAddresseeNotConnected is returned if the user is not connected to any instance, ErrRouteUnavailable if the route
+// could not be looked up, which is worth retrying
+func (r *routeClient) lookup(ctx context.Context, userId string) (queueUrl string, err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, r.serviceUrl+"/routes/"+url.PathEscape(userId), nil)
+	if err != nil {
+		return "", commonmodel.ErrInvalidArgument
+	}
+	request.Header.Set(apiKeyHeader, r.apiKey)
+	response, err := r.http.Do(request)
+	if err != nil {
+		return "", commonmodel.ErrRouteUnavailable
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusUnauthorized {
+		return "", commonmodel.ErrInvalidApiKey
+	} else if response.StatusCode != http.StatusOK {
+		return "", commonmodel.ErrRouteUnavailable
+	}
+	var route model.Route
+	if err := json.NewDecoder(response.Body).Decode(&route); err != nil {
+		return "", commonmodel.ErrRouteUnavailable
+	}
+	if !route.Online || route.QueueUrl == "" {
+		return "", commonmodel.ErrAddresseeNotConnected
+	}
+	return route.QueueUrl, nil
+}
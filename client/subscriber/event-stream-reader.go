@@ -0,0 +1,74 @@
+package subscriber
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLineSize is the longest line of the event stream accepted, it exceeds the size limit of the notifications
+const maxLineSize = 1024 * 1024
+
+// event is a single Server-Sent Events frame
+type event struct {
+	id    string
+	name  string
+	data  string
+	retry time.Duration
+}
+
+// eventStreamReader parses the Server-Sent Events frames of a stream
+type eventStreamReader struct {
+	scanner *bufio.Scanner
+}
+
+// newEventStreamReader creates a new eventStreamReader reading the given stream
+func newEventStreamReader(r io.Reader) *eventStreamReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	return &eventStreamReader{scanner: scanner}
+}
+
+// Next returns the next frame of the stream, io.EOF is returned when the stream ends
+// The data fields of the frame are joined by line breaks, the comment lines and the unknown fields are ignored. A frame
+// consisting of a retry field only is returned as well, so the reconnection delay advised by the server is not lost
+func (r *eventStreamReader) Next() (e event, err error) {
+	var data []string
+	empty := true
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		if line == "" {
+			if empty {
+				continue
+			}
+			e.data = strings.Join(data, "\n")
+			return e, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			e.id = value
+		case "event":
+			e.name = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			if milliseconds, err := strconv.Atoi(value); err == nil && milliseconds >= 0 {
+				e.retry = time.Duration(milliseconds) * time.Millisecond
+			}
+		default:
+			continue
+		}
+		empty = false
+	}
+	if err := r.scanner.Err(); err != nil {
+		return e, err
+	}
+	return e, io.EOF
+}
@@ -0,0 +1,48 @@
+package subscriber
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStreamReader(t *testing.T) {
+	stream := ": comment\n\n" +
+		"retry: 3000\n\n" +
+		"id: 1\nevent: subject\ndata: first\ndata:second\nunknown: field\n\n" +
+		"\n\n" +
+		"event: error\ndata: CODE\n\n" +
+		"id: 2\ndata: unterminated"
+	reader := newEventStreamReader(strings.NewReader(stream))
+	expected := []event{
+		{retry: 3 * time.Second},
+		{id: "1", name: "subject", data: "first\nsecond"},
+		{name: "error", data: "CODE"},
+	}
+	for i, e := range expected {
+		actual, err := reader.Next()
+		if err != nil {
+			t.Fatalf("unexpected error of event %d: %v", i, err)
+		}
+		if actual != e {
+			t.Fatalf("unexpected event %d: %+v, expected %+v", i, actual, e)
+		}
+	}
+	//An incomplete frame at the end of the stream is dropped
+	if _, err := reader.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("unexpected error at the end of the stream: %v", err)
+	}
+}
+
+func TestEventStreamReaderIgnoresInvalidRetry(t *testing.T) {
+	reader := newEventStreamReader(strings.NewReader("retry: soon\ndata: body\n\n"))
+	e, err := reader.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.retry != 0 || e.data != "body" {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+}
@@ -0,0 +1,280 @@
+package subscriber
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"notification-service/common/circuit"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errorEvent is the event the service sends right before it closes a stream it can no longer serve
+const errorEvent = "error"
+
+// terminationError is returned by stream if the service closed the stream by an error event, code is the data of the event
+type terminationError struct {
+	code string
+}
+
+func (e terminationError) Error() string {
+	return "stream terminated by the service: " + e.code
+}
+
+// TokenFunc returns the bearer token the stream is opened with, it is called before every connection attempt, thus it
+// should return a cached token until it is about to expire
+// If forceRefresh is true, the previous token has been rejected by the service and a new one must be obtained
+type TokenFunc func(ctx context.Context, forceRefresh bool) (token string, err error)
+
+// Config contains the parameters of the Subscriber
+// ServiceUrl is the base URL of the notification service
+// Token provides the bearer token of the user
+// The failed connection attempts are retried after a jittered exponential delay between BackoffBase and BackoffMax, while
+// after the service closes the stream (e.g. at MAX_TIMEOUT_SECONDS) the client reconnects after the delay advised by the
+// service (SSE_RETRY_MILLISECONDS). If the service has not advised a delay, or it terminated the stream by an error event,
+// the reconnection is backed off the same way as the failed attempts
+type Config struct {
+	ServiceUrl  string
+	Token       TokenFunc
+	HttpClient  *http.Client
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	Logger      *zap.Logger
+}
+
+// Subscriber receives the notifications of a user through the Server-Sent Events stream of the notification service and
+// keeps the stream open: it reconnects whenever the stream ends and resumes from the last notification received
+type Subscriber struct {
+	config     Config
+	serviceUrl string
+	http       *http.Client
+	log        *zap.Logger
+	mutex      sync.Mutex
+	lastId     string
+	retry      time.Duration
+	err        error
+}
+
+// NewSubscriber is a factory function that creates a new Subscriber instance, it returns ErrInvalidArgument if the config
+// is incomplete
+func NewSubscriber(config Config) (*Subscriber, error) {
+	if config.ServiceUrl == "" || config.Token == nil {
+		return nil, commonmodel.ErrInvalidArgument
+	}
+	if config.HttpClient == nil {
+		config.HttpClient = http.DefaultClient
+	}
+	if config.BackoffBase <= 0 {
+		config.BackoffBase = 500 * time.Millisecond
+	}
+	if config.BackoffMax < config.BackoffBase {
+		config.BackoffMax = 60 * config.BackoffBase
+	}
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	return &Subscriber{
+		config:     config,
+		serviceUrl: strings.TrimSuffix(config.ServiceUrl, "/"),
+		http:       config.HttpClient,
+		log:        config.Logger,
+	}, nil
+}
+
+// Subscribe receives the notifications in the background and delivers them to the returned channel, which is closed when
+// the context is cancelled or the subscription fails permanently (see Err)
+func (s *Subscriber) Subscribe(ctx context.Context) <-chan model.Notification {
+	c := make(chan model.Notification)
+	go func() {
+		defer close(c)
+		err := s.Run(ctx, func(notification model.Notification) {
+			select {
+			case c <- notification:
+			case <-ctx.Done():
+			}
+		})
+		s.mutex.Lock()
+		s.err = err
+		s.mutex.Unlock()
+	}()
+	return c
+}
+
+// Err returns the error the subscription started by Subscribe failed with, nil if it was stopped by its context
+func (s *Subscriber) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// LastEventId returns the id of the last notification received, the stream is resumed from it after reconnecting
+func (s *Subscriber) LastEventId() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastId
+}
+
+// Run receives the notifications and calls handle for each of them, until the context is cancelled (nil is returned) or
+// the subscription fails permanently: ErrInvalidToken if the service rejects the refreshed token too, ErrInvalidArgument
+// if the service rejects the request, or the error of the token function
+func (s *Subscriber) Run(ctx context.Context, handle func(notification model.Notification)) error {
+	backoff := circuit.NewBackoff(s.config.BackoffBase, s.config.BackoffMax)
+	forceRefresh := false
+	for {
+		token, err := s.config.Token(ctx, forceRefresh)
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		status, err := s.stream(ctx, token, handle)
+		if ctx.Err() != nil {
+			return nil
+		}
+		delay := time.Duration(0)
+		var terminated terminationError
+		switch {
+		case status == http.StatusUnauthorized:
+			if forceRefresh {
+				return commonmodel.ErrInvalidToken
+			}
+			s.log.Debug("Token rejected, refreshing it")
+			forceRefresh = true
+			continue
+		case status >= 400 && status < 500:
+			s.log.Error("Subscription rejected", zap.Int("status", status))
+			return commonmodel.ErrInvalidArgument
+		case errors.As(err, &terminated):
+			//The service can no longer serve the stream (e.g. it is shutting down), the reconnection is backed off, since
+			//the next connection might end up at the same instance
+			delay = backoff.Next()
+			s.log.Warn("Stream terminated by the service, reconnecting", zap.String("error", terminated.code), zap.Duration("delay", delay))
+		case err != nil || status != http.StatusOK:
+			delay = backoff.Next()
+			s.log.Debug("Connection failed, reconnecting", zap.Int("status", status), zap.Duration("delay", delay), zap.Any("error", err))
+		default:
+			//The service closed the stream, e.g. because it reached the maximum duration of a connection, if it has not
+			//advised a delay, the reconnection is backed off
+			if delay = s.retryDelay(); delay > 0 {
+				backoff.Reset()
+			} else {
+				delay = backoff.Next()
+			}
+			s.log.Debug("Stream closed, reconnecting", zap.Duration("delay", delay))
+		}
+		forceRefresh = false
+		if !sleepWithContext(ctx, delay) {
+			return nil
+		}
+	}
+}
+
+// stream opens the event stream and delivers the notifications until it ends, it returns the status code of the response
+// and the error the stream ended with: nil if it was closed by the service, terminationError if the service closed it by
+// an error event
+func (s *Subscriber) stream(ctx context.Context, token string, handle func(notification model.Notification)) (status int, err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.serviceUrl+"/notifications", nil)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Accept", "text/event-stream")
+	if lastId := s.LastEventId(); lastId != "" {
+		request.Header.Set("Last-Event-ID", lastId)
+	}
+	response, err := s.http.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return response.StatusCode, nil
+	}
+	reader := newEventStreamReader(response.Body)
+	for {
+		e, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return response.StatusCode, nil
+		} else if err != nil {
+			return response.StatusCode, err
+		}
+		if e.retry > 0 {
+			s.mutex.Lock()
+			s.retry = e.retry
+			s.mutex.Unlock()
+		}
+		if e.name == errorEvent && e.id == "" {
+			return response.StatusCode, terminationError{code: e.data}
+		}
+		if e.id == "" && e.data == "" {
+			continue
+		}
+		if e.id != "" {
+			s.mutex.Lock()
+			s.lastId = e.id
+			s.mutex.Unlock()
+		}
+		//The addressee is the user of the token, it is not part of the frames
+		handle(model.Notification{Id: e.id, Subject: e.name, Body: e.data})
+	}
+}
+
+// Ack acknowledges the receipt of the notification, required if the service runs with ACK_REQUIRED, otherwise the
+// notification is delivered again after ACK_TIMEOUT_SECONDS
+// ErrNotificationNotFound is returned if the notification is not waiting for an acknowledgement (anymore)
+func (s *Subscriber) Ack(ctx context.Context, id string) error {
+	forceRefresh := false
+	for {
+		token, err := s.config.Token(ctx, forceRefresh)
+		if err != nil {
+			return err
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.serviceUrl+"/notifications/"+url.PathEscape(id)+"/ack", nil)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := s.http.Do(request)
+		if err != nil {
+			return err
+		}
+		_ = response.Body.Close()
+		switch {
+		case response.StatusCode == http.StatusUnauthorized && !forceRefresh:
+			forceRefresh = true
+			continue
+		case response.StatusCode == http.StatusUnauthorized:
+			return commonmodel.ErrInvalidToken
+		case response.StatusCode == http.StatusNotFound:
+			return commonmodel.ErrNotificationNotFound
+		case response.StatusCode >= 300:
+			return commonmodel.ErrSqsInternalServerError
+		}
+		return nil
+	}
+}
+
+// retryDelay returns the reconnection delay advised by the service
+func (s *Subscriber) retryDelay() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.retry
+}
+
+// sleepWithContext waits for the given duration, it returns false if the context is cancelled in the meantime
+func sleepWithContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,57 @@
+package subscriber
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"notification-service/model"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countConnections runs the subscriber against a service which answers every connection with the given frames, and
+// returns the number of connections within the given duration
+func countConnections(t *testing.T, frames string, duration time.Duration) int32 {
+	var connections atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte(frames))
+	}))
+	defer server.Close()
+	subscriber, err := NewSubscriber(Config{
+		ServiceUrl:  server.URL,
+		Token:       func(ctx context.Context, forceRefresh bool) (string, error) { return "token", nil },
+		BackoffBase: 100 * time.Millisecond,
+		BackoffMax:  time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	if err := subscriber.Run(ctx, func(notification model.Notification) {}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return connections.Load()
+}
+
+func TestSubscriberBacksOffWithoutRetry(t *testing.T) {
+	if connections := countConnections(t, "", 500*time.Millisecond); connections > 20 {
+		t.Fatalf("the reconnections are not backed off: %d connections", connections)
+	}
+}
+
+func TestSubscriberBacksOffAfterErrorEvent(t *testing.T) {
+	frames := "retry: 1\n\nevent: error\ndata: ERROR_CODE\n\n"
+	if connections := countConnections(t, frames, 500*time.Millisecond); connections > 20 {
+		t.Fatalf("the reconnections are not backed off: %d connections", connections)
+	}
+}
+
+func TestSubscriberReconnectsAfterAdvisedDelay(t *testing.T) {
+	if connections := countConnections(t, "retry: 10\n\n", 500*time.Millisecond); connections < 10 {
+		t.Fatalf("the advised delay is not used: %d connections", connections)
+	}
+}
@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"context"
+	"notification-service/model"
+	"sync"
+)
+
+// Broker is the message broker neutral interface the notification service depends on to publish and receive notifications
+// A destination is the broker specific identifier of the place where notifications are sent to and received from (e.g.
+// the URL of an SQS queue). Deliveries are represented by model.NotificationMeta, where ReceiptHandle is an opaque,
+// broker specific handle which is only used to acknowledge the delivery
+type Broker interface {
+	// CreateDestination creates a new destination with the given name and returns its identifier
+	CreateDestination(name string) (destination string, err error)
+	// GetDestination returns the identifier of an existing destination with the given name
+	GetDestination(name string) (destination string, err error)
+	// Publish sends the notification to the given destination and returns the id of the message
+	Publish(ctx context.Context, destination string, notification model.Notification) (messageId string, err error)
+	// Subscribe starts receiving the notifications of the destination to the given channel until ctx is cancelled
+	Subscribe(ctx context.Context, destination string, c chan<- model.NotificationMeta) (subscription *Subscription, err error)
+	// Ack confirms the delivery, thus the notification is removed from the destination
+	Ack(ctx context.Context, delivery model.NotificationMeta) error
+	// Nack releases the delivery, thus the notification becomes available for the consumers of the destination again
+	Nack(ctx context.Context, delivery model.NotificationMeta) error
+}
+
+// DestinationDeleter is implemented by the brokers which can delete the destinations they have created
+type DestinationDeleter interface {
+	// DeleteDestination deletes the destination together with the notifications it still contains
+	DeleteDestination(destination string) error
+}
+
+// DestinationCounter is implemented by the brokers which can tell how many notifications a destination still contains
+type DestinationCounter interface {
+	// CountNotifications returns the (approximate) number of notifications of the destination, including the in-flight ones
+	CountNotifications(destination string) (count int, err error)
+}
+
+// Closer is implemented by the brokers which hold resources on the broker side on behalf of the instance, which have to be
+// released when the instance stops
+type Closer interface {
+	// Close releases the resources of the instance, the broker must not be used afterwards
+	Close()
+}
+
+// Subscription represents a running subscription of a destination
+type Subscription struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// NewSubscription is a factory function that creates a new Subscription instance, it is meant to be used by Broker implementations
+func NewSubscription() *Subscription {
+	return &Subscription{done: make(chan struct{})}
+}
+
+// Done returns a channel which is closed when the subscription stops
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error which stopped the subscription, it is nil if the subscription was stopped by cancelling its context
+// It must be called only after Done is closed
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// Close stops the subscription with the given error, only the first call has effect
+func (s *Subscription) Close(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
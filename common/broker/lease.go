@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"notification-service/model"
+	"time"
+)
+
+// LeaseExtender is implemented by the brokers which can extend the visibility timeout of a delivery, so a notification
+// which is still being processed does not reappear for the other consumers of the destination
+type LeaseExtender interface {
+	// Extend hides the delivery from the other consumers for visibilityTimeout counted from now
+	Extend(ctx context.Context, delivery model.NotificationMeta, visibilityTimeout time.Duration) error
+}
+
+// DelayedReleaser is implemented by the brokers which can release a delivery so that it becomes available again only after
+// a delay, thus a notification which cannot be delivered for a while does not circulate in a tight loop
+type DelayedReleaser interface {
+	// NackWithDelay releases the delivery, the notification becomes available for the consumers of the destination after delay
+	NackWithDelay(ctx context.Context, delivery model.NotificationMeta, delay time.Duration) error
+}
+
+// Leaser keeps the in-flight deliveries hidden from the other consumers by periodically extending their visibility timeout,
+// if the broker does not implement LeaseExtender, the deliveries are simply acknowledged or released at the end of the lease
+type Leaser struct {
+	broker            Broker
+	extender          LeaseExtender
+	visibilityTimeout time.Duration
+	log               *zap.Logger
+}
+
+// Lease represents a delivery whose visibility timeout is being extended, it ends with Ack, Release or Stop
+type Lease struct {
+	Delivery model.NotificationMeta
+	leaser   *Leaser
+	cancel   context.CancelFunc
+}
+
+// NewLeaser is a factory function that creates a new Leaser instance
+// visibilityTimeout is the visibility timeout the deliveries are received with, it is extended when half of it has elapsed
+func NewLeaser(broker Broker, visibilityTimeout time.Duration, logger *zap.Logger) *Leaser {
+	extender, _ := broker.(LeaseExtender)
+	return &Leaser{
+		broker:            broker,
+		extender:          extender,
+		visibilityTimeout: visibilityTimeout,
+		log:               logger,
+	}
+}
+
+// Acquire starts extending the visibility timeout of the delivery until the returned lease ends or ctx is cancelled
+func (l *Leaser) Acquire(ctx context.Context, delivery model.NotificationMeta) *Lease {
+	leaseCtx, cancel := context.WithCancel(ctx)
+	lease := &Lease{
+		Delivery: delivery,
+		leaser:   l,
+		cancel:   cancel,
+	}
+	if l.extender != nil && l.visibilityTimeout > 0 {
+		go lease.keepAlive(leaseCtx)
+	}
+	return lease
+}
+
+// Ack ends the lease and confirms the delivery, thus the notification is removed from the destination
+func (l *Lease) Ack(ctx context.Context) error {
+	l.cancel()
+	return l.leaser.broker.Ack(ctx, l.Delivery)
+}
+
+// Release ends the lease and makes the notification immediately available for the consumers of the destination again
+func (l *Lease) Release(ctx context.Context) error {
+	l.cancel()
+	return l.leaser.broker.Nack(ctx, l.Delivery)
+}
+
+// ReleaseAfter ends the lease and makes the notification available for the consumers of the destination after delay, if
+// the broker does not implement DelayedReleaser it is released immediately
+func (l *Lease) ReleaseAfter(ctx context.Context, delay time.Duration) error {
+	l.cancel()
+	if releaser, ok := l.leaser.broker.(DelayedReleaser); ok {
+		return releaser.NackWithDelay(ctx, l.Delivery, delay)
+	}
+	return l.leaser.broker.Nack(ctx, l.Delivery)
+}
+
+// Stop ends the lease without touching the delivery, the notification reappears when its current visibility timeout expires
+func (l *Lease) Stop() {
+	l.cancel()
+}
+
+// keepAlive extends the visibility timeout of the delivery periodically until ctx is cancelled, or an extension fails
+func (l *Lease) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(l.leaser.visibilityTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := l.leaser.extender.Extend(ctx, l.Delivery, l.leaser.visibilityTimeout)
+			if err != nil {
+				if ctx.Err() == nil {
+					l.leaser.log.Error("Error while extending the visibility timeout", zap.String("message_id", l.Delivery.Notification.Id), zap.Any("error", err))
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package broker
+
+import (
+	"context"
+	"github.com/google/uuid"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"sync"
+	"time"
+)
+
+// MemoryBroker is an in-process Broker implementation, which makes it possible to run the service locally and in tests
+// without any external message broker
+// Destinations are created implicitly on first use. Similarly to SQS, a received notification is hidden from the other
+// consumers until it is acknowledged, or until the visibility timeout expires
+type MemoryBroker struct {
+	mutex             sync.Mutex
+	destinations      map[string]*memoryDestination
+	visibilityTimeout time.Duration
+}
+
+type memoryDestination struct {
+	pending  []model.Notification
+	inFlight map[string]memoryInFlight
+	signal   chan struct{}
+}
+
+type memoryInFlight struct {
+	notification model.Notification
+	expiresAt    time.Time
+}
+
+// memoryPollInterval is the maximum time a subscriber waits before checking the expired in-flight notifications
+const memoryPollInterval = time.Second
+
+// NewMemoryBroker is a factory function that creates a new MemoryBroker instance
+func NewMemoryBroker(visibilityTimeout time.Duration) *MemoryBroker {
+	return &MemoryBroker{
+		destinations:      make(map[string]*memoryDestination),
+		visibilityTimeout: visibilityTimeout,
+	}
+}
+
+// CreateDestination creates the destination with the given name, the name itself is used as the identifier
+func (b *MemoryBroker) CreateDestination(name string) (destination string, err error) {
+	if len(name) == 0 {
+		return "", commonmodel.ErrInvalidArgument
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.destination(name)
+	return name, nil
+}
+
+// DeleteDestination removes the destination with its notifications, the running subscriptions find it empty
+func (b *MemoryBroker) DeleteDestination(destination string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.destinations, destination)
+	return nil
+}
+
+// CountNotifications returns the number of notifications of the destination, including the in-flight ones
+func (b *MemoryBroker) CountNotifications(destination string) (count int, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	d, ok := b.destinations[destination]
+	if !ok {
+		return 0, nil
+	}
+	return len(d.pending) + len(d.inFlight), nil
+}
+
+// GetDestination returns the identifier of the destination with the given name
+func (b *MemoryBroker) GetDestination(name string) (destination string, err error) {
+	return b.CreateDestination(name)
+}
+
+// Publish appends the notification to the destination, the id of the notification is the message id, a new one is
+// generated if it is empty, the same way as model.CreateNotification does for SQS messages
+func (b *MemoryBroker) Publish(ctx context.Context, destination string, notification model.Notification) (messageId string, err error) {
+	if len(destination) == 0 {
+		return "", commonmodel.ErrInvalidArgument
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if notification.Id == "" {
+		notification.Id = uuid.New().String()
+	}
+	d := b.destination(destination)
+	d.pending = append(d.pending, notification)
+	close(d.signal)
+	d.signal = make(chan struct{})
+	return notification.Id, nil
+}
+
+// Subscribe delivers the notifications of the destination to the given channel until ctx is cancelled
+func (b *MemoryBroker) Subscribe(ctx context.Context, destination string, c chan<- model.NotificationMeta) (subscription *Subscription, err error) {
+	if len(destination) == 0 {
+		return nil, commonmodel.ErrInvalidArgument
+	}
+	subscription = NewSubscription()
+	go func() {
+		defer subscription.Close(nil)
+		for {
+			delivery, signal, ok := b.receive(destination)
+			if !ok {
+				select {
+				case <-ctx.Done():
+					return
+				case <-signal:
+				case <-time.After(memoryPollInterval):
+				}
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				_ = b.Nack(context.Background(), delivery)
+				return
+			case c <- delivery:
+			}
+		}
+	}()
+	return subscription, nil
+}
+
+// Ack removes the delivered notification from the destination
+func (b *MemoryBroker) Ack(ctx context.Context, delivery model.NotificationMeta) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	d := b.destination(delivery.QueueUrl)
+	if _, ok := d.inFlight[delivery.ReceiptHandle]; !ok {
+		return commonmodel.ErrNotificationNotFound
+	}
+	delete(d.inFlight, delivery.ReceiptHandle)
+	return nil
+}
+
+// Nack makes the delivered notification available again
+func (b *MemoryBroker) Nack(ctx context.Context, delivery model.NotificationMeta) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	d := b.destination(delivery.QueueUrl)
+	inFlight, ok := d.inFlight[delivery.ReceiptHandle]
+	if !ok {
+		return commonmodel.ErrNotificationNotFound
+	}
+	delete(d.inFlight, delivery.ReceiptHandle)
+	d.pending = append([]model.Notification{inFlight.notification}, d.pending...)
+	close(d.signal)
+	d.signal = make(chan struct{})
+	return nil
+}
+
+// NackWithDelay makes the delivered notification available again after delay
+func (b *MemoryBroker) NackWithDelay(ctx context.Context, delivery model.NotificationMeta, delay time.Duration) error {
+	if delay <= 0 {
+		return b.Nack(ctx, delivery)
+	}
+	return b.Extend(ctx, delivery, delay)
+}
+
+// Extend postpones the expiration of the delivered notification
+func (b *MemoryBroker) Extend(ctx context.Context, delivery model.NotificationMeta, visibilityTimeout time.Duration) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	d := b.destination(delivery.QueueUrl)
+	inFlight, ok := d.inFlight[delivery.ReceiptHandle]
+	if !ok {
+		return commonmodel.ErrNotificationNotFound
+	}
+	inFlight.expiresAt = time.Now().Add(visibilityTimeout)
+	d.inFlight[delivery.ReceiptHandle] = inFlight
+	return nil
+}
+
+// receive takes the next available notification of the destination, if there is none it returns the channel which is
+// closed when a new notification is published
+func (b *MemoryBroker) receive(destination string) (delivery model.NotificationMeta, signal <-chan struct{}, ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	d := b.destination(destination)
+	now := time.Now()
+	for handle, inFlight := range d.inFlight {
+		if now.After(inFlight.expiresAt) {
+			delete(d.inFlight, handle)
+			d.pending = append(d.pending, inFlight.notification)
+		}
+	}
+	if len(d.pending) == 0 {
+		return delivery, d.signal, false
+	}
+	notification := d.pending[0]
+	d.pending = d.pending[1:]
+	handle := uuid.New().String()
+	d.inFlight[handle] = memoryInFlight{notification: notification, expiresAt: now.Add(b.visibilityTimeout)}
+	return model.CreateNotificationMeta(notification, handle, destination), nil, true
+}
+
+// destination returns the destination with the given name and creates it if it does not exist, the caller must hold the mutex
+func (b *MemoryBroker) destination(name string) *memoryDestination {
+	d, ok := b.destinations[name]
+	if !ok {
+		d = &memoryDestination{
+			inFlight: make(map[string]memoryInFlight),
+			signal:   make(chan struct{}),
+		}
+		b.destinations[name] = d
+	}
+	return d
+}
@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"context"
+	"go.uber.org/zap"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"testing"
+	"time"
+)
+
+// subscribe starts a subscription of the destination and returns the channel of the deliveries
+func subscribe(t *testing.T, b *MemoryBroker, destination string) <-chan model.NotificationMeta {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c := make(chan model.NotificationMeta)
+	if _, err := b.Subscribe(ctx, destination, c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return c
+}
+
+func publish(t *testing.T, b *MemoryBroker, destination string, body string) string {
+	id, err := b.Publish(context.Background(), destination, model.Notification{Addressee: "u1", Subject: "subject", Body: body})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return id
+}
+
+func receive(t *testing.T, c <-chan model.NotificationMeta, timeout time.Duration) model.NotificationMeta {
+	select {
+	case delivery := <-c:
+		return delivery
+	case <-time.After(timeout):
+		t.Fatalf("no delivery within %v", timeout)
+		return model.NotificationMeta{}
+	}
+}
+
+func expectNothing(t *testing.T, c <-chan model.NotificationMeta, duration time.Duration) {
+	select {
+	case delivery := <-c:
+		t.Fatalf("unexpected delivery: %v", delivery.Notification.Id)
+	case <-time.After(duration):
+	}
+}
+
+func TestMemoryBrokerDeliversInOrder(t *testing.T) {
+	b := NewMemoryBroker(time.Minute)
+	first := publish(t, b, "queue", "first")
+	second := publish(t, b, "queue", "second")
+	c := subscribe(t, b, "queue")
+	for _, id := range []string{first, second} {
+		delivery := receive(t, c, time.Second)
+		if delivery.Notification.Id != id {
+			t.Fatalf("unexpected notification: %v, expected %v", delivery.Notification.Id, id)
+		}
+		if delivery.QueueUrl != "queue" || delivery.ReceiptHandle == "" {
+			t.Fatalf("unexpected delivery: %+v", delivery)
+		}
+	}
+}
+
+func TestMemoryBrokerAckRemovesNotification(t *testing.T) {
+	b := NewMemoryBroker(100 * time.Millisecond)
+	publish(t, b, "queue", "body")
+	c := subscribe(t, b, "queue")
+	delivery := receive(t, c, time.Second)
+	if err := b.Ack(context.Background(), delivery); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Ack(context.Background(), delivery); err != commonmodel.ErrNotificationNotFound {
+		t.Fatalf("unexpected error of the second ack: %v", err)
+	}
+	expectNothing(t, c, memoryPollInterval+200*time.Millisecond)
+}
+
+func TestMemoryBrokerNackRedelivers(t *testing.T) {
+	b := NewMemoryBroker(time.Minute)
+	id := publish(t, b, "queue", "body")
+	c := subscribe(t, b, "queue")
+	delivery := receive(t, c, time.Second)
+	if err := b.Nack(context.Background(), delivery); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	redelivery := receive(t, c, time.Second)
+	if redelivery.Notification.Id != id {
+		t.Fatalf("unexpected notification: %v, expected %v", redelivery.Notification.Id, id)
+	}
+	if redelivery.ReceiptHandle == delivery.ReceiptHandle {
+		t.Fatalf("the redelivery must have a new receipt handle")
+	}
+	if err := b.Nack(context.Background(), delivery); err != commonmodel.ErrNotificationNotFound {
+		t.Fatalf("unexpected error of the stale nack: %v", err)
+	}
+}
+
+func TestMemoryBrokerRedeliversAfterVisibilityTimeout(t *testing.T) {
+	b := NewMemoryBroker(100 * time.Millisecond)
+	id := publish(t, b, "queue", "body")
+	c := subscribe(t, b, "queue")
+	delivery := receive(t, c, time.Second)
+	redelivery := receive(t, c, memoryPollInterval+time.Second)
+	if redelivery.Notification.Id != id {
+		t.Fatalf("unexpected notification: %v, expected %v", redelivery.Notification.Id, id)
+	}
+	if err := b.Ack(context.Background(), delivery); err != commonmodel.ErrNotificationNotFound {
+		t.Fatalf("the expired delivery must not be acknowledged: %v", err)
+	}
+}
+
+func TestMemoryBrokerExtendPreventsRedelivery(t *testing.T) {
+	b := NewMemoryBroker(100 * time.Millisecond)
+	publish(t, b, "queue", "body")
+	c := subscribe(t, b, "queue")
+	delivery := receive(t, c, time.Second)
+	if err := b.Extend(context.Background(), delivery, time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectNothing(t, c, memoryPollInterval+200*time.Millisecond)
+	if err := b.Ack(context.Background(), delivery); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMemoryBrokerUnknownDelivery(t *testing.T) {
+	b := NewMemoryBroker(time.Minute)
+	delivery := model.CreateNotificationMeta(model.Notification{Id: "id"}, "unknown", "queue")
+	if err := b.Ack(context.Background(), delivery); err != commonmodel.ErrNotificationNotFound {
+		t.Fatalf("unexpected error of ack: %v", err)
+	}
+	if err := b.Nack(context.Background(), delivery); err != commonmodel.ErrNotificationNotFound {
+		t.Fatalf("unexpected error of nack: %v", err)
+	}
+	if err := b.Extend(context.Background(), delivery, time.Minute); err != commonmodel.ErrNotificationNotFound {
+		t.Fatalf("unexpected error of extend: %v", err)
+	}
+}
+
+func TestLeaseKeepsDeliveryHidden(t *testing.T) {
+	b := NewMemoryBroker(200 * time.Millisecond)
+	publish(t, b, "queue", "body")
+	c := subscribe(t, b, "queue")
+	delivery := receive(t, c, time.Second)
+	lease := NewLeaser(b, 200*time.Millisecond, zap.NewNop()).Acquire(context.Background(), delivery)
+	expectNothing(t, c, memoryPollInterval+200*time.Millisecond)
+	if err := lease.Ack(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLeaseReleaseAfterDelaysRedelivery(t *testing.T) {
+	b := NewMemoryBroker(time.Minute)
+	id := publish(t, b, "queue", "body")
+	c := subscribe(t, b, "queue")
+	delivery := receive(t, c, time.Second)
+	lease := NewLeaser(b, time.Minute, zap.NewNop()).Acquire(context.Background(), delivery)
+	if err := lease.ReleaseAfter(context.Background(), 500*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectNothing(t, c, 300*time.Millisecond)
+	if redelivery := receive(t, c, memoryPollInterval+time.Second); redelivery.Notification.Id != id {
+		t.Fatalf("unexpected notification: %v, expected %v", redelivery.Notification.Id, id)
+	}
+}
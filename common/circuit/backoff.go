@@ -0,0 +1,35 @@
+package circuit
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff calculates exponentially growing delays with full jitter between retries, it is not thread-safe
+type Backoff struct {
+	Base    time.Duration
+	Max     time.Duration
+	attempt int
+}
+
+// NewBackoff is a factory function that creates a new Backoff instance
+func NewBackoff(base, max time.Duration) *Backoff {
+	return &Backoff{Base: base, Max: max}
+}
+
+// Next returns a random delay between 0 and the exponentially growing upper bound (capped at Max)
+func (b *Backoff) Next() time.Duration {
+	upper := b.Max
+	if b.attempt < 32 {
+		if exponential := b.Base << b.attempt; exponential > 0 && exponential < b.Max {
+			upper = exponential
+		}
+	}
+	b.attempt++
+	return time.Duration(rand.Int63n(int64(upper) + 1))
+}
+
+// Reset starts the delays from Base again, it should be called after a successful attempt
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
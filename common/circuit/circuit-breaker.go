@@ -0,0 +1,130 @@
+package circuit
+
+import (
+	"sync"
+	"time"
+)
+
+// State is an enum to represent the state of a Breaker
+// Closed is the normal state, requests are allowed
+// Open is the state after too many consecutive failures, requests are rejected until the open duration elapses
+// HalfOpen is the state after the open duration, a single probe request is allowed at a time, its result decides the next state
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// probeRetryInterval is the longest time a caller rejected because of an in-flight probe is asked to wait
+const probeRetryInterval = time.Second
+
+// Breaker is a thread-safe circuit breaker, which opens after failureThreshold consecutive failures and stays open for
+// openDuration, to avoid flooding a failing dependency with requests
+type Breaker struct {
+	mutex            sync.Mutex
+	failureThreshold int
+	openDuration     time.Duration
+	state            State
+	failures         int
+	probing          bool
+	openedAt         time.Time
+	onStateChange    func(from, to State)
+}
+
+// NewBreaker is a factory function that creates a new Breaker instance, onStateChange is optional
+func NewBreaker(failureThreshold int, openDuration time.Duration, onStateChange func(from, to State)) *Breaker {
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	return &Breaker{
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+		onStateChange:    onStateChange,
+	}
+}
+
+// Allow reports whether a request may be performed, if not, wait is the time after which the caller should ask again
+// In half-open state only one probe request is allowed, until its result is recorded by Success, Failure or Cancel
+func (b *Breaker) Allow() (allowed bool, wait time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case Closed:
+		return true, 0
+	case Open:
+		if elapsed := time.Since(b.openedAt); elapsed < b.openDuration {
+			return false, b.openDuration - elapsed
+		}
+		b.setState(HalfOpen)
+	}
+	if b.probing {
+		return false, min(b.openDuration, probeRetryInterval)
+	}
+	b.probing = true
+	return true, 0
+}
+
+// Success records a successful request, which closes the breaker
+func (b *Breaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+	b.probing = false
+	b.setState(Closed)
+}
+
+// Failure records a failed request, the breaker opens if it is half-open or the failure threshold is reached
+func (b *Breaker) Failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == HalfOpen || (b.state == Closed && b.failures >= b.failureThreshold) {
+		b.openedAt = time.Now()
+		b.setState(Open)
+	}
+}
+
+// Cancel records that an allowed request has been abandoned without a result (e.g. it was cancelled by its caller), in
+// half-open state it lets the next caller probe
+func (b *Breaker) Cancel() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
+
+// State returns the current state of the breaker
+func (b *Breaker) State() State {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == Open && time.Since(b.openedAt) >= b.openDuration {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// setState changes the state and notifies the listener, the caller must hold the mutex
+func (b *Breaker) setState(state State) {
+	if b.state == state {
+		return
+	}
+	from := b.state
+	b.state = state
+	if b.onStateChange != nil {
+		b.onStateChange(from, state)
+	}
+}
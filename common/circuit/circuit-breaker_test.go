@@ -0,0 +1,103 @@
+package circuit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAfterFailureThreshold(t *testing.T) {
+	var transitions []State
+	breaker := NewBreaker(2, time.Minute, func(from, to State) { transitions = append(transitions, to) })
+	breaker.Failure()
+	if allowed, _ := breaker.Allow(); !allowed || breaker.State() != Closed {
+		t.Fatalf("the breaker must stay closed below the threshold")
+	}
+	breaker.Failure()
+	allowed, wait := breaker.Allow()
+	if allowed || breaker.State() != Open {
+		t.Fatalf("the breaker must open at the threshold")
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Fatalf("unexpected wait: %v", wait)
+	}
+	if len(transitions) != 1 || transitions[0] != Open {
+		t.Fatalf("unexpected transitions: %v", transitions)
+	}
+}
+
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	breaker := NewBreaker(2, time.Minute, nil)
+	breaker.Failure()
+	breaker.Success()
+	breaker.Failure()
+	if breaker.State() != Closed {
+		t.Fatalf("the failures must be consecutive to open the breaker")
+	}
+}
+
+func TestBreakerHalfOpens(t *testing.T) {
+	breaker := NewBreaker(1, 50*time.Millisecond, nil)
+	breaker.Failure()
+	time.Sleep(100 * time.Millisecond)
+	if breaker.State() != HalfOpen {
+		t.Fatalf("unexpected state: %v", breaker.State())
+	}
+	if allowed, _ := breaker.Allow(); !allowed {
+		t.Fatalf("the probe must be allowed")
+	}
+	breaker.Failure()
+	if breaker.State() != Open {
+		t.Fatalf("a failed probe must open the breaker again")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if allowed, _ := breaker.Allow(); !allowed {
+		t.Fatalf("the probe must be allowed")
+	}
+	breaker.Success()
+	if breaker.State() != Closed {
+		t.Fatalf("a successful probe must close the breaker")
+	}
+}
+
+func TestBreakerAllowsSingleProbe(t *testing.T) {
+	breaker := NewBreaker(1, 50*time.Millisecond, nil)
+	breaker.Failure()
+	time.Sleep(100 * time.Millisecond)
+	if allowed, _ := breaker.Allow(); !allowed {
+		t.Fatalf("the probe must be allowed")
+	}
+	allowed, wait := breaker.Allow()
+	if allowed {
+		t.Fatalf("only one probe may be in flight")
+	}
+	if wait <= 0 {
+		t.Fatalf("the rejected caller must wait: %v", wait)
+	}
+	//An abandoned probe lets the next caller probe
+	breaker.Cancel()
+	if allowed, _ := breaker.Allow(); !allowed {
+		t.Fatalf("the next probe must be allowed after the cancellation")
+	}
+	if allowed, _ := breaker.Allow(); allowed {
+		t.Fatalf("only one probe may be in flight")
+	}
+	breaker.Success()
+	for i := 0; i < 3; i++ {
+		if allowed, _ := breaker.Allow(); !allowed {
+			t.Fatalf("the closed breaker must allow every request")
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	backoff := NewBackoff(10*time.Millisecond, 50*time.Millisecond)
+	for i, upper := range []time.Duration{10, 20, 40, 50, 50} {
+		if delay := backoff.Next(); delay < 0 || delay > upper*time.Millisecond {
+			t.Fatalf("delay %d out of bounds: %v", i, delay)
+		}
+	}
+	backoff.Reset()
+	if delay := backoff.Next(); delay > 10*time.Millisecond {
+		t.Fatalf("the delay must start from the base after reset: %v", delay)
+	}
+}
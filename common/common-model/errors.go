@@ -8,13 +8,26 @@ import (
 var _, _ = zap.NewDevelopment()
 
 var ErrDbUnexpected = errors.New("ERROR_DB_UNEXPECTED_ERROR")
+var ErrInstanceNotRegistered = errors.New("ERROR_INSTANCE_NOT_REGISTERED")
+var ErrInstanceFailed = errors.New("ERROR_INSTANCE_FAILED")
 var ErrInvalidBody = errors.New("INVALID_REQUEST_BODY")
 var ErrInvalidToken = errors.New("INVALID_TOKEN")
+var ErrInvalidApiKey = errors.New("ERROR_INVALID_API_KEY")
 
 var ErrInvalidArgument = errors.New("ERROR_INVALID_ARGUMENT")
 var ErrContentTooLong = errors.New("ERROR_CONTENT_TOO_LONG")
 var ErrSqsUnexpected = errors.New("ERROR_SQS_UNEXPECTED_ERROR")
 var ErrSqsInvalidMessage = errors.New("ERROR_SQS_INVALID_MESSAGE")
+var ErrSqsQueueDoesNotExist = errors.New("ERROR_SQS_QUEUE_DOES_NOT_EXIST")
 var ErrSqsInternalServerError = errors.New("ERROR_INTERNAL_SERVER_ERROR")
+var ErrStorageUnexpected = errors.New("ERROR_STORAGE_UNEXPECTED_ERROR")
+var ErrPayloadUnavailable = errors.New("ERROR_PAYLOAD_UNAVAILABLE")
+var ErrFallbackUnexpected = errors.New("ERROR_FALLBACK_UNEXPECTED_ERROR")
+var ErrRouteUnavailable = errors.New("ERROR_ROUTE_UNAVAILABLE")
+var ErrRedisUnexpected = errors.New("ERROR_REDIS_UNEXPECTED_ERROR")
+var ErrKafkaUnexpected = errors.New("ERROR_KAFKA_UNEXPECTED_ERROR")
+var ErrNatsUnexpected = errors.New("ERROR_NATS_UNEXPECTED_ERROR")
 
 var ErrLongPollingCouldNotDeliver = errors.New("ERROR_LONG_POLLING_COULD_NOT_DELIVER")
+var ErrNotificationNotFound = errors.New("ERROR_NOTIFICATION_NOT_FOUND")
+var ErrAddresseeNotConnected = errors.New("ERROR_ADDRESSEE_NOT_CONNECTED")
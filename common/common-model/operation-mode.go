@@ -3,9 +3,14 @@ package common_model
 // OperationMode is an emum to represent the operation mode of the service
 // ServiceInstanceQueue is the mode when each service instance has a dedicated SQS queue
 // UserQueue is the mode when each user has a dedicated SQS queue
+// PartitionedTopic is the mode when every instance consumes a Kafka topic partitioned by the addressee and delivers the
+// notifications of the users connected to it
+// UserSubject is the mode when each user has a dedicated NATS subject, consumed through a JetStream durable consumer
 type OperationMode int
 
 const (
 	ServiceInstanceQueue OperationMode = iota
 	UserQueue
+	PartitionedTopic
+	UserSubject
 )
@@ -0,0 +1,11 @@
+package common_model
+
+// ServiceRole is an enum to represent what the binary runs as
+// ApiRole serves the clients and delivers the notifications in real-time
+// DlqWorkerRole consumes the dead-letter-queue and delivers the undeliverable notifications through fallback channels
+type ServiceRole string
+
+const (
+	ApiRole       ServiceRole = "api"
+	DlqWorkerRole ServiceRole = "dlq-worker"
+)
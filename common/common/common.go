@@ -5,11 +5,16 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"net/url"
 	commonmodel "notification-service/common/common-model"
 	"os"
 	"regexp"
 )
 
+// Version is the version of the service, it is set at build time:
+// go build -ldflags "-X notification-service/common/common.Version=1.0.0"
+var Version = "dev"
+
 func GetEnvWithDefault(key string, defaultValue string) string {
 	value, exists := os.LookupEnv(key)
 	if !exists {
@@ -53,6 +58,25 @@ func RestrictRequestJson(body string, jsonType JsonType) string {
 	return body
 }
 
+// RestrictRequestUrl returns the URL of the request as a string, while replaces sensitive query parameters with "RESTRICTED"
+func RestrictRequestUrl(requestUrl *url.URL) string {
+	sensitiveQueryKeys := []string{"access_token", "token"}
+	query := requestUrl.Query()
+	restricted := false
+	for _, key := range sensitiveQueryKeys {
+		if query.Has(key) {
+			query.Set(key, "RESTRICTED")
+			restricted = true
+		}
+	}
+	if !restricted {
+		return requestUrl.String()
+	}
+	urlCopy := *requestUrl
+	urlCopy.RawQuery = query.Encode()
+	return urlCopy.String()
+}
+
 // GetGinHeaderAsString returns the request headers as a JSON string
 func GetGinHeaderAsString(req *http.Request) string {
 	// Get the headers from the request
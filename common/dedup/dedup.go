@@ -0,0 +1,12 @@
+package dedup
+
+import "context"
+
+// Cache remembers the ids of the recently delivered notifications, so the redeliveries of the message broker can be dropped
+// An id is remembered only after the notification has been delivered, thus a failed delivery can still be retried
+type Cache interface {
+	// Contains reports whether the notification with the given id has already been delivered
+	Contains(ctx context.Context, id string) (bool, error)
+	// Add remembers the id of a delivered notification
+	Add(ctx context.Context, id string) error
+}
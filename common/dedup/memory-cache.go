@@ -0,0 +1,67 @@
+package dedup
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryCache is an in-process Cache, which remembers at most size ids for ttl, the least recently added id is evicted first
+type MemoryCache struct {
+	mutex   sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	id        string
+	expiresAt time.Time
+}
+
+// NewMemoryCache is a factory function that creates a new MemoryCache instance
+func NewMemoryCache(size int, ttl time.Duration) *MemoryCache {
+	return &MemoryCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Contains reports whether the id has been added within ttl
+func (m *MemoryCache) Contains(ctx context.Context, id string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	element, ok := m.entries[id]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(element.Value.(memoryEntry).expiresAt) {
+		m.order.Remove(element)
+		delete(m.entries, id)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Add remembers the id for ttl, if the cache is full the oldest id is evicted
+func (m *MemoryCache) Add(ctx context.Context, id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry := memoryEntry{id: id, expiresAt: time.Now().Add(m.ttl)}
+	if element, ok := m.entries[id]; ok {
+		element.Value = entry
+		m.order.MoveToBack(element)
+		return nil
+	}
+	m.entries[id] = m.order.PushBack(entry)
+	for m.order.Len() > m.size {
+		oldest := m.order.Front()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(memoryEntry).id)
+	}
+	return nil
+}
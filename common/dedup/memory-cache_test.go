@@ -0,0 +1,49 @@
+package dedup
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheRemembersIds(t *testing.T) {
+	cache := NewMemoryCache(10, time.Minute)
+	ctx := context.Background()
+	if ok, _ := cache.Contains(ctx, "id"); ok {
+		t.Fatalf("unexpected id in an empty cache")
+	}
+	if err := cache.Add(ctx, "id"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok, _ := cache.Contains(ctx, "id"); !ok {
+		t.Fatalf("the added id is missing")
+	}
+}
+
+func TestMemoryCacheForgetsExpiredIds(t *testing.T) {
+	cache := NewMemoryCache(10, 50*time.Millisecond)
+	ctx := context.Background()
+	_ = cache.Add(ctx, "id")
+	time.Sleep(100 * time.Millisecond)
+	if ok, _ := cache.Contains(ctx, "id"); ok {
+		t.Fatalf("the expired id is still remembered")
+	}
+	if len(cache.entries) != 0 || cache.order.Len() != 0 {
+		t.Fatalf("the expired id has not been removed")
+	}
+}
+
+func TestMemoryCacheEvictsOldestId(t *testing.T) {
+	cache := NewMemoryCache(2, time.Minute)
+	ctx := context.Background()
+	_ = cache.Add(ctx, "a")
+	_ = cache.Add(ctx, "b")
+	//Adding an id again makes it the most recent one
+	_ = cache.Add(ctx, "a")
+	_ = cache.Add(ctx, "c")
+	for id, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		if ok, _ := cache.Contains(ctx, id); ok != expected {
+			t.Fatalf("unexpected presence of %v: %v", id, ok)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package dedup
+
+import (
+	"context"
+	goredis "github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	commonmodel "notification-service/common/common-model"
+	"time"
+)
+
+// RedisCache is a Cache backed by Redis, which makes the deduplication work across the instances of the service
+// Each id is stored as a separate key with ttl expiration, the keys are prefixed with keyPrefix
+type RedisCache struct {
+	client    *goredis.Client
+	keyPrefix string
+	ttl       time.Duration
+	log       *zap.Logger
+}
+
+// NewRedisCache is a factory function that creates a new RedisCache instance
+func NewRedisCache(client *goredis.Client, keyPrefix string, ttl time.Duration, logger *zap.Logger) *RedisCache {
+	return &RedisCache{
+		client:    client,
+		keyPrefix: keyPrefix,
+		ttl:       ttl,
+		log:       logger,
+	}
+}
+
+// Contains reports whether the key of the id exists
+func (r *RedisCache) Contains(ctx context.Context, id string) (bool, error) {
+	count, err := r.client.Exists(ctx, r.keyPrefix+id).Result()
+	if err != nil {
+		r.log.Error("Error while looking up notification id", zap.String("id", id), zap.Any("error", err))
+		return false, commonmodel.ErrRedisUnexpected
+	}
+	return count > 0, nil
+}
+
+// Add stores the key of the id with ttl expiration
+func (r *RedisCache) Add(ctx context.Context, id string) error {
+	err := r.client.Set(ctx, r.keyPrefix+id, 1, r.ttl).Err()
+	if err != nil {
+		r.log.Error("Error while storing notification id", zap.String("id", id), zap.Any("error", err))
+		return commonmodel.ErrRedisUnexpected
+	}
+	return nil
+}
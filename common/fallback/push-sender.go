@@ -0,0 +1,29 @@
+package fallback
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"notification-service/model"
+)
+
+// PushSender is a placeholder of a push notification provider (e.g. FCM, APNs), it only logs the notifications
+// It is meant to be replaced by a real integration, which looks up the device tokens of the addressee
+type PushSender struct {
+	log *zap.Logger
+}
+
+// NewPushSender is a factory function that creates a new PushSender instance
+func NewPushSender(logger *zap.Logger) *PushSender {
+	return &PushSender{log: logger}
+}
+
+// Name returns the name of the channel
+func (p *PushSender) Name() string {
+	return "push"
+}
+
+// Send logs the notifications as if they were pushed
+func (p *PushSender) Send(ctx context.Context, addressee string, notifications []model.Notification) error {
+	p.log.Info("Push notification sent (stub)", zap.String("addressee", addressee), zap.Int("quantity", len(notifications)))
+	return nil
+}
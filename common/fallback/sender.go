@@ -0,0 +1,15 @@
+package fallback
+
+import (
+	"context"
+	"notification-service/model"
+)
+
+// Sender delivers the notifications of a user through an alternative channel (e.g. e-mail, push notification), when they
+// could not be delivered in real-time
+type Sender interface {
+	// Name returns the name of the channel, it is used for logging
+	Name() string
+	// Send delivers the notifications of the addressee at once (as a digest if there is more than one)
+	Send(ctx context.Context, addressee string, notifications []model.Notification) error
+}
@@ -0,0 +1,166 @@
+package fallback
+
+import (
+	"context"
+	"crypto/tls"
+	"go.uber.org/zap"
+	"net"
+	"net/smtp"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smtpTimeout is the maximum duration of sending an e-mail, including the connection to the server
+const smtpTimeout = 30 * time.Second
+
+// AddresseePlaceholder is replaced by the id of the addressee in the recipient format of the SmtpSender
+const AddresseePlaceholder = "{addressee}"
+
+// SmtpSender sends the notifications of a user in a single plain text e-mail
+// The e-mail address of the user is derived from recipientFormat (e.g. "{addressee}@example.com"), or it can be resolved by
+// a custom function set by WithRecipientResolver
+type SmtpSender struct {
+	addr            string
+	auth            smtp.Auth
+	from            string
+	recipientFormat string
+	resolve         func(addressee string) (string, error)
+	log             *zap.Logger
+}
+
+// NewSmtpSender is a factory function that creates a new SmtpSender instance
+// addr is the host:port of the SMTP server, if user is empty no authentication is performed
+func NewSmtpSender(addr, user, password, from, recipientFormat string, logger *zap.Logger) *SmtpSender {
+	sender := &SmtpSender{
+		addr:            addr,
+		from:            from,
+		recipientFormat: recipientFormat,
+		log:             logger,
+	}
+	if user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		sender.auth = smtp.PlainAuth("", user, password, host)
+	}
+	sender.resolve = sender.formatRecipient
+	return sender
+}
+
+// WithRecipientResolver replaces the recipient format with the given function, e.g. to look up the address of the user
+func (s *SmtpSender) WithRecipientResolver(resolve func(addressee string) (string, error)) *SmtpSender {
+	s.resolve = resolve
+	return s
+}
+
+// Name returns the name of the channel
+func (s *SmtpSender) Name() string {
+	return "smtp"
+}
+
+// Send sends the e-mail, the SMTP session is aborted when ctx is cancelled or smtpTimeout elapses
+func (s *SmtpSender) Send(ctx context.Context, addressee string, notifications []model.Notification) error {
+	recipient, err := s.resolve(addressee)
+	if err != nil {
+		s.log.Error("Error while resolving e-mail address", zap.String("addressee", addressee), zap.Any("error", err))
+		return err
+	}
+	if err = s.sendMail(ctx, recipient, s.composeMessage(recipient, notifications)); err != nil {
+		s.log.Error("Error while sending e-mail", zap.String("addressee", addressee), zap.Any("error", err))
+		return commonmodel.ErrFallbackUnexpected
+	}
+	return nil
+}
+
+// sendMail does the same as smtp.SendMail, but over a connection whose deadline is bound to ctx and smtpTimeout
+func (s *SmtpSender) sendMail(ctx context.Context, recipient string, message []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	//Unblock the pending read or write right away if ctx is cancelled before the deadline
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	host, _, _ := net.SplitHostPort(s.addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if err := client.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(s.from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(recipient); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// formatRecipient derives the e-mail address of the addressee from the recipient format
+func (s *SmtpSender) formatRecipient(addressee string) (string, error) {
+	if s.recipientFormat == "" || strings.ContainsAny(addressee, "\r\n") {
+		return "", commonmodel.ErrInvalidArgument
+	}
+	return strings.ReplaceAll(s.recipientFormat, AddresseePlaceholder, addressee), nil
+}
+
+// composeMessage creates the e-mail, a single notification is sent with its own subject, more of them as a digest
+func (s *SmtpSender) composeMessage(recipient string, notifications []model.Notification) []byte {
+	subject := "You have " + strconv.Itoa(len(notifications)) + " new notifications"
+	if len(notifications) == 1 {
+		subject = notifications[0].Subject
+	}
+	var message strings.Builder
+	message.WriteString("From: " + s.from + "\r\n")
+	message.WriteString("To: " + recipient + "\r\n")
+	message.WriteString("Subject: " + sanitizeHeader(subject) + "\r\n")
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for i, notification := range notifications {
+		if i > 0 {
+			message.WriteString("\r\n\r\n")
+		}
+		if len(notifications) > 1 {
+			message.WriteString(notification.Subject + "\r\n")
+		}
+		message.WriteString(notification.Body)
+	}
+	message.WriteString("\r\n")
+	return []byte(message.String())
+}
+
+// sanitizeHeader removes the line breaks from a header value, which would allow injecting headers
+func sanitizeHeader(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
@@ -0,0 +1,56 @@
+package fallback
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"net"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"testing"
+	"time"
+)
+
+func TestSmtpSenderObservesContext(t *testing.T) {
+	//The server accepts the connection, but never sends its greeting
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	sender := NewSmtpSender(listener.Addr().String(), "", "", "from@example.com", "{addressee}@example.com", zap.NewNop())
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = sender.Send(ctx, "u1", []model.Notification{{Subject: "subject", Body: "body"}})
+	if err != commonmodel.ErrFallbackUnexpected {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the cancellation was not observed: %v", elapsed)
+	}
+}
+
+func TestFormatRecipient(t *testing.T) {
+	sender := NewSmtpSender("localhost:25", "", "", "from@example.com", "{addressee}@example.com", zap.NewNop())
+	if recipient, err := sender.formatRecipient("u1"); err != nil || recipient != "u1@example.com" {
+		t.Fatalf("unexpected recipient: %v, %v", recipient, err)
+	}
+	if _, err := sender.formatRecipient("u1\r\nBcc: other@example.com"); err != commonmodel.ErrInvalidArgument {
+		t.Fatalf("unexpected error of the injected addressee: %v", err)
+	}
+}
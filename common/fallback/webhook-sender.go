@@ -0,0 +1,73 @@
+package fallback
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"time"
+)
+
+// webhookTimeout is the maximum duration of a webhook call
+const webhookTimeout = 10 * time.Second
+
+// WebhookSender posts the notifications of a user as a JSON document to the given URL, any 2xx response is a success
+type WebhookSender struct {
+	url    string
+	token  string
+	client *http.Client
+	log    *zap.Logger
+}
+
+// webhookPayload is the JSON document sent to the webhook
+type webhookPayload struct {
+	Addressee     string               `json:"addressee"`
+	Notifications []model.Notification `json:"notifications"`
+}
+
+// NewWebhookSender is a factory function that creates a new WebhookSender instance
+// If token is not empty, it is sent as a bearer token in the Authorization header
+func NewWebhookSender(url, token string, logger *zap.Logger) *WebhookSender {
+	return &WebhookSender{
+		url:    url,
+		token:  token,
+		client: &http.Client{Timeout: webhookTimeout},
+		log:    logger,
+	}
+}
+
+// Name returns the name of the channel
+func (w *WebhookSender) Name() string {
+	return "webhook"
+}
+
+// Send posts the notifications to the webhook
+func (w *WebhookSender) Send(ctx context.Context, addressee string, notifications []model.Notification) error {
+	payload, err := json.Marshal(webhookPayload{Addressee: addressee, Notifications: notifications})
+	if err != nil {
+		return commonmodel.ErrInvalidArgument
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(payload))
+	if err != nil {
+		w.log.Error("Error while creating webhook request", zap.String("url", w.url), zap.Any("error", err))
+		return commonmodel.ErrFallbackUnexpected
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if w.token != "" {
+		request.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	response, err := w.client.Do(request)
+	if err != nil {
+		w.log.Error("Error while calling webhook", zap.String("url", w.url), zap.Any("error", err))
+		return commonmodel.ErrFallbackUnexpected
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		w.log.Error("Webhook responded with error", zap.String("url", w.url), zap.Int("status", response.StatusCode))
+		return commonmodel.ErrFallbackUnexpected
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package jwt
 
 import (
+	"crypto/subtle"
 	"errors"
 	"github.com/MicahParks/keyfunc/v2"
 	"github.com/gin-gonic/gin"
@@ -18,6 +19,10 @@ const ErrorInvalidJwt = "ERROR_INVALID_JWT"
 const ErrorInvalidSignature = "ERROR_INVALID_SIGNATURE"
 const ErrorTokenExpired = "ERROR_TOKEN_EXPIRED"
 const ErrorTokenProcessable = "ERROR_TOKEN_PROCESSABLE"
+const ErrorInvalidApiKey = "ERROR_INVALID_API_KEY"
+
+// ApiKeyHeader is the header the services authenticate with by their API key
+const ApiKeyHeader = "X-Api-Key"
 
 func init() {
 	zLog = *logging.Logger()
@@ -36,6 +41,7 @@ type Authorization struct {
 type AuthorizationInterface interface {
 	UpdateJwks()
 	JwtAuthorizationHandlerGin(c *gin.Context)
+	ApiKeyAuthorizationHandlerGin(c *gin.Context)
 	ParseJWTPayloadGin(c *gin.Context) (result jwt.MapClaims, err error)
 }
 
@@ -67,6 +73,35 @@ func (auth *Authorization) UpdateJwks() {
 	}
 }
 
+// AddApiKey registers the API key of a service and enables the API key authentication
+// The name identifies the service in the logs
+func (auth *Authorization) AddApiKey(name string, key string) {
+	auth.apiKeys[key] = name
+	auth.apiKeyAutEnabled = true
+}
+
+// ApiKeyAuthorizationHandlerGin API key validation for Gin Router, used by the service-to-service endpoints
+// Returns with error and terminates the connection if the key in the X-Api-Key header is not registered
+func (auth *Authorization) ApiKeyAuthorizationHandlerGin(c *gin.Context) {
+	key := c.GetHeader(ApiKeyHeader)
+	if auth.apiKeyAutEnabled && key != "" {
+		//Compare all the keys in constant time, so the response time does not reveal them
+		name := ""
+		for apiKey, apiKeyName := range auth.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(apiKey), []byte(key)) == 1 {
+				name = apiKeyName
+			}
+		}
+		if name != "" {
+			zLog.Debug("Service authenticated", zap.String("trace-id", c.GetHeader("trace-id")), zap.String("service", name))
+			c.Next()
+			return
+		}
+	}
+	zLog.Info(ErrorInvalidApiKey, zap.String("trace-id", c.GetHeader("trace-id")))
+	common.ErrorResponse(c, 401, ErrorInvalidApiKey, "Invalid API key", c.GetHeader("trace-id"))
+}
+
 // JwtAuthorizationHandlerGin JWT validation for Gin Router
 // Returns with error and terminates the connection if the JWT is invalid
 func (auth *Authorization) JwtAuthorizationHandlerGin(c *gin.Context) {
@@ -77,8 +112,7 @@ func (auth *Authorization) JwtAuthorizationHandlerGin(c *gin.Context) {
 		c.Abort()
 		return
 	}
-	tokenStr := c.GetHeader("Authorization")
-	tokenStr = strings.Replace(tokenStr, "Bearer ", "", -1)
+	tokenStr := getTokenGin(c)
 	jwtPulled := false
 	for {
 		token, err := jwt.Parse(tokenStr, auth.jwks.Keyfunc)
@@ -113,8 +147,7 @@ func (auth *Authorization) JwtAuthorizationHandlerGin(c *gin.Context) {
 
 // ParseJWTPayloadGin parses the JWT payload from the given Gin context and returns a jwt.MapClaims object
 func (auth *Authorization) ParseJWTPayloadGin(c *gin.Context) (result jwt.MapClaims, err error) {
-	tokenStr := c.GetHeader("Authorization")
-	tokenStr = strings.Replace(tokenStr, "Bearer ", "", -1)
+	tokenStr := getTokenGin(c)
 	token, err := jwt.Parse(tokenStr, auth.jwks.Keyfunc)
 	if token == nil || !token.Valid {
 		return result, errors.New(ErrorInvalidJwt)
@@ -123,3 +156,13 @@ func (auth *Authorization) ParseJWTPayloadGin(c *gin.Context) (result jwt.MapCla
 	err = nil
 	return
 }
+
+// getTokenGin returns the bearer token of the request
+// The token is expected in the Authorization header, however browsers cannot set custom headers when opening a WebSocket
+// connection, therefore the access_token query parameter is accepted if the header is not present
+func getTokenGin(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); header != "" {
+		return strings.Replace(header, "Bearer ", "", -1)
+	}
+	return c.Query("access_token")
+}
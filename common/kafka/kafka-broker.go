@@ -0,0 +1,225 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	kafkago "github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"notification-service/common/broker"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// commitInterval is the interval the acknowledged offsets are committed at, in batches
+const commitInterval = time.Second
+
+// messageReader is the part of kafkago.Reader the broker depends on
+type messageReader interface {
+	FetchMessage(ctx context.Context) (kafkago.Message, error)
+	CommitMessages(ctx context.Context, messages ...kafkago.Message) error
+	Close() error
+}
+
+// KafkaBroker is the broker.Broker implementation backed by Kafka, destinations are topics
+// Notifications are keyed by their addressee, thus the notifications of a user are always written to the same partition
+// and keep their order. Every instance consumes all partitions of the topic through its own consumer group and delivers
+// the notifications of the users connected to it. The offsets of the acknowledged notifications are committed asynchronously,
+// in a batch every commitInterval
+type KafkaBroker struct {
+	brokers   []string
+	group     string
+	writer    *kafkago.Writer
+	newReader func(topic string) messageReader
+	log       *zap.Logger
+	mutex     sync.Mutex
+	readers   map[string]messageReader
+	pending   map[string]kafkago.Message
+}
+
+// NewKafkaBroker is a factory function that creates a new KafkaBroker instance
+// group is the consumer group of this instance, it must be unique for each instance, since every instance has to receive
+// every notification. The group is kept by Kafka after the instance stops, until its offsets expire (offsets.retention.minutes),
+// thus the group should be derived from an id which is stable across the restarts of the instance
+func NewKafkaBroker(brokers []string, group string, logger *zap.Logger) *KafkaBroker {
+	b := &KafkaBroker{
+		brokers: brokers,
+		group:   group,
+		writer: &kafkago.Writer{
+			Addr:         kafkago.TCP(brokers...),
+			Balancer:     &kafkago.Hash{},
+			RequiredAcks: kafkago.RequireAll,
+		},
+		log:     logger,
+		readers: make(map[string]messageReader),
+		pending: make(map[string]kafkago.Message),
+	}
+	b.newReader = func(topic string) messageReader {
+		return kafkago.NewReader(kafkago.ReaderConfig{
+			Brokers:        b.brokers,
+			GroupID:        b.group,
+			Topic:          topic,
+			StartOffset:    kafkago.LastOffset,
+			CommitInterval: commitInterval,
+			//The failed asynchronous commits are only reported through the logger of the reader
+			ErrorLogger: kafkago.LoggerFunc(func(msg string, args ...interface{}) {
+				b.log.Error("Kafka reader error", zap.String("topic", topic), zap.String("error", fmt.Sprintf(msg, args...)))
+			}),
+		})
+	}
+	return b
+}
+
+// CreateDestination returns the name of the topic, topics are expected to be provisioned with the desired number of partitions
+func (b *KafkaBroker) CreateDestination(name string) (destination string, err error) {
+	return b.GetDestination(name)
+}
+
+// GetDestination returns the name of the topic
+func (b *KafkaBroker) GetDestination(name string) (destination string, err error) {
+	if len(name) == 0 {
+		return "", commonmodel.ErrInvalidArgument
+	}
+	return name, nil
+}
+
+// Publish writes the notification to the topic keyed by its addressee and returns the id of the notification
+func (b *KafkaBroker) Publish(ctx context.Context, destination string, notification model.Notification) (messageId string, err error) {
+	if len(destination) == 0 || len(notification.Addressee) == 0 {
+		return "", commonmodel.ErrInvalidArgument
+	}
+	messageId = notification.Id
+	if messageId == "" {
+		messageId = uuid.New().String()
+	}
+	err = b.writer.WriteMessages(ctx, kafkago.Message{
+		Topic: destination,
+		Key:   []byte(notification.Addressee),
+		Value: []byte(notification.Body),
+		Headers: []kafkago.Header{
+			{Key: "id", Value: []byte(messageId)},
+			{Key: "subject", Value: []byte(notification.Subject)},
+		},
+	})
+	if err != nil {
+		b.log.Error("Error while writing message", zap.String("topic", destination), zap.Any("error", err))
+		return "", commonmodel.ErrKafkaUnexpected
+	}
+	return messageId, nil
+}
+
+// Subscribe consumes the topic through the consumer group of the instance until ctx is cancelled
+// Only the messages written after the consumer group was created are consumed, since the notifications written before
+// were addressed to the users connected at that time, a group which already exists continues from its committed offsets
+func (b *KafkaBroker) Subscribe(ctx context.Context, destination string, c chan<- model.NotificationMeta) (subscription *broker.Subscription, err error) {
+	if len(destination) == 0 {
+		return nil, commonmodel.ErrInvalidArgument
+	}
+	reader := b.newReader(destination)
+	b.mutex.Lock()
+	b.readers[destination] = reader
+	b.mutex.Unlock()
+
+	subscription = broker.NewSubscription()
+	go func() {
+		defer subscription.Close(nil)
+		defer func() {
+			b.mutex.Lock()
+			delete(b.readers, destination)
+			b.mutex.Unlock()
+			_ = reader.Close()
+		}()
+		b.log.Debug("Started receiving messages", zap.String("topic", destination), zap.String("group", b.group))
+		for {
+			message, err := reader.FetchMessage(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					b.log.Debug("Stopped receiving messages", zap.String("topic", destination))
+					return
+				}
+				b.log.Error("Error while fetching message", zap.String("topic", destination), zap.Any("error", err))
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+			handle := receiptHandle(message)
+			notification, err := notificationFromMessage(message)
+			if err != nil {
+				b.log.Error("Invalid notification received... Committing", zap.String("topic", destination), zap.String("handle", handle))
+				_ = reader.CommitMessages(ctx, message)
+				continue
+			}
+			b.mutex.Lock()
+			b.pending[handle] = message
+			b.mutex.Unlock()
+			select {
+			case c <- model.CreateNotificationMeta(notification, handle, destination):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return subscription, nil
+}
+
+// Ack commits the offset of the message, the commit is sent with the next batch, thus a nil error only means it is scheduled
+// The pending offsets are committed when the subscription stops as well
+// Since an offset commit covers the preceding messages of the partition too, notifications must be acknowledged in the order they were received
+func (b *KafkaBroker) Ack(ctx context.Context, delivery model.NotificationMeta) error {
+	b.mutex.Lock()
+	message, ok := b.pending[delivery.ReceiptHandle]
+	delete(b.pending, delivery.ReceiptHandle)
+	reader := b.readers[delivery.QueueUrl]
+	b.mutex.Unlock()
+	if !ok || reader == nil {
+		return commonmodel.ErrNotificationNotFound
+	}
+	if err := reader.CommitMessages(ctx, message); err != nil {
+		b.log.Error("Error while committing offset", zap.String("topic", delivery.QueueUrl), zap.String("handle", delivery.ReceiptHandle), zap.Any("error", err))
+		return commonmodel.ErrKafkaUnexpected
+	}
+	return nil
+}
+
+// Nack forgets the message without committing its offset, Kafka cannot redeliver a single message, thus it will only be
+// consumed again if the instance restarts before a later offset of the partition is committed
+func (b *KafkaBroker) Nack(ctx context.Context, delivery model.NotificationMeta) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.pending, delivery.ReceiptHandle)
+	return nil
+}
+
+// receiptHandle identifies the message within the topic
+func receiptHandle(message kafkago.Message) string {
+	return strconv.Itoa(message.Partition) + ":" + strconv.FormatInt(message.Offset, 10)
+}
+
+// notificationFromMessage creates a notification from the message, the key of the message is the addressee, the body is
+// the value, while the id and the subject are headers
+func notificationFromMessage(message kafkago.Message) (model.Notification, error) {
+	notification := model.Notification{
+		Addressee: string(message.Key),
+		Body:      string(message.Value),
+	}
+	for _, header := range message.Headers {
+		switch header.Key {
+		case "id":
+			notification.Id = string(header.Value)
+		case "subject":
+			notification.Subject = string(header.Value)
+		}
+	}
+	if len(notification.Addressee) == 0 || len(notification.Subject) == 0 || len(notification.Body) == 0 {
+		return model.Notification{}, commonmodel.ErrSqsInvalidMessage
+	}
+	if notification.Id == "" {
+		notification.Id = message.Topic + ":" + receiptHandle(message)
+	}
+	return notification, nil
+}
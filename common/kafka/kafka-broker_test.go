@@ -0,0 +1,162 @@
+package kafka
+
+import (
+	"context"
+	kafkago "github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeReader serves the messages of its channel and records the committed ones
+type fakeReader struct {
+	messages  chan kafkago.Message
+	mutex     sync.Mutex
+	committed []kafkago.Message
+	closed    chan struct{}
+}
+
+func newFakeReader() *fakeReader {
+	return &fakeReader{messages: make(chan kafkago.Message, 10), closed: make(chan struct{})}
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafkago.Message, error) {
+	select {
+	case message := <-r.messages:
+		return message, nil
+	case <-ctx.Done():
+		return kafkago.Message{}, ctx.Err()
+	}
+}
+
+func (r *fakeReader) CommitMessages(_ context.Context, messages ...kafkago.Message) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.committed = append(r.committed, messages...)
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func (r *fakeReader) Committed() []kafkago.Message {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]kafkago.Message(nil), r.committed...)
+}
+
+func newTestBroker(reader *fakeReader) *KafkaBroker {
+	b := NewKafkaBroker([]string{"localhost:9092"}, "test", zap.NewNop())
+	b.newReader = func(string) messageReader { return reader }
+	return b
+}
+
+func message(partition int, offset int64, addressee, id string) kafkago.Message {
+	return kafkago.Message{
+		Topic:     "notifications",
+		Partition: partition,
+		Offset:    offset,
+		Key:       []byte(addressee),
+		Value:     []byte("body"),
+		Headers: []kafkago.Header{
+			{Key: "id", Value: []byte(id)},
+			{Key: "subject", Value: []byte("subject")},
+		},
+	}
+}
+
+func TestNotificationFromMessage(t *testing.T) {
+	notification, err := notificationFromMessage(message(2, 7, "u1", "n1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := model.Notification{Id: "n1", Addressee: "u1", Subject: "subject", Body: "body"}
+	if notification != expected {
+		t.Fatalf("unexpected notification: %+v, expected %+v", notification, expected)
+	}
+	//The position of the message identifies the notification if it has no id
+	notification, err = notificationFromMessage(message(2, 7, "u1", ""))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if notification.Id != "notifications:2:7" {
+		t.Fatalf("unexpected id: %s", notification.Id)
+	}
+	if _, err := notificationFromMessage(message(2, 7, "", "n1")); err != commonmodel.ErrSqsInvalidMessage {
+		t.Fatalf("unexpected error of a message without addressee: %v", err)
+	}
+}
+
+func TestPublishValidatesArguments(t *testing.T) {
+	b := newTestBroker(newFakeReader())
+	if _, err := b.Publish(context.Background(), "", model.Notification{Addressee: "u1"}); err != commonmodel.ErrInvalidArgument {
+		t.Fatalf("unexpected error without topic: %v", err)
+	}
+	if _, err := b.Publish(context.Background(), "notifications", model.Notification{}); err != commonmodel.ErrInvalidArgument {
+		t.Fatalf("unexpected error without addressee: %v", err)
+	}
+}
+
+func TestSubscribeDispatchesAndCommitsOnAck(t *testing.T) {
+	reader := newFakeReader()
+	b := newTestBroker(reader)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan model.NotificationMeta)
+	subscription, err := b.Subscribe(ctx, "notifications", c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	invalid := message(0, 1, "", "n0")
+	reader.messages <- invalid
+	reader.messages <- message(0, 2, "u1", "n1")
+	var delivery model.NotificationMeta
+	select {
+	case delivery = <-c:
+	case <-time.After(time.Second):
+		t.Fatalf("no delivery")
+	}
+	if delivery.Notification.Id != "n1" || delivery.ReceiptHandle != "0:2" || delivery.QueueUrl != "notifications" {
+		t.Fatalf("unexpected delivery: %+v", delivery)
+	}
+	//The invalid message is committed without being dispatched
+	if committed := reader.Committed(); len(committed) != 1 || committed[0].Offset != invalid.Offset {
+		t.Fatalf("unexpected commits: %+v", committed)
+	}
+	if err := b.Ack(ctx, delivery); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if committed := reader.Committed(); len(committed) != 2 || committed[1].Offset != 2 {
+		t.Fatalf("unexpected commits: %+v", committed)
+	}
+	if err := b.Ack(ctx, delivery); err != commonmodel.ErrNotificationNotFound {
+		t.Fatalf("unexpected error of the repeated ack: %v", err)
+	}
+
+	//A released notification is not committed
+	reader.messages <- message(1, 3, "u2", "n2")
+	delivery = <-c
+	if err := b.Nack(ctx, delivery); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Ack(ctx, delivery); err != commonmodel.ErrNotificationNotFound {
+		t.Fatalf("unexpected error of the ack after release: %v", err)
+	}
+
+	cancel()
+	select {
+	case <-subscription.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("the subscription has not stopped")
+	}
+	select {
+	case <-reader.closed:
+	default:
+		t.Fatalf("the reader has not been closed")
+	}
+}
@@ -0,0 +1,256 @@
+package nats
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/google/uuid"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.uber.org/zap"
+	"notification-service/common/broker"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NatsBroker is the broker.Broker implementation backed by NATS JetStream, destinations are subjects
+// All subjects are captured by a single work-queue stream, and every subject is consumed through a durable consumer, thus
+// the notifications published while the addressee is offline are kept in the stream and delivered when it connects again.
+// Acknowledged notifications are removed from the stream, the durable consumers are removed by the server after being
+// inactive for the inactive threshold, while their notifications stay in the stream until a new consumer picks them up
+type NatsBroker struct {
+	js                jetstream.JetStream
+	stream            string
+	visibilityTimeout time.Duration
+	inactiveThreshold time.Duration
+	log               *zap.Logger
+	mutex             sync.Mutex
+	pending           map[string]jetstream.Msg
+}
+
+// NewNatsBroker is a factory function that creates a new NatsBroker instance
+// It creates (or updates) the stream with the given name, capturing every subject starting with subjectPrefix
+// maxAge is the maximum time a notification is kept in the stream, 0 means unlimited
+// inactiveThreshold is the time after which the server deletes a durable consumer nobody consumes through
+func NewNatsBroker(conn *natsgo.Conn, stream, subjectPrefix string, maxAge, visibilityTimeout, inactiveThreshold time.Duration, logger *zap.Logger) (*NatsBroker, error) {
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
+		Name:      stream,
+		Subjects:  []string{subjectPrefix + ".>"},
+		Retention: jetstream.WorkQueuePolicy,
+		MaxAge:    maxAge,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &NatsBroker{
+		js:                js,
+		stream:            stream,
+		visibilityTimeout: visibilityTimeout,
+		inactiveThreshold: inactiveThreshold,
+		log:               logger,
+		pending:           make(map[string]jetstream.Msg),
+	}, nil
+}
+
+// CreateDestination returns the subject, subjects do not need to be created
+func (b *NatsBroker) CreateDestination(name string) (destination string, err error) {
+	return b.GetDestination(name)
+}
+
+// GetDestination returns the subject
+func (b *NatsBroker) GetDestination(name string) (destination string, err error) {
+	if len(name) == 0 {
+		return "", commonmodel.ErrInvalidArgument
+	}
+	return name, nil
+}
+
+// Publish publishes the notification to the subject and returns the id of the notification, which is also used for the
+// deduplication of JetStream
+func (b *NatsBroker) Publish(ctx context.Context, destination string, notification model.Notification) (messageId string, err error) {
+	if len(destination) == 0 {
+		return "", commonmodel.ErrInvalidArgument
+	}
+	messageId = notification.Id
+	if messageId == "" {
+		messageId = uuid.New().String()
+	}
+	message := natsgo.NewMsg(destination)
+	message.Header.Set("id", messageId)
+	message.Header.Set("addressee", notification.Addressee)
+	message.Header.Set("subject", notification.Subject)
+	message.Data = []byte(notification.Body)
+	_, err = b.js.PublishMsg(ctx, message, jetstream.WithMsgID(messageId))
+	if err != nil {
+		b.log.Error("Error while publishing message", zap.String("subject", destination), zap.Any("error", err))
+		return "", commonmodel.ErrNatsUnexpected
+	}
+	return messageId, nil
+}
+
+// Subscribe consumes the subject through its durable consumer until ctx is cancelled
+// Messages not acknowledged within the visibility timeout are redelivered. The consumer may be shared by the instances the
+// user is connected to, thus it is not deleted when the subscription ends, but by the server once it becomes inactive
+func (b *NatsBroker) Subscribe(ctx context.Context, destination string, c chan<- model.NotificationMeta) (subscription *broker.Subscription, err error) {
+	if len(destination) == 0 {
+		return nil, commonmodel.ErrInvalidArgument
+	}
+	consumer, err := b.js.CreateOrUpdateConsumer(ctx, b.stream, jetstream.ConsumerConfig{
+		Durable:           DurableName(destination),
+		FilterSubject:     destination,
+		AckPolicy:         jetstream.AckExplicitPolicy,
+		AckWait:           b.visibilityTimeout,
+		DeliverPolicy:     jetstream.DeliverAllPolicy,
+		InactiveThreshold: b.inactiveThreshold,
+	})
+	if err != nil {
+		b.log.Error("Error while creating consumer", zap.String("subject", destination), zap.Any("error", err))
+		return nil, commonmodel.ErrNatsUnexpected
+	}
+	messages, err := consumer.Messages()
+	if err != nil {
+		b.log.Error("Error while consuming subject", zap.String("subject", destination), zap.Any("error", err))
+		return nil, commonmodel.ErrNatsUnexpected
+	}
+	subscription = broker.NewSubscription()
+	go func() {
+		<-ctx.Done()
+		messages.Stop()
+	}()
+	go func() {
+		defer subscription.Close(nil)
+		b.log.Debug("Started receiving messages", zap.String("subject", destination))
+		for {
+			message, err := messages.Next()
+			if errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+				b.log.Debug("Stopped receiving messages", zap.String("subject", destination))
+				return
+			} else if err != nil {
+				b.log.Error("Error while receiving message", zap.String("subject", destination), zap.Any("error", err))
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+			notification, handle, err := b.notificationFromMessage(message)
+			if err != nil {
+				b.log.Error("Invalid notification received... Removing from stream", zap.String("subject", destination), zap.Any("error", err))
+				_ = message.Term()
+				continue
+			}
+			b.mutex.Lock()
+			b.pending[handle] = message
+			b.mutex.Unlock()
+			select {
+			case c <- model.CreateNotificationMeta(notification, handle, destination):
+			case <-ctx.Done():
+				_ = b.Nack(context.Background(), model.CreateNotificationMeta(notification, handle, destination))
+				return
+			}
+		}
+	}()
+	return subscription, nil
+}
+
+// Ack acknowledges the message, thus it is removed from the work-queue stream
+func (b *NatsBroker) Ack(ctx context.Context, delivery model.NotificationMeta) error {
+	message, ok := b.takePending(delivery.ReceiptHandle)
+	if !ok {
+		return commonmodel.ErrNotificationNotFound
+	}
+	if err := message.Ack(); err != nil {
+		b.log.Error("Error while acknowledging message", zap.String("subject", delivery.QueueUrl), zap.Any("error", err))
+		return commonmodel.ErrNatsUnexpected
+	}
+	return nil
+}
+
+// Nack negatively acknowledges the message, thus it is redelivered immediately
+func (b *NatsBroker) Nack(ctx context.Context, delivery model.NotificationMeta) error {
+	message, ok := b.takePending(delivery.ReceiptHandle)
+	if !ok {
+		return commonmodel.ErrNotificationNotFound
+	}
+	if err := message.Nak(); err != nil {
+		b.log.Error("Error while releasing message", zap.String("subject", delivery.QueueUrl), zap.Any("error", err))
+		return commonmodel.ErrNatsUnexpected
+	}
+	return nil
+}
+
+// NackWithDelay negatively acknowledges the message, thus it is redelivered after delay
+func (b *NatsBroker) NackWithDelay(ctx context.Context, delivery model.NotificationMeta, delay time.Duration) error {
+	message, ok := b.takePending(delivery.ReceiptHandle)
+	if !ok {
+		return commonmodel.ErrNotificationNotFound
+	}
+	if err := message.NakWithDelay(delay); err != nil {
+		b.log.Error("Error while releasing message", zap.String("subject", delivery.QueueUrl), zap.Any("error", err))
+		return commonmodel.ErrNatsUnexpected
+	}
+	return nil
+}
+
+// Extend resets the redelivery timer of the message, JetStream always extends it by the AckWait of the consumer, which is
+// the visibility timeout the broker was created with
+func (b *NatsBroker) Extend(ctx context.Context, delivery model.NotificationMeta, visibilityTimeout time.Duration) error {
+	b.mutex.Lock()
+	message, ok := b.pending[delivery.ReceiptHandle]
+	b.mutex.Unlock()
+	if !ok {
+		return commonmodel.ErrNotificationNotFound
+	}
+	if err := message.InProgress(); err != nil {
+		b.log.Error("Error while extending message", zap.String("subject", delivery.QueueUrl), zap.Any("error", err))
+		return commonmodel.ErrNatsUnexpected
+	}
+	return nil
+}
+
+func (b *NatsBroker) takePending(handle string) (message jetstream.Msg, ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	message, ok = b.pending[handle]
+	delete(b.pending, handle)
+	return message, ok
+}
+
+// notificationFromMessage creates a notification from the headers and the data of the message, the stream sequence of
+// the message is used as the receipt handle
+func (b *NatsBroker) notificationFromMessage(message jetstream.Msg) (notification model.Notification, handle string, err error) {
+	metadata, err := message.Metadata()
+	if err != nil {
+		return notification, "", err
+	}
+	headers := message.Headers()
+	notification = model.Notification{
+		Id:        headers.Get("id"),
+		Addressee: headers.Get("addressee"),
+		Subject:   headers.Get("subject"),
+		Body:      string(message.Data()),
+	}
+	if len(notification.Id) == 0 || len(notification.Addressee) == 0 || len(notification.Subject) == 0 || len(notification.Body) == 0 {
+		return notification, "", commonmodel.ErrSqsInvalidMessage
+	}
+	return notification, strconv.FormatUint(metadata.Sequence.Stream, 10), nil
+}
+
+// Subject returns the subject of the given user, the user id is hex encoded, since it may contain characters which are not
+// allowed in a subject token, and the encoding must keep different user ids on different subjects
+func Subject(prefix, userId string) string {
+	return prefix + "." + hex.EncodeToString([]byte(userId))
+}
+
+// DurableName returns the name of the durable consumer of the given subject, the subject is hex encoded, since the dots
+// separating its tokens are not allowed in a consumer name
+func DurableName(subject string) string {
+	return hex.EncodeToString([]byte(subject))
+}
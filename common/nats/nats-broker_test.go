@@ -0,0 +1,24 @@
+package nats
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSubjectIsInjective(t *testing.T) {
+	subjects := make(map[string]string)
+	for _, userId := range []string{"a.b", "a_b", "a b", "a*b", "a>b", "ab", "a.b.", "Ab"} {
+		subject := Subject("notifications", userId)
+		if other, ok := subjects[subject]; ok {
+			t.Fatalf("%q and %q share the subject %q", userId, other, subject)
+		}
+		subjects[subject] = userId
+		token := strings.TrimPrefix(subject, "notifications.")
+		if strings.ContainsAny(token, ".*> \t") {
+			t.Fatalf("invalid subject token: %q", token)
+		}
+		if durable := DurableName(subject); strings.ContainsAny(durable, ".*> \t") {
+			t.Fatalf("invalid durable name: %q", durable)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	goredis "github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"notification-service/common/broker"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readBlockDuration is the maximum time a read of the consumer group is blocked waiting for new entries
+const readBlockDuration = 5 * time.Second
+
+// readCount is the maximum number of entries read at once
+const readCount = 10
+
+// trimInterval is the minimum time between two trims of a stream by a subscription
+const trimInterval = time.Minute
+
+// RedisBroker is the broker.Broker implementation backed by Redis Streams, destinations are stream keys
+// Each instance consumes the destinations through its own consumer group, thus every instance subscribed to a stream receives
+// its entries. An entry is only acknowledged (XACK) in the group of the instance when the notification is delivered, it is
+// removed from the stream (XTRIM MINID) once every group has acknowledged it, or when it is older than the retention, which
+// bounds the stream even if a group never acknowledges its entries (e.g. its instance has crashed). Entries which are not
+// acknowledged within the visibility timeout are claimed again (XAUTOCLAIM), which mimics the visibility timeout of SQS
+// The consumer groups are kept until the broker is closed, thus a stream which is subscribed again continues where the
+// previous subscription has stopped
+type RedisBroker struct {
+	client            *goredis.Client
+	group             string
+	consumer          string
+	visibilityTimeout time.Duration
+	retention         time.Duration
+	streams           sync.Map
+	log               *zap.Logger
+}
+
+// NewRedisBroker is a factory function that creates a new RedisBroker instance
+// group is the consumer group of this instance the destinations are consumed through, it must not be shared with the other
+// instances, consumer is the name of this instance within the group, retention is the maximum age of the entries of the streams
+func NewRedisBroker(client *goredis.Client, group, consumer string, visibilityTimeout, retention time.Duration, logger *zap.Logger) *RedisBroker {
+	return &RedisBroker{
+		client:            client,
+		group:             group,
+		consumer:          consumer,
+		visibilityTimeout: visibilityTimeout,
+		retention:         retention,
+		log:               logger,
+	}
+}
+
+// CreateDestination creates the stream and the consumer group of the destination, the name is used as the stream key
+func (b *RedisBroker) CreateDestination(name string) (destination string, err error) {
+	if len(name) == 0 {
+		return "", commonmodel.ErrInvalidArgument
+	}
+	if err := b.ensureGroup(context.Background(), name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// GetDestination returns the stream key of the destination, streams are created implicitly when the first entry is added
+func (b *RedisBroker) GetDestination(name string) (destination string, err error) {
+	if len(name) == 0 {
+		return "", commonmodel.ErrInvalidArgument
+	}
+	return name, nil
+}
+
+// Publish adds the notification to the stream and returns the id of the entry
+func (b *RedisBroker) Publish(ctx context.Context, destination string, notification model.Notification) (messageId string, err error) {
+	if len(destination) == 0 {
+		return "", commonmodel.ErrInvalidArgument
+	}
+	messageId, err = b.client.XAdd(ctx, &goredis.XAddArgs{
+		Stream: destination,
+		Values: map[string]interface{}{
+			"id":        notification.Id,
+			"addressee": notification.Addressee,
+			"subject":   notification.Subject,
+			"body":      notification.Body,
+		},
+	}).Result()
+	if err != nil {
+		b.log.Error("Error while adding entry to the stream", zap.String("stream", destination), zap.Any("error", err))
+		return "", commonmodel.ErrRedisUnexpected
+	}
+	return messageId, nil
+}
+
+// Subscribe reads the stream through the consumer group until ctx is cancelled, the consumer group is kept, thus the entries
+// which have not been acknowledged and the ones added in the meantime are read by the next subscription of the stream
+// The stream is trimmed periodically while it is read
+func (b *RedisBroker) Subscribe(ctx context.Context, destination string, c chan<- model.NotificationMeta) (subscription *broker.Subscription, err error) {
+	if len(destination) == 0 {
+		return nil, commonmodel.ErrInvalidArgument
+	}
+	if err := b.ensureGroup(ctx, destination); err != nil {
+		return nil, err
+	}
+	subscription = broker.NewSubscription()
+	go func() {
+		defer subscription.Close(nil)
+		b.log.Debug("Started receiving messages", zap.String("stream", destination))
+		var trimmedAt time.Time
+		for ctx.Err() == nil {
+			if time.Since(trimmedAt) >= trimInterval {
+				if err := b.trim(ctx, destination); err != nil && ctx.Err() == nil {
+					b.log.Warn("Error while trimming stream", zap.String("stream", destination), zap.Any("error", err))
+				}
+				trimmedAt = time.Now()
+			}
+			messages, err := b.read(ctx, destination)
+			if err != nil {
+				if ctx.Err() == nil {
+					b.log.Error("Error while reading stream", zap.String("stream", destination), zap.Any("error", err))
+					if strings.HasPrefix(err.Error(), "NOGROUP") {
+						//The consumer group has been destroyed from the outside, it is created again
+						b.streams.Delete(destination)
+						_ = b.ensureGroup(ctx, destination)
+					}
+					select {
+					case <-ctx.Done():
+					case <-time.After(time.Second):
+					}
+				}
+				continue
+			}
+			for _, message := range messages {
+				notification, err := notificationFromStreamMessage(message)
+				if err != nil {
+					b.log.Error("Invalid notification received... Removing from stream", zap.String("stream", destination), zap.String("id", message.ID))
+					_ = b.Ack(ctx, model.CreateNotificationMeta(model.Notification{}, message.ID, destination))
+					continue
+				}
+				select {
+				case c <- model.CreateNotificationMeta(notification, message.ID, destination):
+				case <-ctx.Done():
+					b.log.Debug("Message not processed, subscription cancelled", zap.String("stream", destination), zap.String("id", message.ID))
+				}
+			}
+		}
+		b.log.Debug("Stopped receiving messages", zap.String("stream", destination))
+	}()
+	return subscription, nil
+}
+
+// Ack acknowledges the entry in the consumer group, the entry stays in the stream until every group has acknowledged it
+func (b *RedisBroker) Ack(ctx context.Context, delivery model.NotificationMeta) error {
+	if err := b.client.XAck(ctx, delivery.QueueUrl, b.group, delivery.ReceiptHandle).Err(); err != nil {
+		b.log.Error("Error while acknowledging entry", zap.String("stream", delivery.QueueUrl), zap.String("id", delivery.ReceiptHandle), zap.Any("error", err))
+		return commonmodel.ErrRedisUnexpected
+	}
+	return nil
+}
+
+// Extend claims the pending entry again for this consumer, which resets its idle time, thus it is not claimed by the other
+// consumers until the visibility timeout elapses again
+func (b *RedisBroker) Extend(ctx context.Context, delivery model.NotificationMeta, visibilityTimeout time.Duration) error {
+	claimed, err := b.client.XClaimJustID(ctx, &goredis.XClaimArgs{
+		Stream:   delivery.QueueUrl,
+		Group:    b.group,
+		Consumer: b.consumer,
+		Messages: []string{delivery.ReceiptHandle},
+	}).Result()
+	if err != nil {
+		b.log.Error("Error while extending entry", zap.String("stream", delivery.QueueUrl), zap.String("id", delivery.ReceiptHandle), zap.Any("error", err))
+		return commonmodel.ErrRedisUnexpected
+	}
+	if len(claimed) == 0 {
+		return commonmodel.ErrNotificationNotFound
+	}
+	return nil
+}
+
+// Nack makes the pending entry immediately available again, while it keeps its id in the stream
+func (b *RedisBroker) Nack(ctx context.Context, delivery model.NotificationMeta) error {
+	return b.NackWithDelay(ctx, delivery, 0)
+}
+
+// NackWithDelay makes the pending entry available again after delay, by setting its idle time to the visibility timeout
+// reduced by the delay, thus it is claimed by the first read after the delay elapses
+func (b *RedisBroker) NackWithDelay(ctx context.Context, delivery model.NotificationMeta, delay time.Duration) error {
+	idle := b.visibilityTimeout - delay
+	if idle < 0 {
+		idle = 0
+	}
+	claimed, err := b.client.Do(ctx, "XCLAIM", delivery.QueueUrl, b.group, b.consumer, 0, delivery.ReceiptHandle,
+		"IDLE", idle.Milliseconds(), "JUSTID").Slice()
+	if err != nil {
+		b.log.Error("Error while releasing entry", zap.String("stream", delivery.QueueUrl), zap.String("id", delivery.ReceiptHandle), zap.Any("error", err))
+		return commonmodel.ErrRedisUnexpected
+	}
+	if len(claimed) == 0 {
+		return commonmodel.ErrNotificationNotFound
+	}
+	return nil
+}
+
+// read returns the entries whose visibility timeout has expired, or if there is none, the new entries of the stream
+func (b *RedisBroker) read(ctx context.Context, destination string) ([]goredis.XMessage, error) {
+	claimed, _, err := b.client.XAutoClaim(ctx, &goredis.XAutoClaimArgs{
+		Stream:   destination,
+		Group:    b.group,
+		Consumer: b.consumer,
+		MinIdle:  b.visibilityTimeout,
+		Start:    "0-0",
+		Count:    readCount,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(claimed) > 0 {
+		return claimed, nil
+	}
+	streams, err := b.client.XReadGroup(ctx, &goredis.XReadGroupArgs{
+		Group:    b.group,
+		Consumer: b.consumer,
+		Streams:  []string{destination, ">"},
+		Count:    readCount,
+		Block:    readBlockDuration,
+	}).Result()
+	if errors.Is(err, goredis.Nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var messages []goredis.XMessage
+	for _, stream := range streams {
+		messages = append(messages, stream.Messages...)
+	}
+	return messages, nil
+}
+
+// Close destroys the consumer groups of this instance, the entries only they have not acknowledged are removed by the next
+// trim of the stream
+func (b *RedisBroker) Close() {
+	b.streams.Range(func(destination, _ any) bool {
+		if err := b.client.XGroupDestroy(context.Background(), destination.(string), b.group).Err(); err != nil {
+			b.log.Warn("Error while destroying consumer group", zap.Any("stream", destination), zap.String("group", b.group), zap.Any("error", err))
+		}
+		b.streams.Delete(destination)
+		return true
+	})
+}
+
+// ensureGroup creates the consumer group of the destination (and the stream itself) if it does not exist yet
+// A new group starts after the newest entry any other group has read, thus the entries which have not been delivered by
+// any instance yet are read, while the ones which have already been delivered are not read again
+func (b *RedisBroker) ensureGroup(ctx context.Context, destination string) error {
+	if _, ok := b.streams.Load(destination); ok {
+		return nil
+	}
+	start := "0"
+	groups, err := b.client.XInfoGroups(ctx, destination).Result()
+	if err != nil && !strings.Contains(err.Error(), "no such key") {
+		b.log.Error("Error while reading consumer groups", zap.String("stream", destination), zap.Any("error", err))
+		return commonmodel.ErrRedisUnexpected
+	}
+	for _, group := range groups {
+		if compareStreamIds(group.LastDeliveredID, start) > 0 {
+			start = group.LastDeliveredID
+		}
+	}
+	err = b.client.XGroupCreateMkStream(ctx, destination, b.group, start).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		b.log.Error("Error while creating consumer group", zap.String("stream", destination), zap.String("group", b.group), zap.Any("error", err))
+		return commonmodel.ErrRedisUnexpected
+	}
+	b.streams.Store(destination, struct{}{})
+	return nil
+}
+
+// trim removes the entries of the stream which have been acknowledged by every consumer group, and the ones which are older
+// than the retention
+func (b *RedisBroker) trim(ctx context.Context, destination string) error {
+	minId := strconv.FormatInt(time.Now().Add(-b.retention).UnixMilli(), 10) + "-0"
+	groups, err := b.client.XInfoGroups(ctx, destination).Result()
+	if err != nil {
+		return err
+	}
+	acknowledged := ""
+	for _, group := range groups {
+		//The entries up to the oldest pending one, or if there is none, up to the last delivered one are acknowledged
+		floor := nextStreamId(group.LastDeliveredID)
+		if group.Pending > 0 {
+			pending, err := b.client.XPending(ctx, destination, group.Name).Result()
+			if err != nil {
+				return err
+			}
+			floor = pending.Lower
+		}
+		if acknowledged == "" || compareStreamIds(floor, acknowledged) < 0 {
+			acknowledged = floor
+		}
+	}
+	if compareStreamIds(acknowledged, minId) > 0 {
+		minId = acknowledged
+	}
+	return b.client.XTrimMinID(ctx, destination, minId).Err()
+}
+
+// parseStreamId splits the id of a stream entry into its millisecond and sequence parts
+func parseStreamId(id string) (ms, seq uint64) {
+	msPart, seqPart, _ := strings.Cut(id, "-")
+	ms, _ = strconv.ParseUint(msPart, 10, 64)
+	seq, _ = strconv.ParseUint(seqPart, 10, 64)
+	return ms, seq
+}
+
+// compareStreamIds returns -1, 0 or 1 if the id a is smaller than, equal to or greater than the id b
+func compareStreamIds(a, b string) int {
+	aMs, aSeq := parseStreamId(a)
+	bMs, bSeq := parseStreamId(b)
+	switch {
+	case aMs < bMs || (aMs == bMs && aSeq < bSeq):
+		return -1
+	case aMs == bMs && aSeq == bSeq:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// nextStreamId returns the smallest id which is greater than the given one
+func nextStreamId(id string) string {
+	ms, seq := parseStreamId(id)
+	return strconv.FormatUint(ms, 10) + "-" + strconv.FormatUint(seq+1, 10)
+}
+
+// notificationFromStreamMessage creates a notification from the fields of a stream entry, the id of the notification is the
+// one it has been published with, the id of the entry is used only if the entry has no id field
+func notificationFromStreamMessage(message goredis.XMessage) (model.Notification, error) {
+	id, _ := message.Values["id"].(string)
+	if len(id) == 0 {
+		id = message.ID
+	}
+	addressee, _ := message.Values["addressee"].(string)
+	subject, _ := message.Values["subject"].(string)
+	body, _ := message.Values["body"].(string)
+	if len(addressee) == 0 || len(subject) == 0 || len(body) == 0 {
+		return model.Notification{}, commonmodel.ErrSqsInvalidMessage
+	}
+	return model.Notification{
+		Id:        id,
+		Addressee: addressee,
+		Subject:   subject,
+		Body:      body,
+	}, nil
+}
@@ -0,0 +1,209 @@
+package redis
+
+import (
+	"context"
+	"github.com/google/uuid"
+	goredis "github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestBroker connects to the redis-server given by REDIS_TEST_ADDR, the test is skipped if it is not set
+func newTestBroker(t *testing.T, consumer string, visibilityTimeout time.Duration) *RedisBroker {
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_TEST_ADDR is not set")
+	}
+	client := goredis.NewClient(&goredis.Options{Addr: addr})
+	t.Cleanup(func() { _ = client.Close() })
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Fatalf("redis-server is not available: %v", err)
+	}
+	b := NewRedisBroker(client, "test-"+consumer, consumer, visibilityTimeout, time.Hour, zap.NewNop())
+	t.Cleanup(b.Close)
+	return b
+}
+
+func newTestStream(t *testing.T, b *RedisBroker) string {
+	stream := "test-stream-" + uuid.New().String()
+	t.Cleanup(func() { _ = b.client.Del(context.Background(), stream).Err() })
+	return stream
+}
+
+func subscribe(t *testing.T, b *RedisBroker, stream string) (<-chan model.NotificationMeta, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c := make(chan model.NotificationMeta)
+	if _, err := b.Subscribe(ctx, stream, c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return c, cancel
+}
+
+func receive(t *testing.T, c <-chan model.NotificationMeta, timeout time.Duration) model.NotificationMeta {
+	select {
+	case delivery := <-c:
+		return delivery
+	case <-time.After(timeout):
+		t.Fatalf("no delivery within %v", timeout)
+		return model.NotificationMeta{}
+	}
+}
+
+func publish(t *testing.T, b *RedisBroker, stream string) model.Notification {
+	notification := model.Notification{Id: uuid.New().String(), Addressee: "u1", Subject: "subject", Body: "body"}
+	if _, err := b.Publish(context.Background(), stream, notification); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return notification
+}
+
+func TestCompareStreamIds(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1-0", "1-0", 0},
+		{"1-1", "1-0", 1},
+		{"1-9", "10-0", -1},
+		{"0", "0-0", 0},
+	}
+	for _, test := range tests {
+		if result := compareStreamIds(test.a, test.b); result != test.expected {
+			t.Fatalf("unexpected result of comparing %s to %s: %d", test.a, test.b, result)
+		}
+	}
+	if next := nextStreamId("1700000000000-4"); next != "1700000000000-5" {
+		t.Fatalf("unexpected next id: %s", next)
+	}
+}
+
+func TestRedisBrokerTrimRemovesEntryAcknowledgedByEveryGroup(t *testing.T) {
+	b := newTestBroker(t, uuid.New().String(), time.Minute)
+	stream := newTestStream(t, b)
+	notification := publish(t, b, stream)
+	c, _ := subscribe(t, b, stream)
+	delivery := receive(t, c, 2*readBlockDuration)
+	if delivery.Notification != notification {
+		t.Fatalf("unexpected notification: %+v, expected %+v", delivery.Notification, notification)
+	}
+	//The entry is kept for the group of the other instance, which has not read it yet
+	other := newTestBroker(t, uuid.New().String(), time.Minute)
+	c2, _ := subscribe(t, other, stream)
+	if err := b.Ack(context.Background(), delivery); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.trim(context.Background(), stream); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if length := b.client.XLen(context.Background(), stream).Val(); length != 1 {
+		t.Fatalf("the entry has been removed before every group has acknowledged it")
+	}
+	if delivery := receive(t, c2, 2*readBlockDuration); delivery.Notification != notification {
+		t.Fatalf("unexpected notification: %+v, expected %+v", delivery.Notification, notification)
+	} else if err := other.Ack(context.Background(), delivery); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.trim(context.Background(), stream); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if length := b.client.XLen(context.Background(), stream).Val(); length != 0 {
+		t.Fatalf("the acknowledged entry is still in the stream")
+	}
+}
+
+func TestRedisBrokerResubscribeDoesNotReplayStream(t *testing.T) {
+	b := newTestBroker(t, uuid.New().String(), time.Minute)
+	stream := newTestStream(t, b)
+	publish(t, b, stream)
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan model.NotificationMeta)
+	subscription, err := b.Subscribe(ctx, stream, c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Ack(context.Background(), receive(t, c, 2*readBlockDuration)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cancel()
+	<-subscription.Done()
+	notification := publish(t, b, stream)
+	resubscribed, _ := subscribe(t, b, stream)
+	if delivery := receive(t, resubscribed, 2*readBlockDuration); delivery.Notification != notification {
+		t.Fatalf("unexpected notification: %+v, expected %+v", delivery.Notification, notification)
+	}
+	//A new group starts after the entries the other groups have already read
+	other := newTestBroker(t, uuid.New().String(), time.Minute)
+	c2, _ := subscribe(t, other, stream)
+	select {
+	case delivery := <-c2:
+		t.Fatalf("unexpected delivery of an entry read by another group: %+v", delivery)
+	case <-time.After(readBlockDuration + time.Second):
+	}
+}
+
+func TestRedisBrokerNackRedeliversWithSameId(t *testing.T) {
+	b := newTestBroker(t, uuid.New().String(), time.Minute)
+	stream := newTestStream(t, b)
+	notification := publish(t, b, stream)
+	c, _ := subscribe(t, b, stream)
+	delivery := receive(t, c, 2*readBlockDuration)
+	if err := b.Nack(context.Background(), delivery); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	redelivery := receive(t, c, 2*readBlockDuration)
+	if redelivery.Notification.Id != notification.Id || redelivery.ReceiptHandle != delivery.ReceiptHandle {
+		t.Fatalf("unexpected redelivery: %+v", redelivery)
+	}
+	if length := b.client.XLen(context.Background(), stream).Val(); length != 1 {
+		t.Fatalf("unexpected length of the stream: %d", length)
+	}
+	if err := b.Ack(context.Background(), redelivery); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Nack(context.Background(), redelivery); err != commonmodel.ErrNotificationNotFound {
+		t.Fatalf("unexpected error of the stale nack: %v", err)
+	}
+}
+
+func TestRedisBrokerRedeliversAfterVisibilityTimeout(t *testing.T) {
+	b := newTestBroker(t, uuid.New().String(), 500*time.Millisecond)
+	stream := newTestStream(t, b)
+	notification := publish(t, b, stream)
+	c, _ := subscribe(t, b, stream)
+	receive(t, c, 2*readBlockDuration)
+	redelivery := receive(t, c, 2*readBlockDuration)
+	if redelivery.Notification.Id != notification.Id {
+		t.Fatalf("unexpected redelivery: %+v", redelivery)
+	}
+	if err := b.Extend(context.Background(), redelivery, time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRedisBrokerInstancesHaveOwnGroups(t *testing.T) {
+	first := newTestBroker(t, uuid.New().String(), time.Minute)
+	second := newTestBroker(t, uuid.New().String(), time.Minute)
+	stream := newTestStream(t, first)
+	notification := publish(t, first, stream)
+	c1, _ := subscribe(t, first, stream)
+	c2, _ := subscribe(t, second, stream)
+	for _, c := range []<-chan model.NotificationMeta{c1, c2} {
+		if delivery := receive(t, c, 2*readBlockDuration); delivery.Notification.Id != notification.Id {
+			t.Fatalf("unexpected delivery: %+v", delivery)
+		}
+	}
+	//The consumer group is destroyed when the broker is closed
+	first.Close()
+	groups, err := first.client.XInfoGroups(context.Background(), stream).Result()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(groups) != 1 || groups[0].Name != second.group {
+		t.Fatalf("the consumer group has not been destroyed: %v", groups)
+	}
+}
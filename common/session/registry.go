@@ -0,0 +1,186 @@
+package session
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Registry is a thread-safe store of the sessions connected to the service instance, which can be shared between the API
+// layer and the dispatcher of the incoming notifications
+// The sessions are sharded by user id, so the lock contention is limited to the users of the same shard
+type Registry struct {
+	shards []*shard
+}
+
+type shard struct {
+	mutex sync.RWMutex
+	users map[string]*user
+}
+
+// user holds the sessions of a user, while its onFirst or onLast callback is running, transition is open and the other
+// registrations of the user wait for it to be closed
+type user struct {
+	sessions   map[string]*Session
+	transition chan struct{}
+}
+
+// NewRegistry is a factory function that creates a new Registry instance with the given number of shards
+func NewRegistry(shardCount int) *Registry {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	registry := &Registry{shards: make([]*shard, shardCount)}
+	for i := range registry.shards {
+		registry.shards[i] = &shard{users: make(map[string]*user)}
+	}
+	return registry
+}
+
+// Register adds the session to the registry
+// If it is the first session of the user, onFirst is called before the session is added. The callback runs outside the
+// lock of the shard (it usually does I/O), however it cannot interleave with the callbacks of the same user: the other
+// registrations of the user wait for it. If onFirst returns an error the session is not registered
+func (r *Registry) Register(session *Session, onFirst func() error) error {
+	shard := r.shard(session.UserId)
+	for {
+		shard.mutex.Lock()
+		u, ok := shard.users[session.UserId]
+		if ok && u.transition != nil {
+			//The first session of the user is being registered or the last one unregistered, retry when it is done
+			transition := u.transition
+			shard.mutex.Unlock()
+			<-transition
+			continue
+		}
+		if ok {
+			u.sessions[session.Id] = session
+			shard.mutex.Unlock()
+			return nil
+		}
+		u = &user{sessions: make(map[string]*Session), transition: make(chan struct{})}
+		shard.users[session.UserId] = u
+		shard.mutex.Unlock()
+
+		var err error
+		if onFirst != nil {
+			err = onFirst()
+		}
+		shard.mutex.Lock()
+		if err != nil {
+			delete(shard.users, session.UserId)
+		} else {
+			u.sessions[session.Id] = session
+		}
+		close(u.transition)
+		u.transition = nil
+		shard.mutex.Unlock()
+		return err
+	}
+}
+
+// Unregister removes the session from the registry and closes it
+// If it was the last session of the user, onLast is called outside the lock of the shard, the registrations of the user
+// wait until it returns
+func (r *Registry) Unregister(session *Session, onLast func()) {
+	shard := r.shard(session.UserId)
+	shard.mutex.Lock()
+	session.close()
+	u, ok := shard.users[session.UserId]
+	if !ok || u.transition != nil {
+		shard.mutex.Unlock()
+		return
+	}
+	if _, ok := u.sessions[session.Id]; !ok {
+		shard.mutex.Unlock()
+		return
+	}
+	delete(u.sessions, session.Id)
+	if len(u.sessions) > 0 {
+		shard.mutex.Unlock()
+		return
+	}
+	u.transition = make(chan struct{})
+	shard.mutex.Unlock()
+
+	if onLast != nil {
+		onLast()
+	}
+	shard.mutex.Lock()
+	delete(shard.users, session.UserId)
+	close(u.transition)
+	shard.mutex.Unlock()
+}
+
+// Lookup returns the sessions of the given user
+func (r *Registry) Lookup(userId string) []*Session {
+	shard := r.shard(userId)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	u, ok := shard.users[userId]
+	if !ok {
+		return nil
+	}
+	sessions := make([]*Session, 0, len(u.sessions))
+	for _, session := range u.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Range calls fn for each registered session until fn returns false
+// The shards are locked one by one, so fn must not call other methods of the registry
+func (r *Registry) Range(fn func(session *Session) bool) {
+	for _, shard := range r.shards {
+		if !shard.rangeSessions(fn) {
+			return
+		}
+	}
+}
+
+// UserCount returns the number of users having at least one session
+func (r *Registry) UserCount() (count int) {
+	for _, shard := range r.shards {
+		shard.mutex.RLock()
+		for _, u := range shard.users {
+			if len(u.sessions) > 0 {
+				count++
+			}
+		}
+		shard.mutex.RUnlock()
+	}
+	return count
+}
+
+// SessionCounts returns the number of sessions of each user having at least one session
+func (r *Registry) SessionCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, shard := range r.shards {
+		shard.mutex.RLock()
+		for userId, u := range shard.users {
+			if len(u.sessions) > 0 {
+				counts[userId] = len(u.sessions)
+			}
+		}
+		shard.mutex.RUnlock()
+	}
+	return counts
+}
+
+func (r *Registry) shard(userId string) *shard {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(userId))
+	return r.shards[hash.Sum32()%uint32(len(r.shards))]
+}
+
+func (s *shard) rangeSessions(fn func(session *Session) bool) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, u := range s.users {
+		for _, session := range u.sessions {
+			if !fn(session) {
+				return false
+			}
+		}
+	}
+	return true
+}
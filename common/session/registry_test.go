@@ -0,0 +1,129 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegisterCallsOnFirstOnce(t *testing.T) {
+	registry := NewRegistry(4)
+	calls := 0
+	onFirst := func() error {
+		calls++
+		return nil
+	}
+	for _, id := range []string{"s1", "s2"} {
+		if err := registry.Register(NewSession(id, "u1", "", ""), onFirst); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("onFirst called %d times", calls)
+	}
+	if sessions := registry.Lookup("u1"); len(sessions) != 2 {
+		t.Fatalf("unexpected number of sessions: %d", len(sessions))
+	}
+	if count := registry.UserCount(); count != 1 {
+		t.Fatalf("unexpected user count: %d", count)
+	}
+	if counts := registry.SessionCounts(); counts["u1"] != 2 {
+		t.Fatalf("unexpected session counts: %v", counts)
+	}
+}
+
+func TestRegisterFailingOnFirstDoesNotRegister(t *testing.T) {
+	registry := NewRegistry(1)
+	failure := errors.New("failure")
+	if err := registry.Register(NewSession("s1", "u1", "", ""), func() error { return failure }); err != failure {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sessions := registry.Lookup("u1"); len(sessions) != 0 {
+		t.Fatalf("session registered despite the error")
+	}
+	called := false
+	if err := registry.Register(NewSession("s2", "u1", "", ""), func() error { called = true; return nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !called {
+		t.Fatal("onFirst not called after a failed registration")
+	}
+}
+
+func TestUnregisterCallsOnLastAfterLastSession(t *testing.T) {
+	registry := NewRegistry(1)
+	first, second := NewSession("s1", "u1", "", ""), NewSession("s2", "u1", "", "")
+	_ = registry.Register(first, nil)
+	_ = registry.Register(second, nil)
+	calls := 0
+	registry.Unregister(first, func() { calls++ })
+	if calls != 0 {
+		t.Fatal("onLast called while a session is still registered")
+	}
+	registry.Unregister(second, func() { calls++ })
+	registry.Unregister(second, func() { calls++ })
+	if calls != 1 {
+		t.Fatalf("onLast called %d times", calls)
+	}
+	if count := registry.UserCount(); count != 0 {
+		t.Fatalf("unexpected user count: %d", count)
+	}
+}
+
+func TestSlowOnFirstDoesNotBlockOtherUsers(t *testing.T) {
+	//A single shard, so both users share the lock
+	registry := NewRegistry(1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		_ = registry.Register(NewSession("s1", "slow", "", ""), func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	done := make(chan struct{})
+	go func() {
+		_ = registry.Register(NewSession("s2", "fast", "", ""), nil)
+		_ = registry.Lookup("slow")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("registration of another user blocked by a slow onFirst")
+	}
+	close(release)
+}
+
+func TestCallbacksOfTheSameUserDoNotInterleave(t *testing.T) {
+	registry := NewRegistry(1)
+	var running int32
+	var wg sync.WaitGroup
+	callback := func() {
+		if atomic.AddInt32(&running, 1) != 1 {
+			t.Error("callbacks of the same user interleaved")
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session := NewSession(string(rune('a'+i%26))+string(rune('0'+i/26)), "u1", "", "")
+			if err := registry.Register(session, func() error { callback(); return nil }); err != nil {
+				t.Error(err)
+				return
+			}
+			registry.Unregister(session, callback)
+		}(i)
+	}
+	wg.Wait()
+	if count := registry.UserCount(); count != 0 {
+		t.Fatalf("unexpected user count: %d", count)
+	}
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"notification-service/model"
+	"sync"
+	"time"
+)
+
+// Session is a single connection of a user, notifications are delivered to it through its dedicated channel
+type Session struct {
+	Id          string
+	UserId      string
+	DeviceId    string
+	TraceId     string
+	ConnectedAt time.Time
+	channel     chan model.Notification
+	done        chan struct{}
+	closeOnce   sync.Once
+	terminated  chan struct{}
+	termination sync.Once
+	err         error
+}
+
+// NewSession is a factory function that creates a new Session instance
+func NewSession(id, userId, deviceId, traceId string) *Session {
+	return &Session{
+		Id:          id,
+		UserId:      userId,
+		DeviceId:    deviceId,
+		TraceId:     traceId,
+		ConnectedAt: time.Now(),
+		channel:     make(chan model.Notification),
+		done:        make(chan struct{}),
+		terminated:  make(chan struct{}),
+	}
+}
+
+// Notifications returns the channel the notifications of the session are delivered to
+func (s *Session) Notifications() <-chan model.Notification {
+	return s.channel
+}
+
+// Done returns a channel which is closed when the session is unregistered
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Terminated returns a channel which is closed when the server can no longer serve the session (see Terminate), the
+// connection of the session is expected to inform the client and close itself
+func (s *Session) Terminated() <-chan struct{} {
+	return s.terminated
+}
+
+// Err returns the reason of the termination, it is nil until the session is terminated
+func (s *Session) Err() error {
+	select {
+	case <-s.terminated:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Terminate signals the connection of the session that it has to be closed because of the given reason
+func (s *Session) Terminate(reason error) {
+	s.termination.Do(func() {
+		s.err = reason
+		close(s.terminated)
+	})
+}
+
+// Deliver hands over the notification to the connection of the session
+// It blocks until the connection receives the notification, at most for the given timeout, so a stalled connection cannot
+// hold up the delivery to the other users. It returns false if the session is closed or the timeout elapses in the meantime
+func (s *Session) Deliver(notification model.Notification, timeout time.Duration) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s.channel <- notification:
+		return true
+	case <-s.done:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
+
+// close marks the session closed, the notification channel is never closed, since deliveries might be in progress
+func (s *Session) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
@@ -0,0 +1,81 @@
+package session
+
+import (
+	"errors"
+	"notification-service/model"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeliverAfterUnregisterReturnsFalse(t *testing.T) {
+	registry := NewRegistry(1)
+	session := NewSession("s1", "u1", "", "")
+	if err := registry.Register(session, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	registry.Unregister(session, nil)
+	if session.Deliver(model.Notification{Id: "n1"}, time.Second) {
+		t.Fatal("notification delivered to a closed session")
+	}
+}
+
+func TestDeliverConcurrentWithUnregisterDoesNotPanic(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		registry := NewRegistry(1)
+		session := NewSession("s1", "u1", "", "")
+		if err := registry.Register(session, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			session.Deliver(model.Notification{Id: "n1"}, time.Second)
+		}()
+		go func() {
+			defer wg.Done()
+			registry.Unregister(session, nil)
+		}()
+		wg.Wait()
+	}
+}
+
+func TestDeliverHandsOverToReader(t *testing.T) {
+	session := NewSession("s1", "u1", "", "")
+	go func() {
+		<-session.Notifications()
+	}()
+	if !session.Deliver(model.Notification{Id: "n1"}, time.Second) {
+		t.Fatal("notification not delivered")
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	session := NewSession("s1", "u1", "", "")
+	if session.Err() != nil {
+		t.Fatal("error set before termination")
+	}
+	first := errors.New("first")
+	session.Terminate(first)
+	session.Terminate(errors.New("second"))
+	select {
+	case <-session.Terminated():
+	case <-time.After(time.Second):
+		t.Fatal("terminated channel not closed")
+	}
+	if session.Err() != first {
+		t.Fatalf("unexpected error: %v", session.Err())
+	}
+}
+
+func TestDeliverTimesOutOnStalledConnection(t *testing.T) {
+	session := NewSession("s1", "u1", "", "")
+	start := time.Now()
+	if session.Deliver(model.Notification{Id: "n1"}, 50*time.Millisecond) {
+		t.Fatal("notification delivered without a reader")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("delivery blocked for %v", elapsed)
+	}
+}
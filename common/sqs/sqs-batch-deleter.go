@@ -0,0 +1,124 @@
+package service
+
+import (
+	"go.uber.org/zap"
+	commonmodel "notification-service/common/common-model"
+	"sync"
+	"time"
+)
+
+// MaxBatchSize is the maximum number of entries of a single SQS batch request
+const MaxBatchSize = 10
+
+// BatchDeleteFailure describes a receipt handle which could not be deleted by DeleteMessageBatch
+type BatchDeleteFailure struct {
+	ReceiptHandle string
+	Code          string
+	Message       string
+	SenderFault   bool
+}
+
+// BatchDeleter coalesces the deletion of messages into DeleteMessageBatch requests
+// The receipt handles of the same queue are collected for the given window (or until a full batch is collected), then
+// deleted at once. The result of each deletion is reported to its caller, the messages which could not be deleted reappear
+// in the queue when their visibility timeout expires
+type BatchDeleter struct {
+	sqs      SqsServiceInterface
+	window   time.Duration
+	log      *zap.Logger
+	mutex    sync.Mutex
+	batches  map[string]*deleteBatch
+	inFlight sync.WaitGroup
+}
+
+type deleteBatch struct {
+	receiptHandles []string
+	onDone         map[string]func(err error)
+	timer          *time.Timer
+}
+
+// NewBatchDeleter is a factory function that creates a new BatchDeleter instance
+func NewBatchDeleter(sqsService SqsServiceInterface, window time.Duration, logger *zap.Logger) *BatchDeleter {
+	return &BatchDeleter{
+		sqs:     sqsService,
+		window:  window,
+		log:     logger,
+		batches: make(map[string]*deleteBatch),
+	}
+}
+
+// Delete schedules the deletion of the message, it does not wait for the batch to be sent
+// onDone is optional, it is called with the result of the deletion once the batch has been sent, err is nil if the message
+// has been deleted
+func (d *BatchDeleter) Delete(queueUrl string, receiptHandle string, onDone func(err error)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	batch, ok := d.batches[queueUrl]
+	if !ok {
+		batch = &deleteBatch{onDone: make(map[string]func(err error))}
+		batch.timer = time.AfterFunc(d.window, func() {
+			d.flush(queueUrl, batch)
+		})
+		d.batches[queueUrl] = batch
+	}
+	batch.receiptHandles = append(batch.receiptHandles, receiptHandle)
+	if onDone != nil {
+		batch.onDone[receiptHandle] = onDone
+	}
+	if len(batch.receiptHandles) >= MaxBatchSize {
+		batch.timer.Stop()
+		d.detach(queueUrl, batch)
+	}
+}
+
+// Flush sends all the collected batches and waits until every pending request completes
+func (d *BatchDeleter) Flush() {
+	d.mutex.Lock()
+	for queueUrl, batch := range d.batches {
+		batch.timer.Stop()
+		d.detach(queueUrl, batch)
+	}
+	d.mutex.Unlock()
+	d.inFlight.Wait()
+}
+
+// flush is called by the timer of the batch when the window elapses
+func (d *BatchDeleter) flush(queueUrl string, batch *deleteBatch) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.batches[queueUrl] != batch {
+		//The batch has already been sent since it became full
+		return
+	}
+	d.detach(queueUrl, batch)
+}
+
+// detach removes the batch from the collected ones and sends it in the background, the caller must hold the mutex
+func (d *BatchDeleter) detach(queueUrl string, batch *deleteBatch) {
+	delete(d.batches, queueUrl)
+	d.inFlight.Add(1)
+	go func() {
+		defer d.inFlight.Done()
+		failed, err := d.sqs.DeleteMessageBatch(queueUrl, batch.receiptHandles)
+		if err != nil {
+			failed = make([]BatchDeleteFailure, 0, len(batch.receiptHandles))
+			for _, receiptHandle := range batch.receiptHandles {
+				failed = append(failed, BatchDeleteFailure{ReceiptHandle: receiptHandle, Code: err.Error()})
+			}
+		}
+		if len(failed) > 0 {
+			receiptHandles := make([]string, 0, len(failed))
+			for _, failure := range failed {
+				receiptHandles = append(receiptHandles, failure.ReceiptHandle)
+				if onDone, ok := batch.onDone[failure.ReceiptHandle]; ok {
+					delete(batch.onDone, failure.ReceiptHandle)
+					onDone(commonmodel.ErrSqsUnexpected)
+				}
+			}
+			d.log.Error("Messages could not be deleted", zap.String("queueUrl", queueUrl), zap.Strings("receiptHandles", receiptHandles), zap.Int("total", len(batch.receiptHandles)))
+		}
+		for _, onDone := range batch.onDone {
+			onDone(nil)
+		}
+	}()
+}
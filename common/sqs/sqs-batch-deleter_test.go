@@ -0,0 +1,69 @@
+package service
+
+import (
+	"go.uber.org/zap"
+	commonmodel "notification-service/common/common-model"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDeleter fails the deletion of the receipt handles listed in failures
+type fakeDeleter struct {
+	SqsServiceInterface
+	mutex    sync.Mutex
+	batches  [][]string
+	failures map[string]bool
+}
+
+func (f *fakeDeleter) DeleteMessageBatch(queueUrl string, receiptHandles []string) (failed []BatchDeleteFailure, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.batches = append(f.batches, receiptHandles)
+	for _, receiptHandle := range receiptHandles {
+		if f.failures[receiptHandle] {
+			failed = append(failed, BatchDeleteFailure{ReceiptHandle: receiptHandle, Code: "ReceiptHandleIsInvalid"})
+		}
+	}
+	return failed, nil
+}
+
+func TestBatchDeleterReportsResultOfEachDeletion(t *testing.T) {
+	fake := &fakeDeleter{failures: map[string]bool{"failed": true}}
+	deleter := NewBatchDeleter(fake, time.Hour, zap.NewNop())
+	var mutex sync.Mutex
+	results := make(map[string]error)
+	onDone := func(receiptHandle string) func(err error) {
+		return func(err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			results[receiptHandle] = err
+		}
+	}
+	deleter.Delete("queue", "deleted", onDone("deleted"))
+	deleter.Delete("queue", "failed", onDone("failed"))
+	deleter.Delete("queue", "without-callback", nil)
+	deleter.Flush()
+	if len(fake.batches) != 1 || len(fake.batches[0]) != 3 {
+		t.Fatalf("unexpected batches: %v", fake.batches)
+	}
+	if err, ok := results["deleted"]; !ok || err != nil {
+		t.Fatalf("unexpected result of the deleted message: %v", err)
+	}
+	if err := results["failed"]; err != commonmodel.ErrSqsUnexpected {
+		t.Fatalf("unexpected result of the failed message: %v", err)
+	}
+}
+
+func TestBatchDeleterSendsFullBatches(t *testing.T) {
+	fake := &fakeDeleter{}
+	deleter := NewBatchDeleter(fake, time.Hour, zap.NewNop())
+	for i := 0; i < MaxBatchSize+1; i++ {
+		deleter.Delete("queue", "handle", nil)
+	}
+	deleter.Flush()
+	//The full batch is sent right away, while the remaining one at the flush, they might complete in any order
+	if len(fake.batches) != 2 || len(fake.batches[0])+len(fake.batches[1]) != MaxBatchSize+1 || len(fake.batches[0]) > MaxBatchSize || len(fake.batches[1]) > MaxBatchSize {
+		t.Fatalf("unexpected batches: %v", fake.batches)
+	}
+}
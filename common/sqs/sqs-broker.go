@@ -0,0 +1,218 @@
+package service
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"math"
+	"notification-service/common/broker"
+	"notification-service/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deadLetterQueueSuffix is appended to the name of a queue to get the name of its paired dead-letter-queue
+const deadLetterQueueSuffix = "-dlq"
+
+// PairedQueueTag is the tag of the paired dead-letter-queues, which holds the name of the queue the dead-letter-queue
+// was created for
+const PairedQueueTag = "notification-service-paired-queue"
+
+// RetiredAtTag is the tag of the paired dead-letter-queues whose queue has been deleted, which holds the unix timestamp
+// of the deletion. Such a dead-letter-queue receives no more messages, it is deleted once it has been drained
+const RetiredAtTag = "notification-service-retired-at"
+
+// retiredQueueGracePeriod is the time a retired dead-letter-queue is kept even if it is empty, since the message counts
+// reported by SQS are approximate and lag behind the last redrives
+const retiredQueueGracePeriod = 5 * time.Minute
+
+// SqsBroker is the broker.Broker implementation backed by AWS SQS, destinations are queue URLs
+type SqsBroker struct {
+	sqs               SqsServiceInterface
+	visibilityTimeout int64
+	queueConfig       SqsQueueConfig
+	log               *zap.Logger
+}
+
+// SqsQueueConfig contains the attributes of the queues created by the SqsBroker, the nil values are left to SQS defaults
+// RetentionPeriodSeconds is the time a message is kept in the queue (60-1209600)
+// MaxReceiveCount is the number of receives after which a message is moved to the dead-letter-queue
+// DeadLetterQueueArn is the ARN of an existing dead-letter-queue shared by the created queues
+// CreateDeadLetterQueue makes the broker create a paired dead-letter-queue (<name>-dlq) for each queue, if DeadLetterQueueArn is not set
+// DeadLetterRetentionPeriodSeconds is the retention period of the paired dead-letter-queues
+type SqsQueueConfig struct {
+	RetentionPeriodSeconds           *int
+	MaxReceiveCount                  *int
+	DeadLetterQueueArn               *string
+	CreateDeadLetterQueue            bool
+	DeadLetterRetentionPeriodSeconds *int
+}
+
+// NewSqsBroker is a factory function that creates a new SqsBroker instance
+// visibilityTimeout is the time in seconds a received message is hidden from the other consumers of the queue
+func NewSqsBroker(sqsService SqsServiceInterface, visibilityTimeout int64, queueConfig SqsQueueConfig, logger *zap.Logger) *SqsBroker {
+	return &SqsBroker{
+		sqs:               sqsService,
+		visibilityTimeout: visibilityTimeout,
+		queueConfig:       queueConfig,
+		log:               logger,
+	}
+}
+
+// CreateDestination creates a new SQS queue and returns its URL
+// The queue is attached to the configured dead-letter-queue, or to its own paired dead-letter-queue created beforehand
+func (b *SqsBroker) CreateDestination(name string) (destination string, err error) {
+	deadLetterQueueArn := b.queueConfig.DeadLetterQueueArn
+	if deadLetterQueueArn == nil && b.queueConfig.CreateDeadLetterQueue {
+		deadLetterQueueArn, err = b.createDeadLetterQueue(name)
+		if err != nil {
+			return "", err
+		}
+	}
+	maxReceiveCount := b.queueConfig.MaxReceiveCount
+	if deadLetterQueueArn == nil {
+		maxReceiveCount = nil
+	}
+	queueUrl, err := b.sqs.CreateMessageQueue(name, nil, b.queueConfig.RetentionPeriodSeconds, maxReceiveCount, deadLetterQueueArn)
+	if err != nil {
+		return "", err
+	}
+	return *queueUrl, nil
+}
+
+// createDeadLetterQueue creates the paired dead-letter-queue of the queue with the given name and returns its ARN
+// The dead-letter-queue of a FIFO queue must be a FIFO queue too
+// The dead-letter-queue is tagged with PairedQueueTag, thus it can be told apart from the queues provisioned by other means
+func (b *SqsBroker) createDeadLetterQueue(name string) (deadLetterQueueArn *string, err error) {
+	deadLetterQueueUrl, err := b.sqs.CreateMessageQueue(DeadLetterQueueName(name), nil, b.queueConfig.DeadLetterRetentionPeriodSeconds, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.sqs.TagMessageQueue(*deadLetterQueueUrl, map[string]string{PairedQueueTag: name}); err != nil {
+		return nil, err
+	}
+	return b.sqs.GetQueueArn(*deadLetterQueueUrl)
+}
+
+// DeadLetterQueueName returns the name of the paired dead-letter-queue of the queue with the given name
+// The dead-letter-queue of a FIFO queue must be a FIFO queue too
+func DeadLetterQueueName(name string) string {
+	if IsFifoQueue(name) {
+		return strings.TrimSuffix(name, FifoQueueSuffix) + deadLetterQueueSuffix + FifoQueueSuffix
+	}
+	return name + deadLetterQueueSuffix
+}
+
+// IsDeadLetterQueue returns whether the name (or the URL) is the name of a paired dead-letter-queue
+func IsDeadLetterQueue(queueNameOrUrl string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(queueNameOrUrl, FifoQueueSuffix), deadLetterQueueSuffix)
+}
+
+// DeleteDestination deletes the SQS queue
+// Its paired dead-letter-queue (if the broker creates them) is tagged with RetiredAtTag instead of being deleted, since
+// it might still hold notifications for the DLQ worker, see DeleteDrainedDeadLetterQueue
+func (b *SqsBroker) DeleteDestination(destination string) error {
+	if err := b.sqs.DeleteMessageQueue(destination); err != nil {
+		return err
+	}
+	if b.queueConfig.DeadLetterQueueArn != nil || !b.queueConfig.CreateDeadLetterQueue {
+		return nil
+	}
+	deadLetterQueueUrl, err := b.sqs.GetQueueUrl(DeadLetterQueueName(destination[strings.LastIndex(destination, "/")+1:]))
+	if err != nil {
+		b.log.Warn("Paired dead-letter-queue not found", zap.String("queueUrl", destination), zap.Any("error", err))
+		return nil
+	}
+	return b.sqs.TagMessageQueue(*deadLetterQueueUrl, map[string]string{RetiredAtTag: strconv.FormatInt(time.Now().Unix(), 10)})
+}
+
+// DeleteDrainedDeadLetterQueue deletes the paired dead-letter-queue if its queue has been deleted (see DeleteDestination)
+// and all its messages have been processed, it returns whether the dead-letter-queue has been deleted
+// The dead-letter-queues without RetiredAtTag are never deleted
+func (b *SqsBroker) DeleteDrainedDeadLetterQueue(queueUrl string) (deleted bool, err error) {
+	tags, err := b.sqs.GetQueueTags(queueUrl)
+	if err != nil {
+		return false, err
+	}
+	retiredAt, err := strconv.ParseInt(tags[RetiredAtTag], 10, 64)
+	if err != nil || time.Since(time.Unix(retiredAt, 0)) < retiredQueueGracePeriod {
+		return false, nil
+	}
+	count, err := b.sqs.CountMessages(queueUrl)
+	if err != nil || count > 0 {
+		return false, err
+	}
+	if err := b.sqs.DeleteMessageQueue(queueUrl); err != nil {
+		return false, err
+	}
+	b.log.Info("Drained dead-letter-queue deleted", zap.String("queueUrl", queueUrl))
+	return true, nil
+}
+
+// CountNotifications returns the approximate number of messages of the queue, including the in-flight ones
+func (b *SqsBroker) CountNotifications(destination string) (count int, err error) {
+	return b.sqs.CountMessages(destination)
+}
+
+// GetDestination returns the URL of the SQS queue with the given name
+func (b *SqsBroker) GetDestination(name string) (destination string, err error) {
+	queueUrl, err := b.sqs.GetQueueUrl(name)
+	if err != nil {
+		return "", err
+	}
+	return *queueUrl, nil
+}
+
+// Publish sends the notification to the SQS queue
+func (b *SqsBroker) Publish(ctx context.Context, destination string, notification model.Notification) (messageId string, err error) {
+	id, err := b.sqs.SendNotificationToQueue(model.CreateNotificationMeta(notification, "", destination))
+	if err != nil {
+		return "", err
+	}
+	return *id, nil
+}
+
+// Subscribe receives the notifications of the SQS queue until ctx is cancelled
+// If the queue stops being usable (e.g.: it has been deleted), the subscription is closed with the corresponding error
+func (b *SqsBroker) Subscribe(ctx context.Context, destination string, c chan<- model.NotificationMeta) (subscription *broker.Subscription, err error) {
+	receiveCtx, cancel := context.WithCancel(ctx)
+	subscription = broker.NewSubscription()
+	err = b.sqs.ReceiveNotification(receiveCtx, c, destination, b.visibilityTimeout, subscription.Close)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-receiveCtx.Done():
+		case <-subscription.Done():
+		}
+		cancel()
+		subscription.Close(nil)
+	}()
+	return subscription, nil
+}
+
+// Ack deletes the message from the SQS queue, possibly batched with other deletions, then its offloaded body
+func (b *SqsBroker) Ack(ctx context.Context, delivery model.NotificationMeta) error {
+	return b.sqs.AcknowledgeNotification(delivery)
+}
+
+// Extend changes the visibility timeout of the message, thus it stays hidden for visibilityTimeout counted from now
+func (b *SqsBroker) Extend(ctx context.Context, delivery model.NotificationMeta, visibilityTimeout time.Duration) error {
+	return b.sqs.ChangeMessageVisibility(delivery.QueueUrl, delivery.ReceiptHandle, int64(visibilityTimeout.Seconds()))
+}
+
+// Nack makes the message immediately visible for the consumers of the SQS queue
+func (b *SqsBroker) Nack(ctx context.Context, delivery model.NotificationMeta) error {
+	return b.sqs.ChangeMessageVisibility(delivery.QueueUrl, delivery.ReceiptHandle, 0)
+}
+
+// NackWithDelay makes the message visible again after delay (rounded up to seconds, at most the maximum visibility timeout)
+func (b *SqsBroker) NackWithDelay(ctx context.Context, delivery model.NotificationMeta, delay time.Duration) error {
+	seconds := int64(math.Ceil(delay.Seconds()))
+	if seconds > maxVisibilityTimeoutSeconds {
+		seconds = maxVisibilityTimeoutSeconds
+	}
+	return b.sqs.ChangeMessageVisibility(delivery.QueueUrl, delivery.ReceiptHandle, seconds)
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"go.uber.org/zap"
+	commonmodel "notification-service/common/common-model"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeQueues keeps the tags and the message counts of the queues, keyed by URL
+type fakeQueues struct {
+	SqsServiceInterface
+	tags   map[string]map[string]string
+	counts map[string]int
+}
+
+func newFakeQueues(urls ...string) *fakeQueues {
+	f := &fakeQueues{tags: make(map[string]map[string]string), counts: make(map[string]int)}
+	for _, url := range urls {
+		f.tags[url] = make(map[string]string)
+	}
+	return f
+}
+
+func (f *fakeQueues) CreateMessageQueue(queueName string, delaySeconds, retentionPeriodSeconds, maxReceiveCount *int, deadLetterQueueArn *string) (queueUrl *string, err error) {
+	url := "https://sqs.local/" + queueName
+	f.tags[url] = make(map[string]string)
+	return &url, nil
+}
+
+func (f *fakeQueues) GetQueueArn(queueUrl string) (queueArn *string, err error) {
+	return &queueUrl, nil
+}
+
+func (f *fakeQueues) GetQueueUrl(queueName string) (queueUrl *string, err error) {
+	url := "https://sqs.local/" + queueName
+	if _, ok := f.tags[url]; !ok {
+		return nil, commonmodel.ErrSqsUnexpected
+	}
+	return &url, nil
+}
+
+func (f *fakeQueues) DeleteMessageQueue(queueUrl string) (err error) {
+	delete(f.tags, queueUrl)
+	return nil
+}
+
+func (f *fakeQueues) TagMessageQueue(queueUrl string, tags map[string]string) (err error) {
+	for key, value := range tags {
+		f.tags[queueUrl][key] = value
+	}
+	return nil
+}
+
+func (f *fakeQueues) GetQueueTags(queueUrl string) (tags map[string]string, err error) {
+	return f.tags[queueUrl], nil
+}
+
+func (f *fakeQueues) CountMessages(queueUrl string) (count int, err error) {
+	return f.counts[queueUrl], nil
+}
+
+func TestDeadLetterQueueName(t *testing.T) {
+	if name := DeadLetterQueueName("queue"); name != "queue-dlq" {
+		t.Fatalf("unexpected name: %v", name)
+	}
+	if name := DeadLetterQueueName("queue.fifo"); name != "queue-dlq.fifo" {
+		t.Fatalf("unexpected name of the FIFO dead-letter-queue: %v", name)
+	}
+}
+
+func TestPairedDeadLetterQueueIsRetiredWithItsQueue(t *testing.T) {
+	fake := newFakeQueues()
+	b := NewSqsBroker(fake, 30, SqsQueueConfig{CreateDeadLetterQueue: true}, zap.NewNop())
+	queueUrl, err := b.CreateDestination("queue")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	deadLetterQueueUrl := "https://sqs.local/queue-dlq"
+	if fake.tags[deadLetterQueueUrl][PairedQueueTag] != "queue" {
+		t.Fatalf("the dead-letter-queue is not tagged: %v", fake.tags[deadLetterQueueUrl])
+	}
+	if err := b.DeleteDestination(queueUrl); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := fake.tags[queueUrl]; ok {
+		t.Fatalf("the queue has not been deleted")
+	}
+	if _, ok := fake.tags[deadLetterQueueUrl][RetiredAtTag]; !ok {
+		t.Fatalf("the dead-letter-queue is not tagged as retired: %v", fake.tags[deadLetterQueueUrl])
+	}
+}
+
+func TestDeleteDrainedDeadLetterQueue(t *testing.T) {
+	retiredAt := strconv.FormatInt(time.Now().Add(-2*retiredQueueGracePeriod).Unix(), 10)
+	fake := newFakeQueues("active", "recent", "pending", "drained")
+	fake.tags["recent"][RetiredAtTag] = strconv.FormatInt(time.Now().Unix(), 10)
+	fake.tags["pending"][RetiredAtTag] = retiredAt
+	fake.counts["pending"] = 1
+	fake.tags["drained"][RetiredAtTag] = retiredAt
+	b := NewSqsBroker(fake, 30, SqsQueueConfig{CreateDeadLetterQueue: true}, zap.NewNop())
+	for queueUrl, expected := range map[string]bool{"active": false, "recent": false, "pending": false, "drained": true} {
+		deleted, err := b.DeleteDrainedDeadLetterQueue(queueUrl)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if deleted != expected {
+			t.Fatalf("unexpected result for %v: %v", queueUrl, deleted)
+		}
+	}
+}
+
+func TestIsDeadLetterQueue(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"https://sqs.local/queue-dlq":      true,
+		"https://sqs.local/queue-dlq.fifo": true,
+		"https://sqs.local/queue":          false,
+		"https://sqs.local/queue.fifo":     false,
+	} {
+		if IsDeadLetterQueue(name) != expected {
+			t.Fatalf("unexpected result for %v", name)
+		}
+	}
+}
@@ -1,67 +1,159 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
+	"notification-service/common/circuit"
 	commonmodel "notification-service/common/common-model"
+	"notification-service/common/storage"
 	"notification-service/model"
 	"reflect"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const MaxMessageBodySize = 262144
 
+// maxVisibilityTimeoutSeconds is the longest visibility timeout SQS accepts
+const maxVisibilityTimeoutSeconds = 43200
+
+// DefaultMaxReceiveCount is the number of receives after which a message is moved to the dead-letter-queue, if not specified
+const DefaultMaxReceiveCount = 5
+
+// redrivePolicy is the JSON document of the RedrivePolicy queue attribute
+type redrivePolicy struct {
+	DeadLetterTargetArn string `json:"deadLetterTargetArn"`
+	MaxReceiveCount     string `json:"maxReceiveCount"`
+}
+
+// FifoQueueSuffix is the mandatory suffix of the names (and thus the URLs) of the FIFO queues
+const FifoQueueSuffix = ".fifo"
+
+// SqsConfig contains the tunable parameters of SqsService
+// ReceiveBatchSize is the maximum number of messages received by a single request (1-10)
+// DeleteBatchWindow is the time the deletions are collected for a DeleteMessageBatch request, 0 disables the batching
+// CircuitFailureThreshold is the number of consecutive failed receive requests after which the circuit breaker opens
+// CircuitOpenDuration is the time the circuit breaker stays open before a new receive request is attempted
+// BackoffBase and BackoffMax are the bounds of the jittered exponential delay between failed receive requests
+// PayloadStore is optional, if it is set the notification bodies longer than PayloadOffloadThreshold bytes are stored in it
+// and only their pointers are sent through the queue
+type SqsConfig struct {
+	ReceiveBatchSize        int64
+	DeleteBatchWindow       time.Duration
+	CircuitFailureThreshold int
+	CircuitOpenDuration     time.Duration
+	BackoffBase             time.Duration
+	BackoffMax              time.Duration
+	PayloadStore            storage.PayloadStore
+	PayloadOffloadThreshold int
+}
+
 type SqsService struct {
-	session *session.Session
-	sqs     *sqs.SQS
-	log     *zap.Logger
-	//Todo: add some kind of circuit breaker logic, to avoid infinite high frequency retrying in case of network issues
+	session          *session.Session
+	sqs              *sqs.SQS
+	log              *zap.Logger
+	receiveBatchSize int64
+	deleter          *BatchDeleter
+	breaker          *circuit.Breaker
+	backoffBase      time.Duration
+	backoffMax       time.Duration
+	payloads         storage.PayloadStore
+	offloadThreshold int
 }
 
 type SqsServiceInterface interface {
 	SendMessageToQueue(queueUrl string, message string, messageAttributes *map[string]interface{}) (messageId *string, err error)
+	SendFifoMessageToQueue(queueUrl string, message string, messageAttributes *map[string]interface{}, groupId, deduplicationId string) (messageId *string, err error)
 	SendNotificationToQueue(meta model.NotificationMeta) (messageId *string, err error)
-	ReceiveMessage(done *chan interface{}, c *chan sqs.Message, queueUrl *string, visibilityTimeout int64) (err error)
-	ReceiveNotification(done *chan interface{}, c *chan model.NotificationMeta, queueUrl *string, visibilityTimeout int64) (err error)
+	ReceiveMessage(ctx context.Context, c chan<- sqs.Message, queueUrl string, visibilityTimeout int64, onTerminated func(err error)) (err error)
+	ReceiveNotification(ctx context.Context, c chan<- model.NotificationMeta, queueUrl string, visibilityTimeout int64, onTerminated func(err error)) (err error)
 	CreateMessageQueue(queueName string, delaySeconds, retentionPeriodSeconds, maxReceiveCount *int, deadLetterQueueArn *string) (queueUrl *string, err error)
+	GetQueueUrl(queueName string) (queueUrl *string, err error)
+	GetQueueArn(queueUrl string) (queueArn *string, err error)
+	CountMessages(queueUrl string) (count int, err error)
+	DeleteMessageQueue(queueUrl string) (err error)
+	ListMessageQueues(queueNamePrefix string) (queueUrls []string, err error)
+	TagMessageQueue(queueUrl string, tags map[string]string) (err error)
+	GetQueueTags(queueUrl string) (tags map[string]string, err error)
 	DeleteMessage(queueUrl string, receiptHandle string) (err error)
+	DeleteMessageBatch(queueUrl string, receiptHandles []string) (failed []BatchDeleteFailure, err error)
+	AcknowledgeMessage(queueUrl string, receiptHandle string) (err error)
+	AcknowledgeNotification(delivery model.NotificationMeta) (err error)
+	ChangeMessageVisibility(queueUrl string, receiptHandle string, visibilityTimeout int64) (err error)
+	CircuitState() circuit.State
+	Close()
 }
 
 // NewSqsService is a factory function that creates a new SqsService instance
-func NewSqsService(logger *zap.Logger) (sqsService *SqsService) {
+func NewSqsService(logger *zap.Logger, config SqsConfig) (sqsService *SqsService) {
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable}))
 	sqsBuff := sqs.New(sess)
-	return &SqsService{
-		session: sess,
-		sqs:     sqsBuff,
-		log:     logger,
+	if config.ReceiveBatchSize < 1 || config.ReceiveBatchSize > MaxBatchSize {
+		logger.Fatal("Invalid receive batch size", zap.Int64("receiveBatchSize", config.ReceiveBatchSize))
+	}
+	if config.BackoffBase <= 0 || config.BackoffMax < config.BackoffBase {
+		logger.Fatal("Invalid backoff configuration", zap.Duration("backoffBase", config.BackoffBase), zap.Duration("backoffMax", config.BackoffMax))
+	}
+	sqsService = &SqsService{
+		session:          sess,
+		sqs:              sqsBuff,
+		log:              logger,
+		receiveBatchSize: config.ReceiveBatchSize,
+		backoffBase:      config.BackoffBase,
+		backoffMax:       config.BackoffMax,
+		payloads:         config.PayloadStore,
+		offloadThreshold: config.PayloadOffloadThreshold,
+	}
+	sqsService.breaker = circuit.NewBreaker(config.CircuitFailureThreshold, config.CircuitOpenDuration, func(from, to circuit.State) {
+		if to == circuit.Open {
+			logger.Error("SQS circuit breaker opened", zap.String("from", from.String()), zap.Duration("openDuration", config.CircuitOpenDuration))
+		} else {
+			logger.Info("SQS circuit breaker state changed", zap.String("from", from.String()), zap.String("to", to.String()))
+		}
+	})
+	if config.DeleteBatchWindow > 0 {
+		sqsService.deleter = NewBatchDeleter(sqsService, config.DeleteBatchWindow, logger)
 	}
+	return sqsService
 }
 
 // SendMessageToQueue sends a message to the given SQS queue
 // It performs basic validation on the provided arguments and returns an error if the message is too long or the queue name is too short
 // An case of successful message sending, it returns the message id
 func (s *SqsService) SendMessageToQueue(queueUrl string, message string, messageAttributes *map[string]interface{}) (messageId *string, err error) {
-	if len(queueUrl) < 5 || len(message) < 5 {
-		s.log.Error("Queue name or message is too short", zap.String("queueUrl", queueUrl), zap.String("message", message))
-		return nil, commonmodel.ErrInvalidArgument
-	}
-	if messageValidation := validateSqsMessage(message); messageValidation != nil {
-		if errors.Is(messageValidation, commonmodel.ErrContentTooLong) {
-			s.log.Error("Message too long", zap.String("queueUrl", queueUrl), zap.String("message", message))
-		}
-		return nil, commonmodel.ErrContentTooLong
+	input, err := s.createSendMessageInput(queueUrl, message, messageAttributes)
+	if err != nil {
+		return nil, err
 	}
-	input := sqs.SendMessageInput{
-		MessageBody: &message,
-		QueueUrl:    &queueUrl,
+	return s.sendMessage(input)
+}
+
+// SendFifoMessageToQueue sends a message to the given FIFO queue
+// The messages with the same groupId are delivered in the order they were sent, the messages with the same deduplicationId
+// sent within the 5 minutes deduplication interval are accepted but only delivered once
+func (s *SqsService) SendFifoMessageToQueue(queueUrl string, message string, messageAttributes *map[string]interface{}, groupId, deduplicationId string) (messageId *string, err error) {
+	input, err := s.createSendMessageInput(queueUrl, message, messageAttributes)
+	if err != nil {
+		return nil, err
 	}
+	return s.sendFifoMessage(input, groupId, deduplicationId)
+}
+
+// createSendMessageInput validates the arguments of the message sending and creates the corresponding input
+func (s *SqsService) createSendMessageInput(queueUrl string, message string, messageAttributes *map[string]interface{}) (input *sqs.SendMessageInput, err error) {
+	var inputAttributes map[string]*sqs.MessageAttributeValue
 	if messageAttributes != nil {
-		inputAttributes := make(map[string]*sqs.MessageAttributeValue)
+		inputAttributes = make(map[string]*sqs.MessageAttributeValue)
 		for key, value := range *messageAttributes {
 			valueType := reflect.TypeOf(value)
 			switch valueType.Kind() {
@@ -74,7 +166,7 @@ func (s *SqsService) SendMessageToQueue(queueUrl string, message string, message
 			case reflect.Int, reflect.Float64, reflect.Int64:
 				inputAttributes[key] = &sqs.MessageAttributeValue{
 					DataType:    aws.String("Number"),
-					StringValue: aws.String(value.(string)),
+					StringValue: aws.String(fmt.Sprint(value)),
 				}
 				break
 			default:
@@ -83,123 +175,234 @@ func (s *SqsService) SendMessageToQueue(queueUrl string, message string, message
 			}
 		}
 	}
-	result, err := s.sqs.SendMessage(&input)
+	return s.newSendMessageInput(queueUrl, message, inputAttributes)
+}
+
+// newSendMessageInput validates the queue URL and the message, and creates the input of sending it with the given attributes
+func (s *SqsService) newSendMessageInput(queueUrl string, message string, messageAttributes map[string]*sqs.MessageAttributeValue) (input *sqs.SendMessageInput, err error) {
+	if len(queueUrl) < 5 || len(message) < 5 {
+		s.log.Error("Queue name or message is too short", zap.String("queueUrl", queueUrl), zap.String("message", message))
+		return nil, commonmodel.ErrInvalidArgument
+	}
+	if messageValidation := validateSqsMessage(message); messageValidation != nil {
+		if errors.Is(messageValidation, commonmodel.ErrContentTooLong) {
+			s.log.Error("Message too long", zap.String("queueUrl", queueUrl), zap.String("message", message))
+		}
+		return nil, commonmodel.ErrContentTooLong
+	}
+	return &sqs.SendMessageInput{
+		MessageBody:       &message,
+		QueueUrl:          &queueUrl,
+		MessageAttributes: messageAttributes,
+	}, nil
+}
+
+// sendFifoMessage validates the FIFO parameters of the message, then sends it
+func (s *SqsService) sendFifoMessage(input *sqs.SendMessageInput, groupId, deduplicationId string) (messageId *string, err error) {
+	queueUrl := aws.StringValue(input.QueueUrl)
+	if !IsFifoQueue(queueUrl) || len(groupId) == 0 || len(groupId) > 128 || len(deduplicationId) == 0 || len(deduplicationId) > 128 {
+		s.log.Error("Invalid FIFO message", zap.String("queueUrl", queueUrl), zap.String("groupId", groupId), zap.String("deduplicationId", deduplicationId))
+		return nil, commonmodel.ErrInvalidArgument
+	}
+	input.MessageGroupId = aws.String(groupId)
+	input.MessageDeduplicationId = aws.String(deduplicationId)
+	return s.sendMessage(input)
+}
+
+// sendMessage sends the message described by input
+func (s *SqsService) sendMessage(input *sqs.SendMessageInput) (messageId *string, err error) {
+	result, err := s.sqs.SendMessage(input)
 	if err != nil {
-		s.log.Error("Error while sending message", zap.String("queueUrl", queueUrl), zap.String("message", message), zap.Any("error", err))
+		s.log.Error("Error while sending message", zap.String("queueUrl", aws.StringValue(input.QueueUrl)), zap.String("message", aws.StringValue(input.MessageBody)), zap.Any("error", err))
 		return nil, commonmodel.ErrSqsUnexpected
 	}
 	return result.MessageId, nil
 }
 
 // SendNotificationToQueue sends a notification to the given SQS queue
-// It calls SendMessageToQueue internally, therefore performs basic validation on the provided arguments and returns an error if the message is too long or the queue name is too short
+// The message attributes are the ones of model.NotificationMessageAttributes, it performs basic validation on the provided arguments and returns an error if the message is too long or the queue name is too short
+// If the queue is a FIFO queue, the notifications are grouped by the addressee (thus their order is kept per user) and
+// deduplicated by the notification id
+// If a payload store is configured, the bodies longer than the offload threshold are stored in it, and the message only
+// carries the pointer of the body
 // An case of successful message sending, it returns the message id
 func (s *SqsService) SendNotificationToQueue(meta model.NotificationMeta) (messageId *string, err error) {
-	messageAttributes := map[string]interface{}{
-		"id":        meta.Notification.Id,
-		"addressee": meta.Notification.Addressee,
-		"subject":   meta.Notification.Subject,
+	messageAttributes := model.NotificationMessageAttributes(meta.Notification)
+	body := meta.Notification.Body
+	if s.payloads != nil && len(body) > s.offloadThreshold {
+		key := meta.Notification.Id
+		if key == "" {
+			key = uuid.New().String()
+		}
+		pointer, err := s.payloads.Put(context.Background(), key, body)
+		if err != nil {
+			return nil, err
+		}
+		s.log.Debug("Notification body offloaded", zap.String("queueUrl", meta.QueueUrl), zap.String("pointer", pointer), zap.Int("size", len(body)))
+		messageAttributes[model.PayloadPointerAttribute] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(pointer)}
+		body = pointer
 	}
-	return s.SendMessageToQueue(meta.QueueUrl, meta.Notification.Body, &messageAttributes)
+	input, err := s.newSendMessageInput(meta.QueueUrl, body, messageAttributes)
+	if err != nil {
+		return nil, err
+	}
+	if IsFifoQueue(meta.QueueUrl) {
+		return s.sendFifoMessage(input, meta.Notification.Addressee, meta.Notification.Id)
+	}
+	return s.sendMessage(input)
 }
 
 // ReceiveMessage allows to receive messages from a given SQS queue
-// done is a channel that can be used to stop the receiving process (since the AWS SDK does not provide a way to stop the receiving process, it might take up to "maximum polling period" to stop)
+// ctx controls the receiving process, cancelling it aborts the in-flight long polling request and stops the receiving goroutine
 // c is the channel where the received messages are delivered to
 // queueUrl is the URL of the queue to receive messages from
 // visibilityTimeout is the maximum time the message is hidden from other consumers after it is received
-func (s *SqsService) ReceiveMessage(done *chan interface{}, c *chan sqs.Message, queueUrl *string, visibilityTimeout int64) (err error) {
-	if visibilityTimeout < 0 || visibilityTimeout > 43200 {
+// onTerminated is called (if not nil) when the receiving stops because of a non-retryable error, e.g.: the queue has been deleted
+// Failed requests are retried with jittered exponential backoff, while the shared circuit breaker is open no requests are sent
+func (s *SqsService) ReceiveMessage(ctx context.Context, c chan<- sqs.Message, queueUrl string, visibilityTimeout int64, onTerminated func(err error)) (err error) {
+	if visibilityTimeout < 0 || visibilityTimeout > maxVisibilityTimeoutSeconds {
 		s.log.Error("Invalid visibility timeout", zap.Int64("visibilityTimeout", visibilityTimeout))
 		return commonmodel.ErrInvalidArgument
 	}
-	if queueUrl == nil || len(*queueUrl) < 5 {
-		s.log.Error("Invalid queue url", zap.String("queueUrl", *queueUrl))
+	if len(queueUrl) < 5 {
+		s.log.Error("Invalid queue url", zap.String("queueUrl", queueUrl))
 		return commonmodel.ErrInvalidArgument
 	}
-	terminated := false
-	go func(done *chan interface{}) {
-		<-*done
-		s.log.Debug("Stopping receiving messages", zap.String("queueUrl", *queueUrl))
-		terminated = true
-	}(done)
-	go func(c *chan sqs.Message, queueUrl *string, visibilityTimeout int64, terminated *bool) {
-		for !*terminated {
-			msgResult, err := s.sqs.ReceiveMessage(&sqs.ReceiveMessageInput{
+	go func() {
+		defer s.log.Debug("Stopped receiving messages", zap.String("queueUrl", queueUrl))
+		backoff := circuit.NewBackoff(s.backoffBase, s.backoffMax)
+		for ctx.Err() == nil {
+			if allowed, wait := s.breaker.Allow(); !allowed {
+				s.log.Debug("Circuit breaker open, waiting before receiving", zap.String("queueUrl", queueUrl), zap.Duration("wait", wait))
+				if !sleepWithContext(ctx, wait) {
+					return
+				}
+				continue
+			}
+			msgResult, err := s.sqs.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
 				AttributeNames: []*string{
 					aws.String(sqs.MessageSystemAttributeNameSentTimestamp),
+					aws.String(sqs.MessageSystemAttributeNameMessageGroupId),
 				},
 				MessageAttributeNames: []*string{
 					aws.String(sqs.QueueAttributeNameAll),
 				},
-				QueueUrl:            queueUrl,
-				MaxNumberOfMessages: aws.Int64(1),
+				QueueUrl:            &queueUrl,
+				MaxNumberOfMessages: aws.Int64(s.receiveBatchSize),
 				VisibilityTimeout:   aws.Int64(visibilityTimeout),
 			})
 			if err != nil {
-				s.log.Error("Error while receiving message", zap.String("queueUrl", *queueUrl), zap.Any("error", err))
-			} else {
-				s.log.Debug("Received message", zap.String("queueUrl", *queueUrl), zap.Any("quantity", len(msgResult.Messages)))
-				messages := msgResult.Messages
-				for _, message := range messages {
-					if !*terminated {
-						*c <- *message
-					} else {
-						s.log.Debug("Message not processed, consumer channel closed", zap.String("queueUrl", *queueUrl), zap.Any("id", message.MessageId))
+				if ctx.Err() != nil {
+					//The request has been aborted by the cancellation, it is not a failure of SQS
+					s.breaker.Cancel()
+					return
+				}
+				if isNonRetryableError(err) {
+					//SQS has answered the request, thus it is available
+					s.breaker.Success()
+					s.log.Error("Non-retryable error while receiving message, stopping", zap.String("queueUrl", queueUrl), zap.Any("error", err))
+					if onTerminated != nil {
+						onTerminated(commonmodel.ErrSqsQueueDoesNotExist)
 					}
+					return
+				}
+				s.breaker.Failure()
+				delay := backoff.Next()
+				s.log.Error("Error while receiving message", zap.String("queueUrl", queueUrl), zap.Duration("retryIn", delay), zap.Any("error", err))
+				if !sleepWithContext(ctx, delay) {
+					return
+				}
+				continue
+			}
+			s.breaker.Success()
+			backoff.Reset()
+			s.log.Debug("Received message", zap.String("queueUrl", queueUrl), zap.Any("quantity", len(msgResult.Messages)))
+			for i, message := range msgResult.Messages {
+				select {
+				case c <- *message:
+				case <-ctx.Done():
+					s.releaseMessages(queueUrl, msgResult.Messages[i:])
+					return
 				}
 			}
 		}
-		s.log.Debug("Stopped receiving messages", zap.String("queueUrl", *queueUrl))
-	}(c, queueUrl, visibilityTimeout, &terminated)
-	s.log.Debug("Started receiving messages", zap.String("queueUrl", *queueUrl))
+	}()
+	s.log.Debug("Started receiving messages", zap.String("queueUrl", queueUrl))
 	return nil
 }
 
 // ReceiveNotification allows to receive notifications from a given SQS queue
-// done is a channel that can be used to stop the receiving process (since the AWS SDK does not provide a way to stop the receiving process, it might take up to "maximum polling period" to stop)
+// ctx controls the receiving process, cancelling it aborts the in-flight long polling request and stops the receiving goroutines
 // c is the channel where the received notifications are delivered to
 // queueUrl is the URL of the queue to receive messages from
 // visibilityTimeout is the maximum time the message is hidden from other consumers after it is received
-func (s *SqsService) ReceiveNotification(done *chan interface{}, c *chan model.NotificationMeta, queueUrl *string, visibilityTimeout int64) (err error) {
+// onTerminated is called (if not nil) when the receiving stops because of a non-retryable error, see ReceiveMessage
+func (s *SqsService) ReceiveNotification(ctx context.Context, c chan<- model.NotificationMeta, queueUrl string, visibilityTimeout int64, onTerminated func(err error)) (err error) {
 	sqsMessageChannel := make(chan sqs.Message)
-	internalDone := make(chan interface{})
-	err = s.ReceiveMessage(&internalDone, &sqsMessageChannel, queueUrl, visibilityTimeout)
+	err = s.ReceiveMessage(ctx, sqsMessageChannel, queueUrl, visibilityTimeout, onTerminated)
 	if err != nil {
 		return err
 	}
-	go func(c *chan model.NotificationMeta, queueUrl *string, visibilityTimeout int64) {
+	var resolvePayload model.PayloadResolver
+	if s.payloads != nil {
+		resolvePayload = func(pointer string) (string, error) {
+			return s.payloads.Get(ctx, pointer)
+		}
+	}
+	go func() {
 		for {
 			select {
-			case <-*done:
-				internalDone <- nil
-				close(internalDone)
-				close(sqsMessageChannel)
+			case <-ctx.Done():
 				return //Stop the loop
 			case message := <-sqsMessageChannel:
-				s.log.Debug("Received message", zap.String("queueUrl", *queueUrl), zap.Any("message", message))
-				notification, err := model.CreateNotification(message)
-				if err != nil {
-					s.log.Error("Invalid notification received... Removing from queue", zap.String("queueUrl", *queueUrl), zap.String("message", message.GoString()), zap.Any("error", err))
-					err := s.DeleteMessage(*queueUrl, *message.ReceiptHandle)
+				s.log.Debug("Received message", zap.String("queueUrl", queueUrl), zap.Any("message", message))
+				notification, err := model.CreateNotification(message, resolvePayload)
+				if errors.Is(err, commonmodel.ErrPayloadUnavailable) {
+					//The message itself is valid, it is kept in the queue and received again when its visibility timeout expires
+					s.log.Error("Payload of the notification is not available", zap.String("queueUrl", queueUrl), zap.Any("id", message.MessageId), zap.Any("error", err))
+					continue
+				} else if err != nil {
+					s.log.Error("Invalid notification received... Removing from queue", zap.String("queueUrl", queueUrl), zap.String("message", message.GoString()), zap.Any("error", err))
+					err := s.DeleteMessage(queueUrl, *message.ReceiptHandle)
 					if err != nil {
-						s.log.Error("Error while deleting message", zap.String("queueUrl", *queueUrl), zap.String("message", message.GoString()), zap.Any("error", err))
+						s.log.Error("Error while deleting message", zap.String("queueUrl", queueUrl), zap.String("message", message.GoString()), zap.Any("error", err))
 					}
 					continue
 				}
-				*c <- model.CreateNotificationMeta(notification, *message.ReceiptHandle, *queueUrl)
+				meta := model.CreateNotificationMeta(notification, *message.ReceiptHandle, queueUrl)
+				meta.GroupId = aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+				if pointer := message.MessageAttributes[model.PayloadPointerAttribute]; pointer != nil {
+					meta.PayloadPointer = aws.StringValue(pointer.StringValue)
+				}
+				select {
+				case c <- meta:
+				case <-ctx.Done():
+					s.releaseMessages(queueUrl, []*sqs.Message{&message})
+					return
+				}
 			}
 		}
-	}(c, queueUrl, visibilityTimeout)
+	}()
 	return nil
 }
 
 // CreateMessageQueue creates a new SQS queue with the given name and attributes
+// If the name ends with FifoQueueSuffix a FIFO queue is created
+// If deadLetterQueueArn is provided, the messages received more than maxReceiveCount times (DefaultMaxReceiveCount if nil)
+// are moved to the dead-letter-queue by the redrive policy of the queue
 func (s *SqsService) CreateMessageQueue(queueName string, delaySeconds, retentionPeriodSeconds, maxReceiveCount *int, deadLetterQueueArn *string) (queueUrl *string, err error) {
 	if len(queueName) < 5 {
 		s.log.Error("Queue name is too short", zap.String("queueName", queueName))
 		return nil, commonmodel.ErrInvalidArgument
 	}
+	if retentionPeriodSeconds != nil && (*retentionPeriodSeconds < 60 || *retentionPeriodSeconds > 1209600) {
+		s.log.Error("Invalid retention period", zap.String("queueName", queueName), zap.Int("retentionPeriodSeconds", *retentionPeriodSeconds))
+		return nil, commonmodel.ErrInvalidArgument
+	}
+	if maxReceiveCount != nil && (deadLetterQueueArn == nil || *maxReceiveCount < 1 || *maxReceiveCount > 1000) {
+		s.log.Error("Invalid max receive count, it requires a dead-letter-queue", zap.String("queueName", queueName), zap.Int("maxReceiveCount", *maxReceiveCount))
+		return nil, commonmodel.ErrInvalidArgument
+	}
 	attributes := make(map[string]*string)
 	if delaySeconds != nil {
 		attributes["DelaySeconds"] = aws.String(strconv.Itoa(*delaySeconds))
@@ -208,12 +411,23 @@ func (s *SqsService) CreateMessageQueue(queueName string, delaySeconds, retentio
 		attributes["MessageRetentionPeriod"] = aws.String(strconv.Itoa(*retentionPeriodSeconds))
 	}
 	if deadLetterQueueArn != nil {
-		attributes["deadLetterTargetArn"] = deadLetterQueueArn
-	}
-	if maxReceiveCount != nil {
-		attributes["maxReceiveCount"] = aws.String(strconv.Itoa(*maxReceiveCount))
+		receiveCount := DefaultMaxReceiveCount
+		if maxReceiveCount != nil {
+			receiveCount = *maxReceiveCount
+		}
+		redrivePolicy, err := json.Marshal(redrivePolicy{
+			DeadLetterTargetArn: *deadLetterQueueArn,
+			MaxReceiveCount:     strconv.Itoa(receiveCount),
+		})
+		if err != nil {
+			return nil, commonmodel.ErrInvalidArgument
+		}
+		attributes[sqs.QueueAttributeNameRedrivePolicy] = aws.String(string(redrivePolicy))
 	}
 	attributes["ReceiveMessageWaitTimeSeconds"] = aws.String("20")
+	if IsFifoQueue(queueName) {
+		attributes["FifoQueue"] = aws.String("true")
+	}
 
 	s.log.Debug("Creating queue", zap.String("queueName", queueName), zap.Any("attributes", attributes))
 	result, err := s.sqs.CreateQueue(&sqs.CreateQueueInput{
@@ -227,6 +441,113 @@ func (s *SqsService) CreateMessageQueue(queueName string, delaySeconds, retentio
 	return result.QueueUrl, nil
 }
 
+// GetQueueArn returns the ARN of the SQS queue, which is needed to refer to it as a dead-letter-queue
+func (s *SqsService) GetQueueArn(queueUrl string) (queueArn *string, err error) {
+	result, err := s.sqs.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       &queueUrl,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+	})
+	if err != nil {
+		s.log.Error("Error while getting queue ARN", zap.String("queueUrl", queueUrl), zap.Any("error", err))
+		return nil, commonmodel.ErrSqsUnexpected
+	}
+	queueArn, ok := result.Attributes[sqs.QueueAttributeNameQueueArn]
+	if !ok || queueArn == nil {
+		return nil, commonmodel.ErrSqsUnexpected
+	}
+	return queueArn, nil
+}
+
+// CountMessages returns the approximate number of messages of the SQS queue, including the in-flight and the delayed ones
+func (s *SqsService) CountMessages(queueUrl string) (count int, err error) {
+	attributeNames := []string{
+		sqs.QueueAttributeNameApproximateNumberOfMessages,
+		sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+		sqs.QueueAttributeNameApproximateNumberOfMessagesDelayed,
+	}
+	result, err := s.sqs.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       &queueUrl,
+		AttributeNames: aws.StringSlice(attributeNames),
+	})
+	if err != nil {
+		s.log.Error("Error while getting queue attributes", zap.String("queueUrl", queueUrl), zap.Any("error", err))
+		return 0, commonmodel.ErrSqsUnexpected
+	}
+	for _, name := range attributeNames {
+		value, err := strconv.Atoi(aws.StringValue(result.Attributes[name]))
+		if err != nil {
+			return 0, commonmodel.ErrSqsUnexpected
+		}
+		count += value
+	}
+	return count, nil
+}
+
+// GetQueueUrl returns the URL of the SQS queue with the given name
+func (s *SqsService) GetQueueUrl(queueName string) (queueUrl *string, err error) {
+	result, err := s.sqs.GetQueueUrl(&sqs.GetQueueUrlInput{
+		QueueName: &queueName,
+	})
+	if err != nil {
+		s.log.Error("Error while getting queue url", zap.String("queueName", queueName), zap.Any("error", err))
+		return nil, commonmodel.ErrSqsUnexpected
+	}
+	return result.QueueUrl, nil
+}
+
+// DeleteMessageQueue deletes the given SQS queue together with its messages
+func (s *SqsService) DeleteMessageQueue(queueUrl string) (err error) {
+	_, err = s.sqs.DeleteQueue(&sqs.DeleteQueueInput{
+		QueueUrl: &queueUrl,
+	})
+	if err != nil {
+		s.log.Error("Error while deleting queue", zap.String("queueUrl", queueUrl), zap.Any("error", err))
+		return commonmodel.ErrSqsUnexpected
+	}
+	return nil
+}
+
+// ListMessageQueues returns the URLs of all the SQS queues whose name starts with the given prefix
+func (s *SqsService) ListMessageQueues(queueNamePrefix string) (queueUrls []string, err error) {
+	err = s.sqs.ListQueuesPages(&sqs.ListQueuesInput{
+		QueueNamePrefix: &queueNamePrefix,
+		MaxResults:      aws.Int64(1000),
+	}, func(page *sqs.ListQueuesOutput, lastPage bool) bool {
+		queueUrls = append(queueUrls, aws.StringValueSlice(page.QueueUrls)...)
+		return true
+	})
+	if err != nil {
+		s.log.Error("Error while listing queues", zap.String("queueNamePrefix", queueNamePrefix), zap.Any("error", err))
+		return nil, commonmodel.ErrSqsUnexpected
+	}
+	return queueUrls, nil
+}
+
+// TagMessageQueue adds the given tags to the SQS queue, the existing tags with the same keys are overwritten
+func (s *SqsService) TagMessageQueue(queueUrl string, tags map[string]string) (err error) {
+	_, err = s.sqs.TagQueue(&sqs.TagQueueInput{
+		QueueUrl: &queueUrl,
+		Tags:     aws.StringMap(tags),
+	})
+	if err != nil {
+		s.log.Error("Error while tagging queue", zap.String("queueUrl", queueUrl), zap.Any("error", err))
+		return commonmodel.ErrSqsUnexpected
+	}
+	return nil
+}
+
+// GetQueueTags returns the tags of the SQS queue
+func (s *SqsService) GetQueueTags(queueUrl string) (tags map[string]string, err error) {
+	result, err := s.sqs.ListQueueTags(&sqs.ListQueueTagsInput{
+		QueueUrl: &queueUrl,
+	})
+	if err != nil {
+		s.log.Error("Error while getting queue tags", zap.String("queueUrl", queueUrl), zap.Any("error", err))
+		return nil, commonmodel.ErrSqsUnexpected
+	}
+	return aws.StringValueMap(result.Tags), nil
+}
+
 // DeleteMessage deletes a message from the given SQS queue
 // queueUrl is the URL of the queue to delete the message from
 // receiptHandle is the receipt handle of the message to delete
@@ -242,6 +563,157 @@ func (s *SqsService) DeleteMessage(queueUrl string, receiptHandle string) (err e
 	return nil
 }
 
+// DeleteMessageBatch deletes up to MaxBatchSize messages from the given SQS queue with a single request
+// The receipt handles which could not be deleted are returned in failed, err is only set if the whole request failed
+func (s *SqsService) DeleteMessageBatch(queueUrl string, receiptHandles []string) (failed []BatchDeleteFailure, err error) {
+	if len(receiptHandles) == 0 || len(receiptHandles) > MaxBatchSize {
+		s.log.Error("Invalid number of receipt handles", zap.Int("quantity", len(receiptHandles)))
+		return nil, commonmodel.ErrInvalidArgument
+	}
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, 0, len(receiptHandles))
+	for i := range receiptHandles {
+		entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: &receiptHandles[i],
+		})
+	}
+	result, err := s.sqs.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: &queueUrl,
+		Entries:  entries,
+	})
+	if err != nil {
+		s.log.Error("Error while deleting messages", zap.String("queueUrl", queueUrl), zap.Int("quantity", len(receiptHandles)), zap.Any("error", err))
+		return nil, commonmodel.ErrSqsUnexpected
+	}
+	for _, entry := range result.Failed {
+		index, err := strconv.Atoi(aws.StringValue(entry.Id))
+		if err != nil || index < 0 || index >= len(receiptHandles) {
+			continue
+		}
+		failed = append(failed, BatchDeleteFailure{
+			ReceiptHandle: receiptHandles[index],
+			Code:          aws.StringValue(entry.Code),
+			Message:       aws.StringValue(entry.Message),
+			SenderFault:   aws.BoolValue(entry.SenderFault),
+		})
+		s.log.Error("Error while deleting message", zap.String("queueUrl", queueUrl), zap.String("receiptHandle", receiptHandles[index]), zap.String("code", aws.StringValue(entry.Code)))
+	}
+	return failed, nil
+}
+
+// AcknowledgeMessage deletes the message from the queue after it has been processed
+// If the batch deletion is enabled, the message is deleted together with the other messages of the queue acknowledged
+// within the batch window, otherwise it is deleted immediately. In both cases it returns only after the deletion, thus a
+// nil error means that the message has been deleted
+func (s *SqsService) AcknowledgeMessage(queueUrl string, receiptHandle string) (err error) {
+	return s.acknowledge(queueUrl, receiptHandle, nil)
+}
+
+// AcknowledgeNotification deletes the message of the delivered notification from the queue (see AcknowledgeMessage), then
+// its offloaded body from the payload store. The body is kept if the message could not be deleted, since it is delivered again
+func (s *SqsService) AcknowledgeNotification(delivery model.NotificationMeta) (err error) {
+	var onDeleted func()
+	if s.payloads != nil && delivery.PayloadPointer != "" {
+		onDeleted = func() {
+			if err := s.payloads.Delete(context.Background(), delivery.PayloadPointer); err != nil {
+				s.log.Warn("Payload of the delivered notification could not be deleted", zap.String("pointer", delivery.PayloadPointer), zap.Any("error", err))
+			}
+		}
+	}
+	return s.acknowledge(delivery.QueueUrl, delivery.ReceiptHandle, onDeleted)
+}
+
+// acknowledge deletes the message immediately or through the batch deleter and waits for the result, onDeleted (if not
+// nil) is called once the message has been deleted
+func (s *SqsService) acknowledge(queueUrl string, receiptHandle string, onDeleted func()) (err error) {
+	if s.deleter == nil {
+		err = s.DeleteMessage(queueUrl, receiptHandle)
+	} else {
+		done := make(chan error, 1)
+		s.deleter.Delete(queueUrl, receiptHandle, func(err error) {
+			done <- err
+		})
+		err = <-done
+	}
+	if err != nil {
+		return err
+	}
+	if onDeleted != nil {
+		onDeleted()
+	}
+	return nil
+}
+
+// ChangeMessageVisibility changes the visibility timeout of a received message
+// visibilityTimeout is the new timeout in seconds counted from now, 0 makes the message immediately available for other consumers
+func (s *SqsService) ChangeMessageVisibility(queueUrl string, receiptHandle string, visibilityTimeout int64) (err error) {
+	if visibilityTimeout < 0 || visibilityTimeout > maxVisibilityTimeoutSeconds {
+		s.log.Error("Invalid visibility timeout", zap.Int64("visibilityTimeout", visibilityTimeout))
+		return commonmodel.ErrInvalidArgument
+	}
+	_, err = s.sqs.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &queueUrl,
+		ReceiptHandle:     &receiptHandle,
+		VisibilityTimeout: aws.Int64(visibilityTimeout),
+	})
+	if err != nil {
+		s.log.Error("Error while changing message visibility", zap.String("queueUrl", queueUrl), zap.String("receiptHandle", receiptHandle), zap.Any("error", err))
+		return commonmodel.ErrSqsUnexpected
+	}
+	return nil
+}
+
+// Close sends the deletions collected by the batch deleter and waits for them, it should be called during shutdown
+func (s *SqsService) Close() {
+	if s.deleter != nil {
+		s.deleter.Flush()
+	}
+}
+
+// CircuitState returns the state of the circuit breaker protecting the receive requests
+func (s *SqsService) CircuitState() circuit.State {
+	return s.breaker.State()
+}
+
+// releaseMessages makes the received but undelivered messages immediately visible for the other consumers of the queue,
+// instead of keeping them hidden until their visibility timeout expires
+func (s *SqsService) releaseMessages(queueUrl string, messages []*sqs.Message) {
+	for _, message := range messages {
+		s.log.Debug("Message not processed, receiving stopped", zap.String("queueUrl", queueUrl), zap.Any("id", message.MessageId))
+		_ = s.ChangeMessageVisibility(queueUrl, aws.StringValue(message.ReceiptHandle), 0)
+	}
+}
+
+// sleepWithContext waits for the given duration, it returns false if ctx is cancelled in the meantime
+func sleepWithContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// isNonRetryableError reports whether the given error of the AWS SDK cannot be resolved by retrying the request
+func isNonRetryableError(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	switch awsErr.Code() {
+	case sqs.ErrCodeQueueDoesNotExist, "QueueDoesNotExist":
+		return true
+	}
+	return false
+}
+
+// IsFifoQueue reports whether the queue with the given name or URL is a FIFO queue
+func IsFifoQueue(queueNameOrUrl string) bool {
+	return strings.HasSuffix(queueNameOrUrl, FifoQueueSuffix)
+}
+
 // validateSqsMessage validates the given message body
 func validateSqsMessage(message string) error {
 	if len(message) > MaxMessageBodySize {
@@ -0,0 +1,14 @@
+package storage
+
+import "context"
+
+// PayloadStore stores the payloads which are too large to be sent through the message broker (claim-check pattern)
+// The message only carries the pointer returned by Put, which is resolved by Get on the receiving side
+type PayloadStore interface {
+	// Put stores the payload under the given key and returns the pointer referring to it
+	Put(ctx context.Context, key string, payload string) (pointer string, err error)
+	// Get returns the payload the pointer refers to
+	Get(ctx context.Context, pointer string) (payload string, err error)
+	// Delete removes the payload the pointer refers to, it is called once the notification has been delivered
+	Delete(ctx context.Context, pointer string) error
+}
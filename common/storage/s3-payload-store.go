@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+	"io"
+	commonmodel "notification-service/common/common-model"
+	"strings"
+)
+
+// s3PointerScheme is the prefix of the pointers referring to S3 objects (s3://bucket/key)
+const s3PointerScheme = "s3://"
+
+// S3PayloadStore is the PayloadStore implementation backed by an S3 compatible bucket (e.g. AWS S3, MinIO)
+// The objects are deleted when their notification is delivered, the ones whose notification is never delivered (e.g. it
+// expires in the queue or is moved to the dead-letter-queue) are expected to be removed by the lifecycle rules of the bucket
+type S3PayloadStore struct {
+	s3        *s3.S3
+	bucket    string
+	keyPrefix string
+	log       *zap.Logger
+}
+
+// S3Config contains the parameters of the S3PayloadStore
+// Endpoint overrides the AWS endpoint (e.g. http://localhost:9000 for a local MinIO), ForcePathStyle is needed by most of
+// the S3 compatible servers, the keys of the objects are prefixed with KeyPrefix
+type S3Config struct {
+	Bucket         string
+	KeyPrefix      string
+	Endpoint       string
+	ForcePathStyle bool
+}
+
+// NewS3PayloadStore is a factory function that creates a new S3PayloadStore instance
+func NewS3PayloadStore(logger *zap.Logger, config S3Config) *S3PayloadStore {
+	awsConfig := aws.NewConfig().WithS3ForcePathStyle(config.ForcePathStyle)
+	if config.Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(config.Endpoint)
+	}
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Config:            *awsConfig,
+	}))
+	return &S3PayloadStore{
+		s3:        s3.New(sess),
+		bucket:    config.Bucket,
+		keyPrefix: config.KeyPrefix,
+		log:       logger,
+	}
+}
+
+// Put uploads the payload as an object of the bucket
+func (p *S3PayloadStore) Put(ctx context.Context, key string, payload string) (pointer string, err error) {
+	objectKey := p.keyPrefix + key
+	_, err = p.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(p.bucket),
+		Key:         aws.String(objectKey),
+		Body:        strings.NewReader(payload),
+		ContentType: aws.String("text/plain; charset=utf-8"),
+	})
+	if err != nil {
+		p.log.Error("Error while storing payload", zap.String("bucket", p.bucket), zap.String("key", objectKey), zap.Any("error", err))
+		return "", commonmodel.ErrStorageUnexpected
+	}
+	return s3PointerScheme + p.bucket + "/" + objectKey, nil
+}
+
+// Get downloads the object the pointer refers to
+func (p *S3PayloadStore) Get(ctx context.Context, pointer string) (payload string, err error) {
+	bucket, key, ok := parseS3Pointer(pointer)
+	if !ok {
+		p.log.Error("Invalid payload pointer", zap.String("pointer", pointer))
+		return "", commonmodel.ErrInvalidArgument
+	}
+	result, err := p.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		p.log.Error("Error while loading payload", zap.String("pointer", pointer), zap.Any("error", err))
+		return "", commonmodel.ErrStorageUnexpected
+	}
+	defer result.Body.Close()
+	content, err := io.ReadAll(result.Body)
+	if err != nil {
+		p.log.Error("Error while reading payload", zap.String("pointer", pointer), zap.Any("error", err))
+		return "", commonmodel.ErrStorageUnexpected
+	}
+	return string(content), nil
+}
+
+// Delete removes the object the pointer refers to, the objects outside the bucket and the key prefix of the store (e.g.
+// uploaded by the publishers themselves) are left to their owners
+func (p *S3PayloadStore) Delete(ctx context.Context, pointer string) error {
+	bucket, key, ok := parseS3Pointer(pointer)
+	if !ok {
+		p.log.Error("Invalid payload pointer", zap.String("pointer", pointer))
+		return commonmodel.ErrInvalidArgument
+	}
+	if bucket != p.bucket || !strings.HasPrefix(key, p.keyPrefix) {
+		p.log.Debug("Payload not owned by the store, it is not deleted", zap.String("pointer", pointer))
+		return nil
+	}
+	_, err := p.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		p.log.Error("Error while deleting payload", zap.String("pointer", pointer), zap.Any("error", err))
+		return commonmodel.ErrStorageUnexpected
+	}
+	return nil
+}
+
+// parseS3Pointer splits the s3://bucket/key pointer into the bucket and the key
+func parseS3Pointer(pointer string) (bucket, key string, ok bool) {
+	if !strings.HasPrefix(pointer, s3PointerScheme) {
+		return "", "", false
+	}
+	bucket, key, ok = strings.Cut(strings.TrimPrefix(pointer, s3PointerScheme), "/")
+	if !ok || bucket == "" || key == "" {
+		return "", "", false
+	}
+	return bucket, key, true
+}
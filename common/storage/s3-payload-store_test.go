@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	commonmodel "notification-service/common/common-model"
+	"os"
+	"testing"
+)
+
+func TestParseS3Pointer(t *testing.T) {
+	bucket, key, ok := parseS3Pointer("s3://bucket/notifications/id")
+	if !ok || bucket != "bucket" || key != "notifications/id" {
+		t.Fatalf("unexpected result: %v %v %v", bucket, key, ok)
+	}
+	for _, pointer := range []string{"", "bucket/key", "s3://bucket", "s3://bucket/", "s3:///key"} {
+		if _, _, ok := parseS3Pointer(pointer); ok {
+			t.Fatalf("invalid pointer accepted: %q", pointer)
+		}
+	}
+}
+
+// TestS3PayloadStore runs against the MinIO server given by MINIO_TEST_ENDPOINT (e.g. http://localhost:9000), using the
+// existing bucket MINIO_TEST_BUCKET, the credentials are taken from the usual AWS settings (e.g. AWS_ACCESS_KEY_ID)
+func TestS3PayloadStore(t *testing.T) {
+	endpoint, bucket := os.Getenv("MINIO_TEST_ENDPOINT"), os.Getenv("MINIO_TEST_BUCKET")
+	if endpoint == "" || bucket == "" {
+		t.Skip("MINIO_TEST_ENDPOINT or MINIO_TEST_BUCKET is not set")
+	}
+	store := NewS3PayloadStore(zap.NewNop(), S3Config{Bucket: bucket, KeyPrefix: "test/", Endpoint: endpoint, ForcePathStyle: true})
+	ctx := context.Background()
+	pointer, err := store.Put(ctx, uuid.New().String(), "payload")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	payload, err := store.Get(ctx, pointer)
+	if err != nil || payload != "payload" {
+		t.Fatalf("unexpected payload: %q, error: %v", payload, err)
+	}
+	if err := store.Delete(ctx, pointer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := store.Get(ctx, pointer); err != commonmodel.ErrStorageUnexpected {
+		t.Fatalf("the deleted payload is still available: %v", err)
+	}
+	//The objects outside the key prefix of the store are not deleted
+	other := NewS3PayloadStore(zap.NewNop(), S3Config{Bucket: bucket, KeyPrefix: "other/", Endpoint: endpoint, ForcePathStyle: true})
+	pointer, err = other.Put(ctx, uuid.New().String(), "payload")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = other.Delete(ctx, pointer) }()
+	if err := store.Delete(ctx, pointer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := other.Get(ctx, pointer); err != nil {
+		t.Fatalf("the payload of the other store has been deleted: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package trace
 
 import (
+	"bytes"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
@@ -45,10 +46,12 @@ func (t *TraceMiddleware) LogIncomingRequestGin(c *gin.Context) {
 	} else {
 		restrictedBody = common.RestrictRequestJson(string(bodyStr), common.Body)
 	}
+	//The body has been consumed, restore it for the handlers
+	c.Request.Body = io.NopCloser(bytes.NewReader(bodyStr))
 	restrictedHeader = common.RestrictRequestJson(common.GetGinHeaderAsString(c.Request), common.Header)
 	t.Logger.Debug("New request",
 		zap.String("method", c.Request.Method),
-		zap.String("url", c.Request.URL.String()),
+		zap.String("url", common.RestrictRequestUrl(c.Request.URL)),
 		zap.String("client-ip", c.ClientIP()),
 		zap.String("trace-id", c.Request.Header.Get(t.TracingHeaderParameter)),
 		zap.String("body", restrictedBody),
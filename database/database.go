@@ -1,10 +1,12 @@
 package database
 
 import (
-	"database/sql"
+	"errors"
 	"github.com/upper/db/v4"
 	"github.com/upper/db/v4/adapter/postgresql"
 	commonmodel "notification-service/common/common-model"
+	"notification-service/model"
+	"time"
 )
 
 type Database struct {
@@ -12,9 +14,32 @@ type Database struct {
 	config db.ConnectionURL
 }
 
+// sessionLeaseTable stores which service instance each client is connected to (ServiceInstanceQueue mode)
+// A row is a lease of the instance on the client, which is renewed by the heartbeat of the instance. The expired leases
+// (e.g. of a crashed instance) are treated as offline
+const sessionLeaseTable = "notifier_session_leases"
+
+// instanceRegistryTable stores the running service instances, which renew their heartbeat periodically
+const instanceRegistryTable = "notifier_instance_registry"
+
+// maxRenewalBatchSize is the maximum number of leases renewed by a single statement
+const maxRenewalBatchSize = 1000
+
 type DatabaseInterface interface {
-	UpdateClientServiceId(client string, serviceId string) error
-	UpdateClientServiceIdToNull(client string) error
+	AcquireSessionLease(client string, serviceId string, queueUrl string, ttl time.Duration) error
+	ReleaseSessionLease(client string, serviceId string) error
+	RenewSessionLeases(serviceId string, sessionCounts map[string]int, ttl time.Duration) error
+	RestoreSessionLeases(serviceId string, queueUrl string, sessionCounts map[string]int, ttl time.Duration) error
+	ReleaseSessionLeases(serviceId string) error
+	PurgeExpiredSessionLeases() error
+	RegisterInstance(instance model.Instance) error
+	HeartbeatInstance(instanceId string, userCount int) error
+	DeregisterInstance(instanceId string) error
+	IsInstanceRegistered(instanceId string) (registered bool, err error)
+	GetLiveInstances(staleAfter time.Duration) (instances []model.Instance, err error)
+	PurgeStaleInstances(staleAfter time.Duration) (instances []model.Instance, err error)
+	GetClientServiceId(client string) (serviceId *string, err error)
+	GetClientRoute(client string) (route model.Route, err error)
 }
 
 func GetNewDatabaseConnection(connUrl db.ConnectionURL) *Database {
@@ -25,24 +50,248 @@ func GetNewDatabaseConnection(connUrl db.ConnectionURL) *Database {
 	return &Database{conn: session, config: connUrl}
 }
 
-func (d Database) UpdateClientServiceId(client string, serviceId string) error {
-	q := d.conn.SQL().Update("notifier_instances").
-		Set("notifier_instance_id", serviceId).
-		Where("user_id = ?", client)
-	_, err := q.Exec()
+// AcquireSessionLease assigns the service instance to the client for ttl, or takes over the lease if it already exists
+// (e.g. it has been left behind by the previous connection of the client), which then starts as a fresh connection
+// queueUrl is the URL of the queue of the instance, it is returned as the route of the client
+func (d Database) AcquireSessionLease(client string, serviceId string, queueUrl string, ttl time.Duration) error {
+	_, err := d.conn.SQL().Exec(`INSERT INTO `+sessionLeaseTable+` (user_id, notifier_instance_id, queue_url, connected_at, expires_at, session_count)
+		VALUES (?, ?, ?, now(), now() + make_interval(secs => ?), 1)
+		ON CONFLICT (user_id, notifier_instance_id) DO UPDATE SET queue_url = EXCLUDED.queue_url, connected_at = EXCLUDED.connected_at,
+			expires_at = EXCLUDED.expires_at, session_count = EXCLUDED.session_count`,
+		client, serviceId, queueUrl, ttl.Seconds())
+	if err != nil {
+		return commonmodel.ErrDbUnexpected
+	}
+	return nil
+}
+
+// ReleaseSessionLease removes the lease of the service instance on the client
+func (d Database) ReleaseSessionLease(client string, serviceId string) error {
+	_, err := d.conn.SQL().DeleteFrom(sessionLeaseTable).
+		Where("user_id = ? AND notifier_instance_id = ?", client, serviceId).
+		Exec()
+	if err != nil {
+		return commonmodel.ErrDbUnexpected
+	}
+	return nil
+}
+
+// RenewSessionLeases extends the leases of the service instance on the given clients by ttl and updates their session
+// counts, the leases of the other clients are left to expire
+// The missing leases are not created, since the snapshot of the session counts might be older than the release of the
+// lease (the client has disconnected in the meantime), the leases are only created by AcquireSessionLease
+func (d Database) RenewSessionLeases(serviceId string, sessionCounts map[string]int, ttl time.Duration) error {
+	clients := make(postgresql.StringArray, 0, maxRenewalBatchSize)
+	counts := make(postgresql.Int64Array, 0, maxRenewalBatchSize)
+	renew := func() error {
+		if len(clients) == 0 {
+			return nil
+		}
+		_, err := d.conn.SQL().Exec(`UPDATE `+sessionLeaseTable+` AS lease
+			SET expires_at = now() + make_interval(secs => ?), session_count = renewal.session_count
+			FROM unnest(?::text[], ?::bigint[]) AS renewal(user_id, session_count)
+			WHERE lease.notifier_instance_id = ? AND lease.user_id = ANY(?::text[]) AND lease.user_id = renewal.user_id`,
+			ttl.Seconds(), clients, counts, serviceId, clients)
+		clients, counts = clients[:0], counts[:0]
+		if err != nil {
+			return commonmodel.ErrDbUnexpected
+		}
+		return nil
+	}
+	for client, count := range sessionCounts {
+		clients = append(clients, client)
+		counts = append(counts, int64(count))
+		if len(clients) == maxRenewalBatchSize {
+			if err := renew(); err != nil {
+				return err
+			}
+		}
+	}
+	return renew()
+}
+
+// RestoreSessionLeases acquires the leases of the given clients again, with their number of sessions, it is called when the
+// leases of the instance have been purged while its clients are still connected (e.g. its heartbeats have been delayed)
+func (d Database) RestoreSessionLeases(serviceId string, queueUrl string, sessionCounts map[string]int, ttl time.Duration) error {
+	clients := make(postgresql.StringArray, 0, maxRenewalBatchSize)
+	counts := make(postgresql.Int64Array, 0, maxRenewalBatchSize)
+	restore := func() error {
+		if len(clients) == 0 {
+			return nil
+		}
+		_, err := d.conn.SQL().Exec(`INSERT INTO `+sessionLeaseTable+` (user_id, notifier_instance_id, queue_url, connected_at, expires_at, session_count)
+			SELECT restored.user_id, ?, ?, now(), now() + make_interval(secs => ?), restored.session_count
+			FROM unnest(?::text[], ?::bigint[]) AS restored(user_id, session_count)
+			ON CONFLICT (user_id, notifier_instance_id) DO UPDATE SET queue_url = EXCLUDED.queue_url,
+				expires_at = EXCLUDED.expires_at, session_count = EXCLUDED.session_count`,
+			serviceId, queueUrl, ttl.Seconds(), clients, counts)
+		clients, counts = clients[:0], counts[:0]
+		if err != nil {
+			return commonmodel.ErrDbUnexpected
+		}
+		return nil
+	}
+	for client, count := range sessionCounts {
+		clients = append(clients, client)
+		counts = append(counts, int64(count))
+		if len(clients) == maxRenewalBatchSize {
+			if err := restore(); err != nil {
+				return err
+			}
+		}
+	}
+	return restore()
+}
+
+// ReleaseSessionLeases removes all the leases of the service instance, it is called on startup and shutdown
+func (d Database) ReleaseSessionLeases(serviceId string) error {
+	_, err := d.conn.SQL().DeleteFrom(sessionLeaseTable).
+		Where("notifier_instance_id = ?", serviceId).
+		Exec()
+	if err != nil {
+		return commonmodel.ErrDbUnexpected
+	}
+	return nil
+}
+
+// PurgeExpiredSessionLeases removes the expired leases, e.g. the ones left behind by crashed instances
+func (d Database) PurgeExpiredSessionLeases() error {
+	_, err := d.conn.SQL().DeleteFrom(sessionLeaseTable).
+		Where("expires_at < now()").
+		Exec()
 	if err != nil {
 		return commonmodel.ErrDbUnexpected
 	}
 	return nil
 }
 
-func (d Database) UpdateClientServiceIdToNull(client string) error {
-	q := d.conn.SQL().Update("notifier_instances").
-		Set("notifier_instance_id", sql.NullString{}).
-		Where("user_id = ?", client)
-	_, err := q.Exec()
+// RegisterInstance adds the service instance to the registry with a fresh heartbeat, or overwrites its previous entry
+func (d Database) RegisterInstance(instance model.Instance) error {
+	_, err := d.conn.SQL().Exec(`INSERT INTO `+instanceRegistryTable+` (instance_id, queue_url, owns_queue, host, version, started_at, heartbeat_at, user_count)
+		VALUES (?, ?, ?, ?, ?, ?, now(), ?)
+		ON CONFLICT (instance_id) DO UPDATE SET queue_url = EXCLUDED.queue_url, owns_queue = EXCLUDED.owns_queue, host = EXCLUDED.host,
+			version = EXCLUDED.version, started_at = EXCLUDED.started_at, heartbeat_at = EXCLUDED.heartbeat_at, user_count = EXCLUDED.user_count`,
+		instance.Id, instance.QueueUrl, instance.OwnsQueue, instance.Host, instance.Version, instance.StartedAt, instance.UserCount)
 	if err != nil {
 		return commonmodel.ErrDbUnexpected
 	}
 	return nil
 }
+
+// HeartbeatInstance renews the heartbeat of the service instance and updates its connected user count
+// ErrInstanceNotRegistered is returned if the instance is not in the registry (e.g. it has been purged as stale)
+func (d Database) HeartbeatInstance(instanceId string, userCount int) error {
+	result, err := d.conn.SQL().Exec(`UPDATE `+instanceRegistryTable+` SET heartbeat_at = now(), user_count = ? WHERE instance_id = ?`,
+		userCount, instanceId)
+	if err != nil {
+		return commonmodel.ErrDbUnexpected
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return commonmodel.ErrInstanceNotRegistered
+	}
+	return nil
+}
+
+// DeregisterInstance removes the service instance from the registry
+func (d Database) DeregisterInstance(instanceId string) error {
+	_, err := d.conn.SQL().DeleteFrom(instanceRegistryTable).
+		Where("instance_id = ?", instanceId).
+		Exec()
+	if err != nil {
+		return commonmodel.ErrDbUnexpected
+	}
+	return nil
+}
+
+// IsInstanceRegistered tells whether the service instance is in the registry, regardless of its heartbeat
+func (d Database) IsInstanceRegistered(instanceId string) (registered bool, err error) {
+	var row struct {
+		InstanceId string `db:"instance_id"`
+	}
+	err = d.conn.SQL().Select("instance_id").
+		From(instanceRegistryTable).
+		Where("instance_id = ?", instanceId).
+		One(&row)
+	if errors.Is(err, db.ErrNoMoreRows) {
+		return false, nil
+	} else if err != nil {
+		return false, commonmodel.ErrDbUnexpected
+	}
+	return true, nil
+}
+
+// GetLiveInstances returns the service instances whose heartbeat has been renewed within staleAfter, ordered by their start
+func (d Database) GetLiveInstances(staleAfter time.Duration) (instances []model.Instance, err error) {
+	instances = make([]model.Instance, 0)
+	err = d.conn.SQL().Select("instance_id", "queue_url", "owns_queue", "host", "version", "started_at", "heartbeat_at", "user_count").
+		From(instanceRegistryTable).
+		Where("heartbeat_at > now() - make_interval(secs => ?)", staleAfter.Seconds()).
+		OrderBy("started_at").
+		All(&instances)
+	if err != nil {
+		return nil, commonmodel.ErrDbUnexpected
+	}
+	return instances, nil
+}
+
+// PurgeStaleInstances removes the service instances whose heartbeat has not been renewed within staleAfter (e.g. crashed
+// instances) together with their session leases, thus their clients are treated as offline right away
+// The removed instances are returned (only to the caller which removed them), so their queues can be cleaned up
+func (d Database) PurgeStaleInstances(staleAfter time.Duration) (instances []model.Instance, err error) {
+	rows, err := d.conn.SQL().Query(`WITH stale AS (
+			DELETE FROM `+instanceRegistryTable+` WHERE heartbeat_at < now() - make_interval(secs => ?) RETURNING instance_id, queue_url, owns_queue
+		), released AS (
+			DELETE FROM `+sessionLeaseTable+` WHERE notifier_instance_id IN (SELECT instance_id FROM stale)
+		)
+		SELECT instance_id, queue_url, owns_queue FROM stale`, staleAfter.Seconds())
+	if err != nil {
+		return nil, commonmodel.ErrDbUnexpected
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var instance model.Instance
+		if err := rows.Scan(&instance.Id, &instance.QueueUrl, &instance.OwnsQueue); err != nil {
+			return nil, commonmodel.ErrDbUnexpected
+		}
+		instances = append(instances, instance)
+	}
+	if rows.Err() != nil {
+		return nil, commonmodel.ErrDbUnexpected
+	}
+	return instances, nil
+}
+
+// GetClientServiceId returns the id of the service instance the client is connected to, or nil if the client is not connected
+func (d Database) GetClientServiceId(client string) (serviceId *string, err error) {
+	route, err := d.GetClientRoute(client)
+	if err != nil || !route.Online {
+		return nil, err
+	}
+	return &route.InstanceId, nil
+}
+
+// GetClientRoute returns the route of the client with the id of the service instance it is connected to and the URL of
+// its queue, as stored with the lease. If the client is connected to multiple instances, the most recently connected one
+// is returned, the expired leases are ignored
+func (d Database) GetClientRoute(client string) (route model.Route, err error) {
+	route.UserId = client
+	var row struct {
+		NotifierInstanceId string `db:"notifier_instance_id"`
+		QueueUrl           string `db:"queue_url"`
+	}
+	err = d.conn.SQL().Select("notifier_instance_id", "queue_url").
+		From(sessionLeaseTable).
+		Where("user_id = ? AND expires_at > now()", client).
+		OrderBy("-connected_at").
+		Limit(1).
+		One(&row)
+	if errors.Is(err, db.ErrNoMoreRows) {
+		return route, nil
+	} else if err != nil {
+		return route, commonmodel.ErrDbUnexpected
+	}
+	route.Online = true
+	route.InstanceId = row.NotifierInstanceId
+	route.QueueUrl = row.QueueUrl
+	return route, nil
+}
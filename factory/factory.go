@@ -1,17 +1,29 @@
 package factory
 
 import (
+	"github.com/google/uuid"
+	natsgo "github.com/nats-io/nats.go"
+	goredis "github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 	"log"
+	"notification-service/common/broker"
 	"notification-service/common/common"
 	commonmodel "notification-service/common/common-model"
+	"notification-service/common/dedup"
 	"notification-service/common/jwt"
+	"notification-service/common/kafka"
 	"notification-service/common/logging"
+	"notification-service/common/nats"
+	"notification-service/common/redis"
 	sqs "notification-service/common/sqs"
+	"notification-service/common/storage"
 	"notification-service/common/trace"
 	"notification-service/database"
 	dbconfig "notification-service/database/config"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Factory struct {
@@ -19,8 +31,14 @@ type Factory struct {
 	zLog          *zap.Logger
 	auth          *jwt.Authorization
 	sqsService    *sqs.SqsService
+	broker        broker.Broker
 	trace         *trace.TraceMiddleware
 	operationMode commonmodel.OperationMode
+	role          commonmodel.ServiceRole
+	//visibilityTimeout is the time a received notification is hidden from the other consumers of the destination
+	visibilityTimeout time.Duration
+	//dedup is nil if the deduplication is disabled
+	dedup dedup.Cache
 }
 
 type FactoryInterface interface {
@@ -28,8 +46,12 @@ type FactoryInterface interface {
 	Logger() zap.Logger
 	Auth() jwt.AuthorizationInterface
 	Sqs() sqs.SqsServiceInterface
+	Broker() broker.Broker
 	Trace() trace.TraceMiddlewareInterface
 	Mode() commonmodel.OperationMode
+	Role() commonmodel.ServiceRole
+	VisibilityTimeout() time.Duration
+	Dedup() dedup.Cache
 }
 
 func NewFactory(environment string) (factory Factory) {
@@ -41,8 +63,13 @@ func NewFactory(environment string) (factory Factory) {
 		}
 		mode := commonmodel.OperationMode(modeInt)
 		factory.operationMode = mode
+		role := commonmodel.ServiceRole(common.GetEnvWithDefault("NOTIFICATION_SERVICE_ROLE", string(commonmodel.ApiRole)))
+		if role != commonmodel.ApiRole && role != commonmodel.DlqWorkerRole {
+			log.Fatal("Invalid NOTIFICATION_SERVICE_ROLE: ", role)
+		}
+		factory.role = role
 		//SQL database
-		if mode == commonmodel.ServiceInstanceQueue {
+		if mode == commonmodel.ServiceInstanceQueue && role == commonmodel.ApiRole {
 			host := common.GetEnvWithDefault("DB_HOST", "localhost")
 			//port := common.GetEnvWithDefault("TEST_DB_PORT", "5432")
 			user := common.GetEnvWithDefault("DB_USER", "my_user")
@@ -57,10 +84,173 @@ func NewFactory(environment string) (factory Factory) {
 			config := dbconfig.NewConfiguration(host, dbName, user, pw, options)
 			factory.db = database.GetNewDatabaseConnection(config)
 		}
-		//Authorization
-		factory.auth = jwt.CreateAuthorization(environment, true, common.GetEnvRequired("COGNITO_JWK_URL"))
-		//SQS service
-		factory.sqsService = sqs.NewSqsService(factory.zLog)
+		//Authorization, the worker does not serve clients
+		if role == commonmodel.ApiRole {
+			factory.auth = jwt.CreateAuthorization(environment, true, common.GetEnvRequired("COGNITO_JWK_URL"))
+			//API keys of the services calling the service-to-service endpoints, in name:key format
+			if apiKeys := common.GetEnvWithDefault("SERVICE_API_KEYS", ""); apiKeys != "" {
+				for _, entry := range strings.Split(apiKeys, ",") {
+					name, key, found := strings.Cut(strings.TrimSpace(entry), ":")
+					if !found || name == "" || key == "" {
+						log.Fatal("Invalid SERVICE_API_KEYS entry, expected name:key")
+					}
+					factory.auth.AddApiKey(name, key)
+				}
+			}
+		}
+		//Visibility timeout of the received notifications, shared by every broker
+		visibilityTimeoutSeconds, err := strconv.Atoi(common.GetEnvWithDefault("VISIBILITY_TIMEOUT_SECONDS", "15"))
+		if err != nil || visibilityTimeoutSeconds < 1 || visibilityTimeoutSeconds > 43200 {
+			log.Fatal("Error while parsing VISIBILITY_TIMEOUT_SECONDS", zap.Any("error", err))
+		}
+		factory.visibilityTimeout = time.Duration(visibilityTimeoutSeconds) * time.Second
+		//Message broker, the PartitionedTopic mode can only work with Kafka, the UserSubject mode with NATS
+		defaultBroker := "sqs"
+		if mode == commonmodel.PartitionedTopic {
+			defaultBroker = "kafka"
+		} else if mode == commonmodel.UserSubject {
+			defaultBroker = "nats"
+		}
+		brokerType := common.GetEnvWithDefault("MESSAGE_BROKER", defaultBroker)
+		if mode == commonmodel.PartitionedTopic && brokerType != "kafka" {
+			log.Fatal("NOTIFICATION_SERVICE_MODE 2 requires the kafka MESSAGE_BROKER")
+		} else if mode == commonmodel.UserSubject && brokerType != "nats" {
+			log.Fatal("NOTIFICATION_SERVICE_MODE 3 requires the nats MESSAGE_BROKER")
+		}
+		switch brokerType {
+		case "sqs":
+			receiveBatchSize, err := strconv.Atoi(common.GetEnvWithDefault("SQS_RECEIVE_BATCH_SIZE", "10"))
+			if err != nil {
+				log.Fatal("Error while parsing SQS_RECEIVE_BATCH_SIZE", zap.Any("error", err))
+			}
+			deleteBatchWindow, err := strconv.Atoi(common.GetEnvWithDefault("SQS_DELETE_BATCH_WINDOW_MS", "100"))
+			if err != nil {
+				log.Fatal("Error while parsing SQS_DELETE_BATCH_WINDOW_MS", zap.Any("error", err))
+			}
+			circuitFailureThreshold, err := strconv.Atoi(common.GetEnvWithDefault("SQS_CIRCUIT_FAILURE_THRESHOLD", "5"))
+			if err != nil {
+				log.Fatal("Error while parsing SQS_CIRCUIT_FAILURE_THRESHOLD", zap.Any("error", err))
+			}
+			circuitOpenSeconds, err := strconv.Atoi(common.GetEnvWithDefault("SQS_CIRCUIT_OPEN_SECONDS", "30"))
+			if err != nil {
+				log.Fatal("Error while parsing SQS_CIRCUIT_OPEN_SECONDS", zap.Any("error", err))
+			}
+			backoffBase, err := strconv.Atoi(common.GetEnvWithDefault("SQS_BACKOFF_BASE_MS", "100"))
+			if err != nil {
+				log.Fatal("Error while parsing SQS_BACKOFF_BASE_MS", zap.Any("error", err))
+			}
+			backoffMax, err := strconv.Atoi(common.GetEnvWithDefault("SQS_BACKOFF_MAX_MS", "20000"))
+			if err != nil {
+				log.Fatal("Error while parsing SQS_BACKOFF_MAX_MS", zap.Any("error", err))
+			}
+			//Large payloads are offloaded to an S3 compatible bucket if it is configured
+			var payloadStore storage.PayloadStore
+			offloadThreshold, err := strconv.Atoi(common.GetEnvWithDefault("PAYLOAD_OFFLOAD_THRESHOLD_BYTES", "245760"))
+			if err != nil || offloadThreshold < 0 || offloadThreshold > sqs.MaxMessageBodySize {
+				log.Fatal("Error while parsing PAYLOAD_OFFLOAD_THRESHOLD_BYTES", zap.Any("error", err))
+			}
+			if payloadBucket := common.GetEnvWithDefault("PAYLOAD_BUCKET", ""); payloadBucket != "" {
+				forcePathStyle, err := strconv.ParseBool(common.GetEnvWithDefault("S3_FORCE_PATH_STYLE", "false"))
+				if err != nil {
+					log.Fatal("Error while parsing S3_FORCE_PATH_STYLE", zap.Any("error", err))
+				}
+				payloadStore = storage.NewS3PayloadStore(factory.zLog, storage.S3Config{
+					Bucket:         payloadBucket,
+					KeyPrefix:      common.GetEnvWithDefault("PAYLOAD_KEY_PREFIX", "notifications/"),
+					Endpoint:       common.GetEnvWithDefault("S3_ENDPOINT", ""),
+					ForcePathStyle: forcePathStyle,
+				})
+			}
+			factory.sqsService = sqs.NewSqsService(factory.zLog, sqs.SqsConfig{
+				ReceiveBatchSize:        int64(receiveBatchSize),
+				DeleteBatchWindow:       time.Duration(deleteBatchWindow) * time.Millisecond,
+				CircuitFailureThreshold: circuitFailureThreshold,
+				CircuitOpenDuration:     time.Duration(circuitOpenSeconds) * time.Second,
+				BackoffBase:             time.Duration(backoffBase) * time.Millisecond,
+				BackoffMax:              time.Duration(backoffMax) * time.Millisecond,
+				PayloadStore:            payloadStore,
+				PayloadOffloadThreshold: offloadThreshold,
+			})
+			createDeadLetterQueue, err := strconv.ParseBool(common.GetEnvWithDefault("SQS_CREATE_DEAD_LETTER_QUEUE", "false"))
+			if err != nil {
+				log.Fatal("Error while parsing SQS_CREATE_DEAD_LETTER_QUEUE", zap.Any("error", err))
+			}
+			queueConfig := sqs.SqsQueueConfig{
+				RetentionPeriodSeconds:           getOptionalIntEnv("SQS_MESSAGE_RETENTION_SECONDS"),
+				MaxReceiveCount:                  getOptionalIntEnv("SQS_MAX_RECEIVE_COUNT"),
+				CreateDeadLetterQueue:            createDeadLetterQueue,
+				DeadLetterRetentionPeriodSeconds: getOptionalIntEnv("SQS_DEAD_LETTER_RETENTION_SECONDS"),
+			}
+			if deadLetterQueueArn := common.GetEnvWithDefault("SQS_DEAD_LETTER_QUEUE_ARN", ""); deadLetterQueueArn != "" {
+				queueConfig.DeadLetterQueueArn = &deadLetterQueueArn
+			}
+			factory.broker = sqs.NewSqsBroker(factory.sqsService, int64(visibilityTimeoutSeconds), queueConfig, factory.zLog)
+		case "memory":
+			factory.broker = broker.NewMemoryBroker(factory.visibilityTimeout)
+		case "redis":
+			client := newRedisClient()
+			hostname, _ := os.Hostname()
+			consumer := common.GetEnvWithDefault("REDIS_CONSUMER_NAME", hostname+"-"+uuid.New().String())
+			//Every instance needs its own consumer group, since all of them have to receive the entries of the streams they read
+			group := common.GetEnvWithDefault("REDIS_CONSUMER_GROUP_PREFIX", "notification-service") + "-" + consumer
+			retention, err := strconv.Atoi(common.GetEnvWithDefault("REDIS_STREAM_RETENTION_SECONDS", "86400"))
+			if err != nil || retention < 1 {
+				log.Fatal("Error while parsing REDIS_STREAM_RETENTION_SECONDS", zap.Any("error", err))
+			}
+			factory.broker = redis.NewRedisBroker(client, group, consumer, factory.visibilityTimeout, time.Duration(retention)*time.Second, factory.zLog)
+		case "kafka":
+			//Every instance needs its own consumer group, since all of them have to receive every notification
+			instanceId := common.GetEnvWithDefault("NOTIFICATION_SERVICE_CLIENT_ID", "")
+			if instanceId == "" {
+				instanceId, _ = os.Hostname()
+			}
+			group := common.GetEnvWithDefault("KAFKA_CONSUMER_GROUP_PREFIX", "notification-service") + "-" + instanceId
+			brokers := strings.Split(common.GetEnvRequired("KAFKA_BROKERS"), ",")
+			factory.broker = kafka.NewKafkaBroker(brokers, group, factory.zLog)
+		case "nats":
+			maxAge, err := strconv.Atoi(common.GetEnvWithDefault("NATS_STREAM_MAX_AGE_SECONDS", "0"))
+			if err != nil {
+				log.Fatal("Error while parsing NATS_STREAM_MAX_AGE_SECONDS", zap.Any("error", err))
+			}
+			inactiveThreshold, err := strconv.Atoi(common.GetEnvWithDefault("NATS_CONSUMER_INACTIVE_SECONDS", "3600"))
+			if err != nil || inactiveThreshold < 1 {
+				log.Fatal("Error while parsing NATS_CONSUMER_INACTIVE_SECONDS", zap.Any("error", err))
+			}
+			conn, err := natsgo.Connect(common.GetEnvWithDefault("NATS_URL", natsgo.DefaultURL))
+			if err != nil {
+				log.Fatal("Error while connecting to NATS", zap.Any("error", err))
+			}
+			factory.broker, err = nats.NewNatsBroker(conn,
+				common.GetEnvWithDefault("NATS_STREAM", "NOTIFICATIONS"),
+				common.GetEnvWithDefault("NATS_SUBJECT_PREFIX", "notifications"),
+				time.Duration(maxAge)*time.Second, factory.visibilityTimeout, time.Duration(inactiveThreshold)*time.Second, factory.zLog)
+			if err != nil {
+				log.Fatal("Error while creating NATS stream", zap.Any("error", err))
+			}
+		default:
+			log.Fatal("Invalid MESSAGE_BROKER: ", brokerType)
+		}
+		//Deduplication of the redelivered notifications
+		switch dedupCache := common.GetEnvWithDefault("DEDUP_CACHE", ""); dedupCache {
+		case "":
+		case "memory", "redis":
+			dedupTtl, err := strconv.Atoi(common.GetEnvWithDefault("DEDUP_TTL_SECONDS", "300"))
+			if err != nil {
+				log.Fatal("Error while parsing DEDUP_TTL_SECONDS", zap.Any("error", err))
+			}
+			if dedupCache == "memory" {
+				dedupSize, err := strconv.Atoi(common.GetEnvWithDefault("DEDUP_CACHE_SIZE", "10000"))
+				if err != nil {
+					log.Fatal("Error while parsing DEDUP_CACHE_SIZE", zap.Any("error", err))
+				}
+				factory.dedup = dedup.NewMemoryCache(dedupSize, time.Duration(dedupTtl)*time.Second)
+			} else {
+				keyPrefix := common.GetEnvWithDefault("DEDUP_KEY_PREFIX", "notification-service:dedup:")
+				factory.dedup = dedup.NewRedisCache(newRedisClient(), keyPrefix, time.Duration(dedupTtl)*time.Second, factory.zLog)
+			}
+		default:
+			log.Fatal("Invalid DEDUP_CACHE: ", dedupCache)
+		}
 		//Tracing
 		factory.trace = trace.NewTraceMiddleware(environment, "trace-id", factory.zLog)
 
@@ -70,6 +260,32 @@ func NewFactory(environment string) (factory Factory) {
 	return
 }
 
+// getOptionalIntEnv returns the integer value of the environmental variable, or nil if it is not set
+func getOptionalIntEnv(key string) *int {
+	value := common.GetEnvWithDefault(key, "")
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatal("Error while parsing "+key, zap.Any("error", err))
+	}
+	return &parsed
+}
+
+// newRedisClient creates a Redis client from the REDIS_* environmental variables
+func newRedisClient() *goredis.Client {
+	redisDb, err := strconv.Atoi(common.GetEnvWithDefault("REDIS_DB", "0"))
+	if err != nil {
+		log.Fatal("Error while parsing REDIS_DB", zap.Any("error", err))
+	}
+	return goredis.NewClient(&goredis.Options{
+		Addr:     common.GetEnvWithDefault("REDIS_ADDR", "localhost:6379"),
+		Password: common.GetEnvWithDefault("REDIS_PW", ""),
+		DB:       redisDb,
+	})
+}
+
 func (f Factory) Db() database.DatabaseInterface {
 	return f.db
 }
@@ -83,9 +299,16 @@ func (f Factory) Auth() jwt.AuthorizationInterface {
 }
 
 func (f Factory) Sqs() sqs.SqsServiceInterface {
+	if f.sqsService == nil {
+		return nil
+	}
 	return f.sqsService
 }
 
+func (f Factory) Broker() broker.Broker {
+	return f.broker
+}
+
 func (f Factory) Trace() trace.TraceMiddlewareInterface {
 	return f.trace
 }
@@ -93,3 +316,15 @@ func (f Factory) Trace() trace.TraceMiddlewareInterface {
 func (f Factory) Mode() commonmodel.OperationMode {
 	return f.operationMode
 }
+
+func (f Factory) Role() commonmodel.ServiceRole {
+	return f.role
+}
+
+func (f Factory) VisibilityTimeout() time.Duration {
+	return f.visibilityTimeout
+}
+
+func (f Factory) Dedup() dedup.Cache {
+	return f.dedup
+}
@@ -8,9 +8,12 @@ import (
 	"net/http"
 	"notification-service/api"
 	"notification-service/common/common"
+	commonmodel "notification-service/common/common-model"
 	"notification-service/factory"
+	"notification-service/worker"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -21,14 +24,29 @@ func NewGinServer(business *api.NotificationService) *gin.Engine {
 	router := gin.Default()
 	router.Use(business.F.Trace().EnsureTracingGin)
 	router.Use(business.F.Trace().LogIncomingRequestGin)
-	router.Use(business.F.Auth().JwtAuthorizationHandlerGin)
-	router.GET("/health", func(c *gin.Context) { return })
-	router.GET("/notifications", business.GetNotificationSubscribe)
+	//Service-to-service endpoints authenticated by API key, the tokens of the users are not accepted
+	services := router.Group("/", business.F.Auth().ApiKeyAuthorizationHandlerGin)
+	services.POST("/notifications", business.PostNotification)
+	services.POST("/notifications/batch", business.PostNotificationBatch)
+	if business.F.Mode() == commonmodel.ServiceInstanceQueue {
+		services.GET("/routes/:userId", business.GetRoute)
+		services.GET("/instances", business.GetInstances)
+	}
+	//User endpoints authenticated by JWT
+	authorized := router.Group("/", business.F.Auth().JwtAuthorizationHandlerGin)
+	authorized.GET("/health", business.GetHealth)
+	authorized.GET("/notifications", business.GetNotificationSubscribe)
+	authorized.GET("/ws/notifications", business.GetNotificationWebSocket)
+	authorized.POST("/notifications/:id/ack", business.PostNotificationAck)
 	return router
 }
 func main() {
 	f = factory.NewFactory("DEPLOYMENT")
 	zLog = f.Logger()
+	if f.Role() == commonmodel.DlqWorkerRole {
+		runDlqWorker()
+		return
+	}
 	zLog.Info("Server is starting...")
 
 	// Create an instance of handler
@@ -46,18 +64,41 @@ func main() {
 	}()
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	failed := false
 	select {
 	case <-c:
-		zLog.Info("SIGINT signal received...")
-		zLog.Info("Gracefully shutting down...")
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			zLog.Fatal("Server forced to shutdown: ", zap.Any("error", err))
-		}
+		zLog.Info("Termination signal received...")
+	case <-service.Failed():
+		//The instance cannot receive notifications anymore, it exits so it can be restarted
+		zLog.Error("Instance failed...")
+		failed = true
 	}
+	zLog.Info("Gracefully shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		//The long-lived connections do not finish in time, the resources of the service are released anyway
+		zLog.Error("Server forced to shutdown: ", zap.Any("error", err))
+	}
+	service.Close()
 
 	zLog.Info("Main thread is terminating...")
 	_ = zLog.Sync()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runDlqWorker runs the dead-letter-queue worker instead of the server until a termination signal is received
+func runDlqWorker() {
+	zLog.Info("DLQ worker is starting...")
+	dlqWorker := worker.NewDlqWorker(f)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := dlqWorker.Run(ctx); err != nil {
+		zLog.Error("DLQ worker terminated", zap.Any("error", err))
+	}
+	zLog.Info("DLQ worker is terminating...")
+	_ = zLog.Sync()
 }
@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+// Instance is a running instance of the notification service, as registered in the instance registry
+// The instance is live while its heartbeat is renewed, UserCount is the number of users connected to it at the last heartbeat
+// OwnsQueue is set if the queue has been created by the instance, thus it is deleted once the instance is gone
+type Instance struct {
+	Id          string    `json:"id" db:"instance_id"`
+	QueueUrl    string    `json:"queue_url" db:"queue_url"`
+	OwnsQueue   bool      `json:"owns_queue" db:"owns_queue"`
+	Host        string    `json:"host" db:"host"`
+	Version     string    `json:"version" db:"version"`
+	StartedAt   time.Time `json:"started_at" db:"started_at"`
+	HeartbeatAt time.Time `json:"heartbeat_at" db:"heartbeat_at"`
+	UserCount   int       `json:"user_count" db:"user_count"`
+}
@@ -4,6 +4,10 @@ type NotificationMeta struct {
 	Notification  Notification `json:"notification"`
 	ReceiptHandle string       `json:"handle"`
 	QueueUrl      string       `json:"queue_url"`
+	//GroupId is the message group of the notification if the destination keeps the order of the groups (e.g. FIFO queues)
+	GroupId string `json:"group_id,omitempty"`
+	//PayloadPointer refers to the offloaded body of the notification, which is deleted when the delivery is acknowledged
+	PayloadPointer string `json:"payload_pointer,omitempty"`
 }
 
 func CreateNotificationMeta(notification Notification, handle string, queueUrl string) NotificationMeta {
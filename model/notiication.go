@@ -1,10 +1,19 @@
 package model
 
 import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
 	awssqs "github.com/aws/aws-sdk-go/service/sqs"
 	commonmodel "notification-service/common/common-model"
 )
 
+// PayloadPointerAttribute is the message attribute carrying the pointer of the body, if it has been offloaded to an object
+// storage because of its size (claim-check pattern)
+const PayloadPointerAttribute = "payload-pointer"
+
+// PayloadResolver returns the body the pointer of an offloaded notification refers to
+type PayloadResolver func(pointer string) (body string, err error)
+
 type Notification struct {
 	Id        string `json:"id"`
 	Addressee string `json:"addressee"`
@@ -12,11 +21,34 @@ type Notification struct {
 	Subject   string `json:"subject"`
 }
 
-func CreateNotification(message awssqs.Message) (Notification, error) {
+// NotificationMessageAttributes returns the message attributes of the SQS message carrying the notification, in the layout
+// CreateNotification expects
+func NotificationMessageAttributes(notification Notification) map[string]*awssqs.MessageAttributeValue {
+	attributes := map[string]*awssqs.MessageAttributeValue{
+		"addressee": {DataType: aws.String("String"), StringValue: aws.String(notification.Addressee)},
+		"subject":   {DataType: aws.String("String"), StringValue: aws.String(notification.Subject)},
+	}
+	//SQS rejects empty attribute values, the notifications without id get the id of their message
+	if notification.Id != "" {
+		attributes["id"] = &awssqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(notification.Id)}
+	}
+	return attributes
+}
+
+// CreateNotification creates a notification from the given SQS message, its id is the "id" message attribute if present,
+// the message id otherwise
+// If the body of the notification has been offloaded, it is loaded by resolvePayload, ErrPayloadUnavailable is returned if
+// it cannot be loaded (e.g. resolvePayload is nil, or the object storage is not available)
+func CreateNotification(message awssqs.Message, resolvePayload PayloadResolver) (Notification, error) {
 	if message.Body == nil || len(*message.Body) == 0 || message.MessageAttributes == nil || len(message.MessageAttributes) == 0 {
 		return Notification{}, commonmodel.ErrSqsInvalidMessage
 	}
+	//The id given by the publisher is kept, thus the notification has the same id on every broker, the message id is
+	//only used for the messages sent without it
 	id := message.MessageId
+	if attribute := message.MessageAttributes["id"]; attribute != nil && aws.StringValue(attribute.StringValue) != "" {
+		id = attribute.StringValue
+	}
 	addressee := message.MessageAttributes["addressee"]
 	subject := message.MessageAttributes["subject"]
 	body := *message.Body
@@ -24,6 +56,18 @@ func CreateNotification(message awssqs.Message) (Notification, error) {
 	if addressee == nil || id == nil || subject == nil || len(body) == 0 {
 		return Notification{}, commonmodel.ErrSqsInvalidMessage
 	}
+	if pointer := message.MessageAttributes[PayloadPointerAttribute]; pointer != nil {
+		if resolvePayload == nil {
+			return Notification{}, commonmodel.ErrPayloadUnavailable
+		}
+		payload, err := resolvePayload(aws.StringValue(pointer.StringValue))
+		if errors.Is(err, commonmodel.ErrInvalidArgument) {
+			return Notification{}, commonmodel.ErrSqsInvalidMessage
+		} else if err != nil {
+			return Notification{}, commonmodel.ErrPayloadUnavailable
+		}
+		body = payload
+	}
 	return Notification{
 		Id:        *id,
 		Addressee: *addressee.StringValue,
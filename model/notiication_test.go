@@ -0,0 +1,37 @@
+package model
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	awssqs "github.com/aws/aws-sdk-go/service/sqs"
+	"testing"
+)
+
+func TestCreateNotificationKeepsPublishedId(t *testing.T) {
+	notification := Notification{Id: "notification-id", Addressee: "u1", Subject: "subject", Body: "body"}
+	message := awssqs.Message{
+		MessageId:         aws.String("message-id"),
+		Body:              aws.String(notification.Body),
+		MessageAttributes: NotificationMessageAttributes(notification),
+	}
+	created, err := CreateNotification(message, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if created != notification {
+		t.Fatalf("unexpected notification: %+v", created)
+	}
+}
+
+func TestCreateNotificationFallsBackToMessageId(t *testing.T) {
+	attributes := NotificationMessageAttributes(Notification{Addressee: "u1", Subject: "subject"})
+	if _, ok := attributes["id"]; ok {
+		t.Fatalf("the empty id must not be sent as an attribute")
+	}
+	created, err := CreateNotification(awssqs.Message{MessageId: aws.String("message-id"), Body: aws.String("body"), MessageAttributes: attributes}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if created.Id != "message-id" {
+		t.Fatalf("unexpected id: %v", created.Id)
+	}
+}
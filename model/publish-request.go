@@ -0,0 +1,27 @@
+package model
+
+// PublishRequest is a notification sent to the addressee through the notification service
+type PublishRequest struct {
+	Addressee string `json:"addressee" binding:"required"`
+	Subject   string `json:"subject" binding:"required"`
+	Body      string `json:"body" binding:"required"`
+}
+
+// PublishBatchRequest is a list of notifications published at once
+type PublishBatchRequest struct {
+	Notifications []PublishRequest `json:"notifications" binding:"required,min=1,max=100,dive"`
+}
+
+// PublishResult is the outcome of publishing a single notification
+// In case of a batch request Error contains the error code if the notification could not be published
+type PublishResult struct {
+	Id        string `json:"id,omitempty"`
+	MessageId string `json:"message_id,omitempty"`
+	Addressee string `json:"addressee"`
+	Error     string `json:"error,omitempty"`
+}
+
+// PublishBatchResult contains the results of a batch request in the order of the request
+type PublishBatchResult struct {
+	Results []PublishResult `json:"results"`
+}
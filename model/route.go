@@ -0,0 +1,10 @@
+package model
+
+// Route describes where the notifications of a user must be sent to in ServiceInstanceQueue mode
+// If the user is not connected to any instance, Online is false and the instance id and the queue URL are omitted
+type Route struct {
+	UserId     string `json:"user_id"`
+	Online     bool   `json:"online"`
+	InstanceId string `json:"instance_id,omitempty"`
+	QueueUrl   string `json:"queue_url,omitempty"`
+}
@@ -0,0 +1,266 @@
+package worker
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"notification-service/common/broker"
+	"notification-service/common/common"
+	"notification-service/common/fallback"
+	sqs "notification-service/common/sqs"
+	"notification-service/factory"
+	"notification-service/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// digestCheckInterval is the time between the checks of the digests whose window has elapsed
+const digestCheckInterval = time.Second
+
+// drainedQueueDeleter is implemented by the brokers which can delete the dead-letter-queues which have been drained
+type drainedQueueDeleter interface {
+	DeleteDrainedDeadLetterQueue(queueUrl string) (deleted bool, err error)
+}
+
+// DlqWorker consumes the dead-letter-queues, where the notifications which could not be delivered in real-time end up, and
+// hands them over to the fallback senders
+// The dead-letter-queue given by DLQ_URL is consumed, as well as the paired dead-letter-queues whose name starts with
+// DLQ_NAME_PREFIX. The latter are listed periodically, thus the dead-letter-queues of the new instances are picked up,
+// and the ones of the deleted queues are deleted once they are drained
+// The notifications are grouped by addressee: the notifications of a user received within the digest window are sent at
+// once. The senders are tried in the configured order until one of them succeeds, then the notifications are deleted from
+// the queue, if all of them fail the notifications reappear in the queue after the visibility timeout and are retried
+type DlqWorker struct {
+	zLog              zap.Logger
+	broker            broker.Broker
+	leaser            *broker.Leaser
+	senders           []fallback.Sender
+	sqs               sqs.SqsServiceInterface
+	queueUrl          string
+	queueNamePrefix   string
+	discoveryInterval time.Duration
+	digestWindow      time.Duration
+	digestSize        int
+	digests           map[string]*digest
+	subscriptions     map[string]*queueSubscription
+	received          chan model.NotificationMeta
+	terminated        chan *queueSubscription
+}
+
+// queueSubscription is the running subscription of a dead-letter-queue
+type queueSubscription struct {
+	queueUrl     string
+	subscription *broker.Subscription
+	cancel       context.CancelFunc
+}
+
+// digest collects the notifications of a user until its window elapses or it becomes full
+type digest struct {
+	leases    []*broker.Lease
+	createdAt time.Time
+}
+
+// NewDlqWorker is a factory function that creates a new DlqWorker instance
+func NewDlqWorker(factory factory.FactoryInterface) *DlqWorker {
+	log := factory.Logger()
+	digestWindow, err := strconv.Atoi(common.GetEnvWithDefault("DLQ_DIGEST_WINDOW_SECONDS", "60"))
+	if err != nil {
+		log.Fatal("Error while parsing DLQ_DIGEST_WINDOW_SECONDS", zap.Any("error", err))
+	}
+	digestSize, err := strconv.Atoi(common.GetEnvWithDefault("DLQ_DIGEST_MAX_SIZE", "50"))
+	if err != nil || digestSize < 1 {
+		log.Fatal("Error while parsing DLQ_DIGEST_MAX_SIZE", zap.Any("error", err))
+	}
+	discoveryInterval, err := strconv.Atoi(common.GetEnvWithDefault("DLQ_DISCOVERY_SECONDS", "60"))
+	if err != nil || discoveryInterval < 1 {
+		log.Fatal("Error while parsing DLQ_DISCOVERY_SECONDS", zap.Any("error", err))
+	}
+	worker := &DlqWorker{
+		zLog:              log,
+		broker:            factory.Broker(),
+		sqs:               factory.Sqs(),
+		queueUrl:          common.GetEnvWithDefault("DLQ_URL", ""),
+		queueNamePrefix:   common.GetEnvWithDefault("DLQ_NAME_PREFIX", ""),
+		discoveryInterval: time.Duration(discoveryInterval) * time.Second,
+		digestWindow:      time.Duration(digestWindow) * time.Second,
+		digestSize:        digestSize,
+		digests:           make(map[string]*digest),
+		subscriptions:     make(map[string]*queueSubscription),
+		received:          make(chan model.NotificationMeta),
+		terminated:        make(chan *queueSubscription),
+	}
+	if worker.queueUrl == "" && worker.queueNamePrefix == "" {
+		log.Fatal("Either DLQ_URL or DLQ_NAME_PREFIX must be set")
+	}
+	if worker.queueNamePrefix != "" && worker.sqs == nil {
+		log.Fatal("DLQ_NAME_PREFIX requires the sqs message broker")
+	}
+	worker.leaser = broker.NewLeaser(worker.broker, factory.VisibilityTimeout(), &worker.zLog)
+	for _, name := range strings.Split(common.GetEnvRequired("FALLBACK_SENDERS"), ",") {
+		switch strings.TrimSpace(name) {
+		case "webhook":
+			worker.senders = append(worker.senders, fallback.NewWebhookSender(common.GetEnvRequired("FALLBACK_WEBHOOK_URL"),
+				common.GetEnvWithDefault("FALLBACK_WEBHOOK_TOKEN", ""), &worker.zLog))
+		case "smtp":
+			worker.senders = append(worker.senders, fallback.NewSmtpSender(common.GetEnvRequired("FALLBACK_SMTP_ADDR"),
+				common.GetEnvWithDefault("FALLBACK_SMTP_USER", ""), common.GetEnvWithDefault("FALLBACK_SMTP_PW", ""),
+				common.GetEnvRequired("FALLBACK_SMTP_FROM"), common.GetEnvRequired("FALLBACK_SMTP_RECIPIENT_FORMAT"), &worker.zLog))
+		case "push":
+			worker.senders = append(worker.senders, fallback.NewPushSender(&worker.zLog))
+		default:
+			log.Fatal("Invalid FALLBACK_SENDERS entry", zap.String("sender", name))
+		}
+	}
+	return worker
+}
+
+// Run consumes the dead-letter-queues until ctx is cancelled, an error is returned only if none of them can be consumed at
+// startup. The subscriptions which stop because of an error are restarted at the next listing of the queues
+// The notifications collected in the digests when ctx is cancelled are left in the queue, they are processed again later
+func (w *DlqWorker) Run(ctx context.Context) error {
+	if err := w.discover(ctx); err != nil && len(w.subscriptions) == 0 {
+		return err
+	}
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+	discoveryTicker := time.NewTicker(w.discoveryInterval)
+	defer discoveryTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			w.abandonAll()
+			return nil
+		case terminated := <-w.terminated:
+			if w.subscriptions[terminated.queueUrl] == terminated {
+				delete(w.subscriptions, terminated.queueUrl)
+				w.zLog.Error("Subscription of the dead-letter-queue terminated", zap.String("queueUrl", terminated.queueUrl), zap.Any("error", terminated.subscription.Err()))
+			}
+		case delivery := <-w.received:
+			w.add(ctx, delivery)
+		case <-ticker.C:
+			now := time.Now()
+			for addressee, userDigest := range w.digests {
+				if now.Sub(userDigest.createdAt) >= w.digestWindow {
+					w.flush(ctx, addressee)
+				}
+			}
+		case <-discoveryTicker.C:
+			if err := w.discover(ctx); err != nil {
+				w.zLog.Error("Error while listing the dead-letter-queues", zap.Any("error", err))
+			}
+		}
+	}
+}
+
+// discover subscribes to the dead-letter-queues which are not consumed yet, and deletes the drained ones whose queue has
+// been deleted
+func (w *DlqWorker) discover(ctx context.Context) (err error) {
+	var queueUrls []string
+	if w.queueUrl != "" {
+		queueUrls = append(queueUrls, w.queueUrl)
+	}
+	if w.queueNamePrefix != "" {
+		listed, errList := w.sqs.ListMessageQueues(w.queueNamePrefix)
+		if errList != nil {
+			err = errList
+		}
+		for _, queueUrl := range listed {
+			if sqs.IsDeadLetterQueue(queueUrl) {
+				queueUrls = append(queueUrls, queueUrl)
+			}
+		}
+	}
+	deleter, canDelete := w.broker.(drainedQueueDeleter)
+	for _, queueUrl := range queueUrls {
+		if existing, ok := w.subscriptions[queueUrl]; ok {
+			if !canDelete || queueUrl == w.queueUrl {
+				continue
+			}
+			if deleted, errDelete := deleter.DeleteDrainedDeadLetterQueue(queueUrl); errDelete != nil {
+				w.zLog.Error("Error while deleting the drained dead-letter-queue", zap.String("queueUrl", queueUrl), zap.Any("error", errDelete))
+			} else if deleted {
+				existing.cancel()
+				delete(w.subscriptions, queueUrl)
+			}
+			continue
+		}
+		if errSubscribe := w.subscribe(ctx, queueUrl); errSubscribe != nil {
+			w.zLog.Error("Error while subscribing to the dead-letter-queue", zap.String("queueUrl", queueUrl), zap.Any("error", errSubscribe))
+			err = errSubscribe
+		}
+	}
+	return err
+}
+
+// subscribe starts consuming the dead-letter-queue, w.terminated is notified when the subscription stops
+func (w *DlqWorker) subscribe(ctx context.Context, queueUrl string) error {
+	subscriptionCtx, cancel := context.WithCancel(ctx)
+	subscription, err := w.broker.Subscribe(subscriptionCtx, queueUrl, w.received)
+	if err != nil {
+		cancel()
+		return err
+	}
+	entry := &queueSubscription{queueUrl: queueUrl, subscription: subscription, cancel: cancel}
+	w.subscriptions[queueUrl] = entry
+	w.zLog.Info("Processing dead-letter-queue", zap.String("queueUrl", queueUrl))
+	go func() {
+		<-subscription.Done()
+		select {
+		case w.terminated <- entry:
+		case <-ctx.Done():
+		}
+	}()
+	return nil
+}
+
+// add puts the notification into the digest of its addressee, the digest is sent right away if it becomes full
+func (w *DlqWorker) add(ctx context.Context, delivery model.NotificationMeta) {
+	addressee := delivery.Notification.Addressee
+	userDigest, ok := w.digests[addressee]
+	if !ok {
+		userDigest = &digest{createdAt: time.Now()}
+		w.digests[addressee] = userDigest
+	}
+	//Keep the notification hidden in the queue while it waits in the digest
+	userDigest.leases = append(userDigest.leases, w.leaser.Acquire(ctx, delivery))
+	if len(userDigest.leases) >= w.digestSize {
+		w.flush(ctx, addressee)
+	}
+}
+
+// flush sends the digest of the addressee through the first fallback sender which succeeds
+func (w *DlqWorker) flush(ctx context.Context, addressee string) {
+	userDigest := w.digests[addressee]
+	delete(w.digests, addressee)
+	notifications := make([]model.Notification, 0, len(userDigest.leases))
+	for _, lease := range userDigest.leases {
+		notifications = append(notifications, lease.Delivery.Notification)
+	}
+	for _, sender := range w.senders {
+		if err := sender.Send(ctx, addressee, notifications); err != nil {
+			w.zLog.Error("Fallback delivery failed", zap.String("sender", sender.Name()), zap.String("addressee", addressee), zap.Any("error", err))
+			continue
+		}
+		w.zLog.Debug("Fallback delivery succeeded", zap.String("sender", sender.Name()), zap.String("addressee", addressee), zap.Int("quantity", len(notifications)))
+		for _, lease := range userDigest.leases {
+			if err := lease.Ack(ctx); err != nil {
+				w.zLog.Error("Error while deleting notification from the dead-letter-queue", zap.String("message_id", lease.Delivery.Notification.Id), zap.Any("error", err))
+			}
+		}
+		return
+	}
+	//None of the senders succeeded, the notifications are retried when their visibility timeout expires
+	for _, lease := range userDigest.leases {
+		lease.Stop()
+	}
+}
+
+// abandonAll stops the leases of all the collected notifications, thus they reappear in the queue
+func (w *DlqWorker) abandonAll() {
+	for addressee, userDigest := range w.digests {
+		for _, lease := range userDigest.leases {
+			lease.Stop()
+		}
+		delete(w.digests, addressee)
+	}
+}
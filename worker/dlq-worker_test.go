@@ -0,0 +1,124 @@
+package worker
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"notification-service/common/broker"
+	"notification-service/common/fallback"
+	sqs "notification-service/common/sqs"
+	"notification-service/model"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSender records the notifications it has sent
+type fakeSender struct {
+	mutex sync.Mutex
+	sent  map[string][]model.Notification
+}
+
+func (f *fakeSender) Name() string {
+	return "fake"
+}
+
+func (f *fakeSender) Send(ctx context.Context, addressee string, notifications []model.Notification) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.sent[addressee] = append(f.sent[addressee], notifications...)
+	return nil
+}
+
+func (f *fakeSender) count(addressee string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.sent[addressee])
+}
+
+// fakeQueueList lists the given queues
+type fakeQueueList struct {
+	sqs.SqsServiceInterface
+	queueUrls []string
+}
+
+func (f *fakeQueueList) ListMessageQueues(queueNamePrefix string) (queueUrls []string, err error) {
+	return f.queueUrls, nil
+}
+
+// drainingBroker reports the queues listed in drained as drained dead-letter-queues
+type drainingBroker struct {
+	*broker.MemoryBroker
+	drained map[string]bool
+}
+
+func (b *drainingBroker) DeleteDrainedDeadLetterQueue(queueUrl string) (deleted bool, err error) {
+	if !b.drained[queueUrl] {
+		return false, nil
+	}
+	return true, b.DeleteDestination(queueUrl)
+}
+
+func newTestWorker(b broker.Broker, sender fallback.Sender) *DlqWorker {
+	worker := &DlqWorker{
+		zLog:              *zap.NewNop(),
+		broker:            b,
+		senders:           []fallback.Sender{sender},
+		discoveryInterval: time.Hour,
+		digestSize:        10,
+		digests:           make(map[string]*digest),
+		subscriptions:     make(map[string]*queueSubscription),
+		received:          make(chan model.NotificationMeta),
+		terminated:        make(chan *queueSubscription),
+	}
+	worker.leaser = broker.NewLeaser(b, time.Minute, &worker.zLog)
+	return worker
+}
+
+func TestDlqWorkerConsumesDiscoveredQueues(t *testing.T) {
+	b := broker.NewMemoryBroker(time.Minute)
+	sender := &fakeSender{sent: make(map[string][]model.Notification)}
+	worker := newTestWorker(b, sender)
+	worker.queueUrl = "shared-dlq"
+	worker.queueNamePrefix = "prefix"
+	worker.sqs = &fakeQueueList{queueUrls: []string{"prefix-a", "prefix-a-dlq", "prefix-b-dlq.fifo"}}
+	for _, queueUrl := range []string{"shared-dlq", "prefix-a", "prefix-a-dlq", "prefix-b-dlq.fifo"} {
+		if _, err := b.Publish(context.Background(), queueUrl, model.Notification{Addressee: queueUrl, Body: "body"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = worker.Run(ctx) }()
+	deadline := time.Now().Add(3 * time.Second)
+	for sender.count("shared-dlq")+sender.count("prefix-a-dlq")+sender.count("prefix-b-dlq.fifo") < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the dead-letter-queues have not been consumed: %v", sender.sent)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	//The instance queue is not a dead-letter-queue
+	if sender.count("prefix-a") != 0 {
+		t.Fatalf("the instance queue has been consumed")
+	}
+}
+
+func TestDlqWorkerDeletesDrainedQueues(t *testing.T) {
+	b := &drainingBroker{MemoryBroker: broker.NewMemoryBroker(time.Minute), drained: map[string]bool{"prefix-a-dlq": true}}
+	worker := newTestWorker(b, &fakeSender{sent: make(map[string][]model.Notification)})
+	worker.queueNamePrefix = "prefix"
+	worker.sqs = &fakeQueueList{queueUrls: []string{"prefix-a-dlq", "prefix-b-dlq"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := worker.discover(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(worker.subscriptions) != 2 {
+		t.Fatalf("unexpected subscriptions: %v", worker.subscriptions)
+	}
+	if err := worker.discover(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := worker.subscriptions["prefix-a-dlq"]; ok || len(worker.subscriptions) != 1 {
+		t.Fatalf("the drained dead-letter-queue is still consumed: %v", worker.subscriptions)
+	}
+}